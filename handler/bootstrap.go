@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/arsham/logpipe/tools"
@@ -27,10 +28,11 @@ type Server interface {
 }
 
 // ServeHTTP will set up the handlers and starts listening to the port. It sets
-// up the server in a goroutine. It will shut down when it receives an Interrupt
-// signal from the OS. It will hold on to the active connections until they
-// finish their work, or a timeout occurs. It returns any errors occurred during
-// the service.
+// up the server in a goroutine. It will shut down when it receives a signal on
+// stop. It will hold on to the active connections until they finish their
+// work, or a timeout occurs. If the server can be shut down, like a Service,
+// it waits for the queued entries to be written and closes the writers within
+// the same timeout. It returns any errors occurred during the service.
 var ServeHTTP func(s Server, logger tools.FieldLogger, stop chan os.Signal, port int) error
 
 func init() {
@@ -39,14 +41,15 @@ func init() {
 
 // Bootstrap reads the command options and starts the server. It returns nil
 // when the server finishes its work successfully, or else it will return the
-// error.
+// error. When a SIGHUP signal is received, all file writers are reopened. It
+// shuts down on SIGINT and SIGTERM.
 func Bootstrap(logger tools.FieldLogger, configFile string, port int) error {
 	if logger == nil {
 		logger = tools.GetLogger("error")
 	}
 
 	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
 	c, err := config.Read(configFile)
 	if err != nil {
@@ -55,22 +58,71 @@ func Bootstrap(logger tools.FieldLogger, configFile string, port int) error {
 
 	logger.Infof("config file: %s", configFile)
 
-	s, err := New(
+	opts := []func(*Service) error{
 		WithLogger(logger),
 		WithConfWriters(logger, c),
-	)
+		WithIngestLimit(c.MaxInFlight, c.MaxQueued, c.QueueTimeout, c.RetryAfter),
+	}
+	if c.Ack {
+		opts = append(opts, WithAck())
+	}
+	s, err := New(opts...)
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("creating the service: %s", configFile))
 	}
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	done := make(chan struct{})
+	defer close(done)
+	go reopenOnSignal(s, logger, hup, done)
+
 	logger.Infof("running on port: %d", port)
 	return ServeHTTP(s, logger, stop, port)
 }
 
-// see ServeHTTP.
+// reopenOnSignal reopens the writers of the service every time a signal is
+// received on hup, until done is closed.
+func reopenOnSignal(s *Service, logger tools.FieldLogger, hup chan os.Signal, done chan struct{}) {
+	for {
+		select {
+		case <-hup:
+			logger.Info("reopening the writers")
+			s.Reopen()
+		case <-done:
+			return
+		}
+	}
+}
+
+// shutdowner is implemented by the servers that close their writers, like
+// Service.
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// statusServer is implemented by the servers that report the state of their
+// writers.
+type statusServer interface {
+	ServeStatus(w http.ResponseWriter, r *http.Request)
+}
+
+// see ServeHTTP. If the server reports the state of its writers, it is served
+// for the GET requests of the /status path. The other requests of the path
+// are entries, and are passed to the server.
 func serveHTTP(s Server, logger tools.FieldLogger, stop chan os.Signal, port int) error {
 	mux := http.NewServeMux()
 	mux.Handle("/", s)
+	if st, ok := s.(statusServer); ok {
+		mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				s.ServeHTTP(w, r)
+				return
+			}
+			st.ServeStatus(w, r)
+		})
+	}
 	h := &http.Server{
 		Addr:    ":" + strconv.Itoa(port),
 		Handler: mux,
@@ -93,6 +145,13 @@ func serveHTTP(s Server, logger tools.FieldLogger, stop chan os.Signal, port int
 		ctx, cancel := context.WithTimeout(context.Background(), s.Timeout())
 		defer cancel()
 		logger.Infof("shutting down the server: %s", h.Shutdown(ctx))
+		if sd, ok := s.(shutdowner); ok {
+			if err := sd.Shutdown(ctx); err != nil {
+				logger.Error(errors.Wrap(err, "closing the writers"))
+			} else {
+				logger.Info("closed the writers")
+			}
+		}
 	}
 	return nil
 }
@@ -9,9 +9,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/arsham/logpipe/handler"
@@ -96,7 +100,7 @@ writers:
 
 		Context("when config file does not exist", func() {
 			var (
-				filename = "/no where to find"
+				filename = path.Join(os.TempDir(), "no where to find")
 				err      error
 			)
 			JustBeforeEach(func() {
@@ -178,6 +182,20 @@ writers:
 			})
 		})
 
+		Context("when receiving a SIGHUP signal", func() {
+			BeforeEach(func() {
+				serveFunc = func(s handler.Server, logger tools.FieldLogger, stop chan os.Signal, port int) error {
+					Expect(syscall.Kill(os.Getpid(), syscall.SIGHUP)).NotTo(HaveOccurred())
+					Eventually(logWriter.String).Should(ContainSubstring("reopening the writers"))
+					return nil
+				}
+			})
+
+			It("should reopen the writers", func() {
+				Expect(handler.Bootstrap(logger, configFile, port)).NotTo(HaveOccurred())
+			})
+		})
+
 		Context("when server has an error while serving", func() {
 
 			var (
@@ -247,6 +265,26 @@ var _ = Describe("Serve", func() {
 			close(done)
 		}, timeout.Seconds()+2)
 
+		Context("requesting the status path", func() {
+			It("should serve the status for GET and pass the entries to the service", func() {
+				url := fmt.Sprintf("http://127.0.0.1:%d/status", port)
+				Eventually(func() error {
+					_, err := http.Get(url)
+					return err
+				}).Should(Succeed())
+
+				resp, err := http.Get(url)
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				resp, err = http.Post(url, "application/json", strings.NewReader("{}"))
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			})
+		})
+
 		Context("calling serve twice", func() {
 			It("should return an error saying the address is already in use", func(done Done) {
 				// waiting for the first serve to finish starting up
@@ -290,6 +328,29 @@ var _ = Describe("Serve", func() {
 					Eventually(logWriter.String).Should(ContainSubstring("shutting down"))
 				})
 			})
+
+			Context("when sending the SIGTERM", func() {
+				It("should close the writers of the service", func() {
+					w := &closingWriter{gate: make(chan struct{})}
+					w.release()
+					service, err := handler.New(
+						handler.WithLogger(logger),
+						handler.WithWriters(w),
+						handler.WithTimeout(timeout),
+					)
+					Expect(err).NotTo(HaveOccurred())
+					stop := make(chan os.Signal)
+					errChan := make(chan error)
+					go func() {
+						errChan <- handler.ServeHTTP(service, logger, stop, port)
+					}()
+					stop <- syscall.SIGTERM
+
+					Expect(<-errChan).To(BeNil())
+					Expect(w.Closed()).To(BeTrue())
+					Expect(logWriter.String()).To(ContainSubstring("closed the writers"))
+				})
+			})
 		})
 	})
 })
@@ -0,0 +1,242 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/arsham/logpipe/tools"
+	"github.com/arsham/logpipe/tools/config"
+	"github.com/arsham/logpipe/writer"
+	"github.com/pkg/errors"
+)
+
+// This file contains the logic for recording the entries that the writers
+// give up on, and writing them again.
+
+// bury records the entry that the writer has given up on in the dead letter
+// file.
+func (l *Service) bury(p *reader.Plain, name string, err error) {
+	entry, e := p.MarshalJSON()
+	if e != nil {
+		l.Logger.WithField("writer", name).Error(errors.Wrap(e, "encoding the dead letter"))
+		return
+	}
+	l.record(&writer.DeadRecord{
+		Writer:   name,
+		Error:    err.Error(),
+		Attempts: attempts(err),
+		Entry:    entry,
+	})
+}
+
+// failureReporter is implemented by the writers that report the entries they
+// fail to write after the write has returned, for example the batched ones.
+type failureReporter interface {
+	OnFailure(func(p, payload []byte, err error))
+}
+
+// burier returns a function that records the entries that the writer has
+// given up on after the write has returned, for example in its batch or its
+// WAL, in the dead letter file. The payload of the entries is recorded, or if
+// it is not known, the entry is decoded from the formatted line.
+func burier(logger tools.FieldLogger, d *writer.DeadLetter, name string) func(p, payload []byte, err error) {
+	return func(p, payload []byte, err error) {
+		if len(payload) == 0 {
+			var e error
+			if payload, e = linePayload(p); e != nil {
+				logger.WithField("writer", name).Error(errors.Wrap(e, "encoding the dead letter"))
+				return
+			}
+		}
+		r := &writer.DeadRecord{
+			Writer:   name,
+			Error:    err.Error(),
+			Attempts: attempts(err),
+			Entry:    payload,
+		}
+		if err := d.Record(r); err != nil {
+			logger.WithField("writer", name).Error(errors.Wrap(err, "recording the dead letter"))
+		}
+	}
+}
+
+// linePayload returns the payload of the entry that is formatted in p.
+func linePayload(p []byte) ([]byte, error) {
+	entries, err := reader.ParseEntries(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, errors.New("not a single entry")
+	}
+	return entries[0].MarshalJSON()
+}
+
+func (l *Service) record(r *writer.DeadRecord) {
+	if err := l.deadLetter.Record(r); err != nil {
+		l.Logger.WithField("writer", r.Writer).Error(errors.Wrap(err, "recording the dead letter"))
+	}
+}
+
+// attempts returns the number of the times the writer tried to write the
+// entry before giving up.
+func attempts(err error) int {
+	if e, ok := err.(*writer.RetryError); ok {
+		return e.Attempts
+	}
+	switch err {
+	case writer.ErrBreakerOpen, writer.ErrQueueFull, writer.ErrDropped, writer.ErrStopped, writer.ErrWALFull:
+		return 0
+	}
+	return 1
+}
+
+// Replay writes the entries of the dead letter records in r into the writers
+// that gave up on them, and waits for the results. The entries that fail
+// again, and the records of the writers that are not in the service, are
+// recorded in the dead letter file again. It returns the number of the
+// entries that are written, and an error if there is no dead letter file or
+// r has invalid records.
+func (l *Service) Replay(r io.Reader) (int, error) {
+	if l.deadLetter == nil {
+		return 0, ErrNoDeadLetter
+	}
+	records, err := writer.ReadDeadRecords(r)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading the dead letters")
+	}
+
+	var written int
+	for _, rec := range records {
+		w := l.writerNamed(rec.Writer)
+		if w == nil {
+			l.Logger.WithField("writer", rec.Writer).Warn("no such writer for replaying the dead letter")
+			l.record(rec)
+			continue
+		}
+		if err := l.replay(w, rec); err != nil {
+			l.Logger.WithField("writer", rec.Writer).Error(errors.Wrap(err, "replaying the dead letter"))
+			continue
+		}
+		written++
+	}
+	return written, nil
+}
+
+// replay writes the entry of the record into w and waits for the result. The
+// entry is recorded again if it fails.
+func (l *Service) replay(w io.Writer, rec *writer.DeadRecord) error {
+	plains, err := reader.GetPlains(bytes.NewReader(rec.Entry), l.Logger)
+	if err == nil && len(plains) != 1 {
+		err = errors.New("not a single entry")
+	}
+	if err != nil {
+		l.record(rec)
+		return err
+	}
+	p := plains[0]
+	b, err := ioutil.ReadAll(p)
+	if err != nil {
+		l.record(rec)
+		return err
+	}
+
+	q, err := l.queue(w)
+	if err != nil {
+		l.record(rec)
+		return err
+	}
+	d, err := writer.NewDistributeWith(
+		writer.WithDistributeWriters(q),
+		writer.WithDistributeLogger(l.Logger),
+		writer.WithDistributePayload(rec.Entry),
+		writer.WithDistributeOnFailure(func(name string, err error) {
+			l.bury(p, name, err)
+		}),
+	)
+	if err != nil {
+		l.record(rec)
+		return err
+	}
+	_, err = d.Write(b)
+	return err
+}
+
+// writerNamed returns the writer with the name, or nil if there is no such
+// writer.
+func (l *Service) writerNamed(name string) io.Writer {
+	for _, w := range l.Writers {
+		if l.name(w) == name {
+			return w
+		}
+	}
+	return nil
+}
+
+// name returns the name of the writer in the settings, or the name the queue
+// would report for it.
+func (l *Service) name(w io.Writer) string {
+	if name, ok := l.names[w]; ok {
+		return name
+	}
+	if n, ok := w.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", w)
+}
+
+// Replay reads the configuration file, and writes the entries of the dead
+// letter file into the writers that gave up on them. The settings should have
+// a dead_letter file for recording the entries that fail again, which can be
+// the same file. The file is renamed with a .replaying suffix while it is
+// being replayed, and is removed when the writers are closed. If anything
+// goes wrong, the renamed file is kept for replaying it again.
+func Replay(logger tools.FieldLogger, configFile, file string) error {
+	if logger == nil {
+		logger = tools.GetLogger("error")
+	}
+	c, err := config.Read(configFile)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("reading config file: %s", configFile))
+	}
+	if c.DeadLetter == "" {
+		return ErrNoDeadLetter
+	}
+
+	// the file is renamed before the service opens the dead letter file,
+	// which might be at the same location.
+	replaying := file + ".replaying"
+	if err := os.Rename(file, replaying); err != nil {
+		return errors.Wrap(err, "moving the dead letter file")
+	}
+	f, err := os.Open(replaying)
+	if err != nil {
+		return errors.Wrap(err, "opening the dead letter file")
+	}
+	defer f.Close()
+
+	s, err := New(
+		WithLogger(logger),
+		WithConfWriters(logger, c),
+	)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("creating the service: %s", configFile))
+	}
+	n, err := s.Replay(f)
+	if cerr := s.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "replaying %s", replaying)
+	}
+	logger.Infof("replayed %d entries from %s", n, file)
+	return os.Remove(replaying)
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package handler_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+
+	"github.com/arsham/logpipe/handler"
+	"github.com/arsham/logpipe/tools"
+	"github.com/arsham/logpipe/tools/config"
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dead letters", func() {
+	var (
+		dir        string
+		deadLetter string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "test_handler_dead_letter")
+		Expect(err).NotTo(HaveOccurred())
+		deadLetter = path.Join(dir, "dead.log")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	records := func() []*writer.DeadRecord {
+		f, err := os.Open(deadLetter)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		records, _ := writer.ReadDeadRecords(f)
+		return records
+	}
+
+	It("should record the entries that the writers give up on", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		addr := l.Addr().String()
+		l.Close()
+		c := &config.Setting{
+			DeadLetter: deadLetter,
+			Writers: map[string]map[string]string{
+				"billing": {"type": "syslog", "network": "tcp", "address": addr, "retry_attempts": "2", "retry_backoff": "1ms"},
+				"shop":    {"type": "file", "location": path.Join(dir, "shop.log")},
+			},
+		}
+		s := &handler.Service{Logger: tools.DiscardLogger()}
+		Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+
+		body := `{"type":"error","message":"payment failed","timestamp":"2017-10-09T10:45:00Z","app":"billing"}`
+		req, err := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+		Expect(err).NotTo(HaveOccurred())
+		s.ServeHTTP(httptest.NewRecorder(), req)
+
+		Eventually(records).Should(HaveLen(1))
+		rec := records()[0]
+		Expect(rec.Writer).To(Equal("billing"))
+		Expect(rec.Attempts).To(Equal(2))
+		Expect(rec.Error).NotTo(BeEmpty())
+		Expect(rec.Entry).To(MatchJSON(body))
+		s.Close()
+	})
+
+	It("should record the entries that the wal gives up on", func() {
+		billing := path.Join(dir, "billing.log")
+		c := &config.Setting{
+			DeadLetter: deadLetter,
+			Writers: map[string]map[string]string{
+				"billing": {"type": "file", "location": billing, "wal": path.Join(dir, "wal"), "wal_attempts": "1"},
+			},
+		}
+		s := &handler.Service{Logger: tools.DiscardLogger()}
+		Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+		Expect(s.Writers[0].(*writer.File).Close()).To(Succeed())
+
+		body := `{"type":"error","message":"payment failed","timestamp":"2017-10-09T10:45:00Z"}`
+		req, err := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+		Expect(err).NotTo(HaveOccurred())
+		s.ServeHTTP(httptest.NewRecorder(), req)
+
+		Eventually(records).Should(HaveLen(1))
+		rec := records()[0]
+		Expect(rec.Writer).To(Equal("billing"))
+		Expect(rec.Attempts).To(Equal(1))
+		Expect(rec.Entry).To(MatchJSON(body))
+		s.Close()
+	})
+
+	Describe("Replay", func() {
+		var (
+			location   string
+			configFile string
+			deadFile   string
+		)
+
+		BeforeEach(func() {
+			location = path.Join(dir, "billing.log")
+			configFile = path.Join(dir, "config.yml")
+			deadFile = path.Join(dir, "replay.log")
+			conf := fmt.Sprintf("app:\n  dead_letter: %s\nwriters:\n  billing:\n    type: file\n    location: %s\n", deadLetter, location)
+			Expect(ioutil.WriteFile(configFile, []byte(conf), 0644)).To(Succeed())
+
+			d, err := writer.NewDeadLetter(writer.WithDeadLetterLocation(deadFile))
+			Expect(err).NotTo(HaveOccurred())
+			for _, rec := range []*writer.DeadRecord{
+				{Writer: "billing", Entry: []byte(`{"message":"first entry"}`)},
+				{Writer: "gone", Entry: []byte(`{"message":"orphan entry"}`)},
+				{Writer: "billing", Entry: []byte(`{"message":"second entry"}`)},
+			} {
+				Expect(d.Record(rec)).To(Succeed())
+			}
+			Expect(d.Close()).To(Succeed())
+		})
+
+		It("should write the entries into their writers again", func() {
+			Expect(handler.Replay(tools.DiscardLogger(), configFile, deadFile)).To(Succeed())
+
+			b, err := ioutil.ReadFile(location)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(ContainSubstring("first entry"))
+			Expect(string(b)).To(ContainSubstring("second entry"))
+			Expect(string(b)).NotTo(ContainSubstring("orphan entry"))
+
+			By("keeping the records of the unknown writers")
+			Expect(records()).To(HaveLen(1))
+			Expect(records()[0].Writer).To(Equal("gone"))
+			_, err = os.Stat(deadFile)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			_, err = os.Stat(deadFile + ".replaying")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("should replay the dead letter file of the settings", func() {
+			Expect(os.Rename(deadFile, deadLetter)).To(Succeed())
+			Expect(handler.Replay(tools.DiscardLogger(), configFile, deadLetter)).To(Succeed())
+			Expect(records()).To(HaveLen(1))
+		})
+
+		It("should error without a dead letter file in the settings", func() {
+			conf := fmt.Sprintf("writers:\n  billing:\n    type: file\n    location: %s\n", location)
+			Expect(ioutil.WriteFile(configFile, []byte(conf), 0644)).To(Succeed())
+			err := handler.Replay(tools.DiscardLogger(), configFile, deadFile)
+			Expect(err).To(Equal(handler.ErrNoDeadLetter))
+			_, err = os.Stat(deadFile)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+})
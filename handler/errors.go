@@ -17,4 +17,6 @@ var (
 	ErrGettingReader   = errors.New("getting reader")
 	ErrNoOptions       = errors.New("no option provided")
 	ErrTimeout         = errors.New("timeout cannot be zero")
+	ErrNoDeadLetter    = errors.New("no dead letter file specified")
+	ErrShuttingDown    = errors.New("shutting down")
 )
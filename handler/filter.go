@@ -0,0 +1,219 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/arsham/logpipe/tools/config"
+	"github.com/pkg/errors"
+)
+
+// This file contains the logic for deciding which entries are written to
+// which writers.
+
+// levelRanks orders the levels from the least to the most severe.
+var levelRanks = map[string]int{
+	reader.DebugLevel: 0,
+	reader.InfoLevel:  1,
+	reader.WarnLevel:  2,
+	reader.ErrorLevel: 3,
+}
+
+// levelFilter is the set of levels that are written to a writer.
+type levelFilter map[string]bool
+
+func (f levelFilter) allows(level string) bool {
+	return f[normalLevel(level)]
+}
+
+// normalLevel returns the level in lower case, and warning for warn.
+func normalLevel(level string) string {
+	level, _ = reader.NormalLevel(level)
+	return level
+}
+
+// newLevelFilter returns a filter from the min_level or the levels keys of the
+// settings. It returns nil if none of them are set.
+func newLevelFilter(conf map[string]string) (levelFilter, error) {
+	minLevel, hasMin := conf["min_level"]
+	levels, hasLevels := conf["levels"]
+	if hasMin && hasLevels {
+		return nil, errors.New("min_level and levels can not be used together")
+	}
+
+	filter := make(levelFilter)
+	switch {
+	case hasMin:
+		min, ok := levelRanks[normalLevel(minLevel)]
+		if !ok {
+			return nil, errors.Errorf("min_level: unknown level: %s", minLevel)
+		}
+		for level, rank := range levelRanks {
+			if rank >= min {
+				filter[level] = true
+			}
+		}
+	case hasLevels:
+		for _, level := range listValue(levels) {
+			if _, ok := levelRanks[normalLevel(level)]; !ok {
+				return nil, errors.Errorf("levels: unknown level: %s", level)
+			}
+			filter[normalLevel(level)] = true
+		}
+	default:
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// route sends the entries that match all of its conditions to its writers.
+type route struct {
+	conditions []condition
+	writers    []io.Writer
+}
+
+// condition tests a field of the entries.
+type condition struct {
+	field  string
+	equals *string
+	regex  *regexp.Regexp
+	exists *bool
+}
+
+// router chooses the writers of the entries. The entries that do not match
+// any routes are written to the fallback writers.
+type router struct {
+	routes   []route
+	fallback []io.Writer
+}
+
+// newRouter returns a router from the routes of the settings. The names are
+// the writers by their names in the settings. Writers that are not in names
+// are left out of the routes, as they have not been set up.
+func newRouter(routes []config.Route, names map[string]io.Writer) (*router, error) {
+	r := &router{}
+	for i, cr := range routes {
+		var rt route
+		for _, name := range cr.Writers {
+			if w, ok := names[name]; ok {
+				rt.writers = append(rt.writers, w)
+			}
+		}
+		for _, cc := range cr.Match {
+			c, err := newCondition(cc)
+			if err != nil {
+				return nil, errors.Wrapf(err, "route %d: %s", i+1, cc.Field)
+			}
+			rt.conditions = append(rt.conditions, c)
+		}
+		if cr.Default {
+			r.fallback = rt.writers
+			continue
+		}
+		r.routes = append(r.routes, rt)
+	}
+	return r, nil
+}
+
+func newCondition(c config.Condition) (condition, error) {
+	cond := condition{field: c.Field}
+	switch c.Operator {
+	case config.Equals:
+		value := c.Value
+		cond.equals = &value
+	case config.Regex:
+		re, err := regexp.Compile(c.Value)
+		if err != nil {
+			return cond, errors.Wrap(err, "regex")
+		}
+		cond.regex = re
+	case config.Exists:
+		exists, err := strconv.ParseBool(c.Value)
+		if err != nil {
+			return cond, errors.Wrap(err, "exists")
+		}
+		cond.exists = &exists
+	default:
+		return cond, errors.Errorf("unknown operator: %s", c.Operator)
+	}
+	return cond, nil
+}
+
+// matches returns true if the field of the entry passes the condition.
+func (c condition) matches(p *reader.Plain) bool {
+	value, ok := fieldValue(p, c.field)
+	switch {
+	case c.exists != nil:
+		return ok == *c.exists
+	case !ok:
+		return false
+	case c.regex != nil:
+		return c.regex.MatchString(value)
+	default:
+		return value == *c.equals
+	}
+}
+
+// fieldValue returns the string value of the field of the entry. The "type"
+// and "message" fields are the level and the message of the entry.
+func fieldValue(p *reader.Plain, field string) (string, bool) {
+	switch field {
+	case "type":
+		return p.Kind, true
+	case "message":
+		return p.Message, true
+	}
+	v, ok := p.Fields[field]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(v), true
+}
+
+// writers returns the set of writers of all routes that match the entry, or
+// the fallback writers if none of them match.
+func (r *router) writers(p *reader.Plain) map[io.Writer]bool {
+	set := make(map[io.Writer]bool)
+ROUTES:
+	for _, rt := range r.routes {
+		for _, c := range rt.conditions {
+			if !c.matches(p) {
+				continue ROUTES
+			}
+		}
+		for _, w := range rt.writers {
+			set[w] = true
+		}
+	}
+	if len(set) > 0 {
+		return set
+	}
+	for _, w := range r.fallback {
+		set[w] = true
+	}
+	return set
+}
+
+// routed returns true if any of the routes write to the writer.
+func (r *router) routed(w io.Writer) bool {
+	for _, fw := range r.fallback {
+		if fw == w {
+			return true
+		}
+	}
+	for _, rt := range r.routes {
+		for _, rw := range rt.writers {
+			if rw == w {
+				return true
+			}
+		}
+	}
+	return false
+}
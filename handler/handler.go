@@ -10,9 +10,13 @@
 package handler
 
 import (
+	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/arsham/logpipe/reader"
@@ -22,6 +26,13 @@ import (
 	"github.com/pkg/errors"
 )
 
+// AckHeader is the header of the requests that wait for their entries to be
+// written. Its value should be AckWritten.
+const (
+	AckHeader  = "X-Logpipe-Ack"
+	AckWritten = "written"
+)
+
 // Service listens to the incoming http requests and decides how to route the
 // payload to be written.
 type Service struct {
@@ -33,6 +44,57 @@ type Service struct {
 
 	// timeout for shutting down the http server. Default is 5 seconds.
 	timeout time.Duration
+
+	// filters decide which levels are written to the writers. Writers without
+	// a filter receive all entries.
+	filters map[io.Writer]levelFilter
+
+	// router chooses the writers of each entry. If it is nil, the entries
+	// are written to all writers.
+	router *router
+
+	// timeouts are the deadlines of writing each entry into the writers.
+	timeouts map[io.Writer]time.Duration
+
+	// names are the names of the writers in the settings, for reporting
+	// their errors.
+	names map[io.Writer]string
+
+	// quorum is the number of the writers that should succeed in writing each
+	// entry. Zero means all writers.
+	quorum int
+
+	// mu guards queues.
+	mu sync.Mutex
+
+	// queues hold the entries of the writers, and write them in their own
+	// workers. They are a *writer.WAL for the writers with a wal directory,
+	// and a *writer.Queue created on the first write for the others.
+	queues map[io.Writer]io.Writer
+
+	// queueOpts are the depth and the overflow policy of the queues.
+	queueOpts map[io.Writer][]func(*writer.Queue) error
+
+	// retries write into the writers that have retry or breaker settings.
+	// The queues write into them instead of the writers.
+	retries map[io.Writer]*writer.Retry
+
+	// deadLetter records the entries that the writers give up on. If it is
+	// nil, the failures are only logged.
+	deadLetter *writer.DeadLetter
+
+	// limiter bounds the requests that are handled at the same time. If it is
+	// nil, there is no limit.
+	limiter *limiter
+
+	// ack makes all requests wait for their entries to be written.
+	ack bool
+
+	// lifeMu guards closing, and is held while adding to requests, so
+	// Shutdown can wait for the requests safely.
+	lifeMu   sync.Mutex
+	closing  bool
+	requests sync.WaitGroup
 }
 
 // New returns an error if there is no logger or no writer specified.
@@ -63,32 +125,264 @@ func New(opts ...func(*Service) error) (*Service, error) {
 // Timeout returns the timeout associated with this service.
 func (l *Service) Timeout() time.Duration { return l.timeout }
 
+// reopener is implemented by the writers that can reopen their files.
+type reopener interface {
+	Reopen() error
+}
+
+// Reopen reopens all the writers that write to files. It logs the errors and
+// continues with the next writer.
+func (l *Service) Reopen() {
+	for _, w := range l.Writers {
+		r, ok := w.(reopener)
+		if !ok {
+			continue
+		}
+		if err := r.Reopen(); err != nil {
+			l.Logger.Error(errors.Wrap(err, "reopening the writer"))
+		}
+	}
+}
+
 func (l *Service) writeError(w http.ResponseWriter, err error, status int) {
 	w.WriteHeader(status)
 	fmt.Fprint(w, err.Error())
 	l.Logger.Error(err)
 }
 
-// ServeHTTP handles the logs coming from the endpoint. It handles the writes in
-// a goroutine in order to avoid write loss. It will log any errors that might
-// occur during writes. It returns a http.StatusBadRequest if the payload is not
-// a valid JSON object or does not contain the required fields.
+// ServeHTTP handles the logs coming from the endpoint. It puts the entries in
+// the queues of the writers, and each writer writes them in its own worker. It
+// will log any errors that might occur during writes. It returns a
+// http.StatusBadRequest if the payload is not a valid JSON object or does not
+// contain the required fields. Gzipped payloads are accepted with the
+// "Content-Encoding: gzip" header. If the service has an ingest limit, the
+// requests over the limit are refused with a http.StatusTooManyRequests or
+// http.StatusServiceUnavailable and a Retry-After header. After Shutdown is
+// called, the requests are refused with a http.StatusServiceUnavailable.
+//
+// In the ack mode, which is set with WithAck or the "X-Logpipe-Ack: written"
+// header, it waits until all writers, or the quorum of them, have written and
+// flushed the entries. If any entry fails, it returns a
+// http.StatusBadGateway with the errors of the writers of each failed entry.
 func (l *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	rd, err := reader.GetReader(r.Body, l.Logger)
+	if !l.begin() {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, ErrShuttingDown.Error())
+		return
+	}
+	defer l.requests.Done()
+
+	if l.limiter != nil {
+		release, status := l.limiter.acquire(r.Context())
+		if release == nil {
+			l.Logger.Debugf("refusing the request: %s", http.StatusText(status))
+			l.limiter.reject(w, status)
+			return
+		}
+		defer release()
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			l.writeError(w, errors.Wrap(err, ErrGettingReader.Error()), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	plains, err := reader.GetPlains(body, l.Logger)
 	if errors.Cause(err) != nil {
 		l.writeError(w, errors.Wrap(err, ErrGettingReader.Error()), http.StatusBadRequest)
 		return
 	}
 
-	go func(l *Service) {
-		concWriter := writer.NewDistribute(l.Writers...)
-		_, err = io.Copy(concWriter, rd)
+	if !l.ack && !strings.EqualFold(r.Header.Get(AckHeader), AckWritten) {
+		for _, p := range plains {
+			l.write(p, nil)
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	errs := make([]error, len(plains))
+	var wg sync.WaitGroup
+	wg.Add(len(plains))
+	for i, p := range plains {
+		i := i
+		l.write(p, func(err error) {
+			errs[i] = err
+			wg.Done()
+		})
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("entry %d: %s", i, err))
+		}
+	}
+	if len(failed) > 0 {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, strings.Join(failed, "\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// write puts the entry in the queues of the writers that accept it, and
+// returns without waiting for the writes. The filtered writers never receive
+// the entry. The entries that the writers give up on are recorded in the dead
+// letter file. The writers that miss their deadline are reported without
+// holding the others. If a queue is full, it blocks or drops an entry
+// depending on its overflow policy. The writers with a WAL have recorded the
+// entry when write returns.
+//
+// If done is not nil, the writers flush the entry after writing it, and done
+// is called with the outcome when all writers, or the quorum of them, are
+// finished.
+func (l *Service) write(p *reader.Plain, done func(error)) {
+	finish := func(err error) {
+		if done != nil {
+			done(err)
+		}
+	}
+	writers := l.writersFor(p)
+	if len(writers) == 0 {
+		finish(nil)
+		return
+	}
+	b, err := ioutil.ReadAll(p)
+	if err != nil {
+		err = errors.Wrap(err, ErrWritingEntry.Error())
+		l.Logger.Error(err)
+		finish(err)
+		return
+	}
+
+	opts := []func(*writer.Distribute) error{
+		writer.WithDistributeLogger(l.Logger),
+	}
+	if done != nil {
+		opts = append(opts, writer.WithDistributeFlush())
+	}
+	if l.deadLetter != nil {
+		opts = append(opts, writer.WithDistributeOnFailure(func(name string, err error) {
+			l.bury(p, name, err)
+		}))
+		// the writers that give up on the entry later record its payload.
+		if payload, err := p.MarshalJSON(); err == nil {
+			opts = append(opts, writer.WithDistributePayload(payload))
+		}
+	}
+	queued := 0
+	for _, w := range writers {
+		q, err := l.queue(w)
 		if err != nil {
 			l.Logger.Error(errors.Wrap(err, ErrWritingEntry.Error()))
+			continue
+		}
+		queued++
+		opts = append(opts, writer.WithDistributeWriters(q))
+		if t, ok := l.timeouts[w]; ok {
+			opts = append(opts, writer.WithDistributeWriterTimeout(q, t))
 		}
-	}(l)
+	}
+	if queued == 0 {
+		finish(ErrWritingEntry)
+		return
+	}
+	if l.quorum > 0 {
+		// the entry might be routed to, or queued for, fewer writers than the
+		// quorum.
+		quorum := l.quorum
+		if quorum > queued {
+			quorum = queued
+		}
+		opts = append(opts, writer.WithDistributeQuorum(quorum))
+	}
+	concWriter, err := writer.NewDistributeWith(opts...)
+	if err != nil {
+		err = errors.Wrap(err, ErrWritingEntry.Error())
+		l.Logger.Error(err)
+		finish(err)
+		return
+	}
+	concWriter.Send(b, func(_ int, err error) {
+		if err != nil {
+			l.logWriteError(err)
+		}
+		finish(err)
+	})
+}
 
-	w.WriteHeader(http.StatusOK)
+// queue returns the queue of the writer, and creates it on the first use.
+func (l *Service) queue(w io.Writer) (io.Writer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if q, ok := l.queues[w]; ok {
+		return q, nil
+	}
+
+	opts := []func(*writer.Queue) error{writer.WithQueueLogger(l.Logger)}
+	if name, ok := l.names[w]; ok {
+		opts = append(opts, writer.WithQueueName(name))
+	}
+	target := w
+	if r, ok := l.retries[w]; ok {
+		target = r
+	}
+	q, err := writer.NewQueue(target, append(opts, l.queueOpts[w]...)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating the queue")
+	}
+	if l.queues == nil {
+		l.queues = make(map[io.Writer]io.Writer)
+	}
+	l.queues[w] = q
+	return q, nil
+}
+
+// logWriteError logs the failure of each writer with its name as the writer
+// field.
+func (l *Service) logWriteError(err error) {
+	de, ok := errors.Cause(err).(*writer.DistributeError)
+	if !ok {
+		l.Logger.Error(errors.Wrap(err, ErrWritingEntry.Error()))
+		return
+	}
+	for _, e := range de.Errors {
+		l.Logger.WithField("writer", e.Name).
+			WithField("bytes", e.N).
+			Error(errors.Wrap(e.Err, ErrWritingEntry.Error()))
+	}
+}
+
+// writersFor returns the writers that the routes choose for the entry, and
+// accept its level.
+func (l *Service) writersFor(p *reader.Plain) []io.Writer {
+	if len(l.filters) == 0 && l.router == nil {
+		return l.Writers
+	}
+	var routed map[io.Writer]bool
+	if l.router != nil {
+		routed = l.router.writers(p)
+	}
+	writers := make([]io.Writer, 0, len(l.Writers))
+	for _, w := range l.Writers {
+		if routed != nil && !routed[w] {
+			continue
+		}
+		if f, ok := l.filters[w]; ok && !f.allows(p.Kind) {
+			continue
+		}
+		writers = append(writers, w)
+	}
+	return writers
 }
 
 // WithWriters will return an error if two identical writers are injected.
@@ -108,35 +402,239 @@ func WithWriters(ws ...io.Writer) func(*Service) error {
 
 // WithConfWriters uses a config.Setting object to set up the writers.
 // If any errors occurred during writer instantiation, it stops and
-// returns that error.
+// returns that error. Writers with missing required settings are skipped with
+// a warning. The min_level or levels keys of the writers' settings limit the
+// entries that are written to them. If the settings have routes, each entry is
+// written to the writers of the routes it matches. The timeout key of the
+// writers' settings, or the write timeout of the settings, is the deadline of
+// writing each entry into the writer. The queue_depth and overflow keys set up
+// the queue of the writer. If the wal key is set, the entries are recorded in
+// that directory before they are written, and the entries of the previous
+// run are written again. The retry and breaker keys wrap the writer in a
+// writer.Retry. If the settings have a dead letter file, the entries that the
+// writers give up on are recorded in it. If a writer can not be set up, the
+// writers, the wals and the dead letter file that are already set up are
+// closed.
 func WithConfWriters(logger tools.FieldLogger, c *config.Setting) func(*Service) error {
-	var (
-		fileLocation string
-		ok           bool
-		writers      []io.Writer
-	)
+	var writers []io.Writer
+	filters := make(map[io.Writer]levelFilter)
+	names := make(map[string]io.Writer)
+	timeouts := make(map[io.Writer]time.Duration)
+	queueOpts := make(map[io.Writer][]func(*writer.Queue) error)
+	wals := make(map[io.Writer]io.Writer)
+	retries := make(map[io.Writer]*writer.Retry)
+
+	var deadLetter *writer.DeadLetter
+	// fail closes the writers, the wals and the dead letter file that are
+	// already built, and returns an option that returns err.
+	fail := func(err error, built ...io.Writer) func(*Service) error {
+		for _, r := range retries {
+			r.Stop()
+		}
+		for _, wal := range wals {
+			if closer, ok := wal.(io.Closer); ok {
+				if e := closer.Close(); e != nil {
+					logger.Error(errors.Wrap(e, "closing the wal"))
+				}
+			}
+		}
+		for _, w := range append(built, writers...) {
+			if closer, ok := w.(io.Closer); ok {
+				if e := closer.Close(); e != nil {
+					logger.Error(errors.Wrap(e, "closing the writer"))
+				}
+			}
+		}
+		if deadLetter != nil {
+			if e := deadLetter.Close(); e != nil {
+				logger.Error(errors.Wrap(e, "closing the dead letter file"))
+			}
+		}
+		return func(*Service) error {
+			return err
+		}
+	}
+
+	if c.DeadLetter != "" {
+		var err error
+		deadLetter, err = writer.NewDeadLetter(writer.WithDeadLetterLocation(c.DeadLetter))
+		if err != nil {
+			return fail(err)
+		}
+	}
 
 LOOP:
 	for name, conf := range c.Writers {
+		var (
+			w   io.Writer
+			err error
+		)
+
 		switch mod := conf["type"]; mod {
 		case "file":
-			if fileLocation, ok = conf["location"]; !ok {
-				logger.Warnf("no location in settings: %s", name)
-				continue LOOP
+			w, err = newFile(logger, conf)
+		case "elasticsearch":
+			w, err = newElasticsearch(logger, conf)
+		case "influxdb":
+			w, err = newInfluxDB(logger, conf)
+		case "syslog":
+			w, err = newSyslog(logger, conf)
+		case "http":
+			w, err = newHTTP(logger, conf)
+		case "console":
+			w, err = newConsole(conf)
+		case "loki":
+			w, err = newLoki(logger, conf)
+		case "splunk_hec":
+			w, err = newSplunkHEC(logger, conf)
+		case "sqlite":
+			w, err = newSQLite(logger, conf)
+		default:
+			continue LOOP
+		}
+
+		if key, ok := errors.Cause(err).(missingKeyError); ok {
+			logger.Warnf("%s in settings: %s", key, name)
+			continue LOOP
+		}
+		if err != nil {
+			return fail(errors.Wrap(err, name))
+		}
+
+		filter, err := newLevelFilter(conf)
+		if err != nil {
+			return fail(errors.Wrap(err, name), w)
+		}
+		if filter != nil {
+			filters[w] = filter
+		}
+		if v, ok := conf["timeout"]; ok {
+			t, err := time.ParseDuration(v)
+			if err != nil || t < 0 {
+				return fail(errors.Errorf("%s: timeout: invalid duration: %s", name, v), w)
 			}
+			timeouts[w] = t
+		} else if c.WriteTimeout > 0 {
+			timeouts[w] = c.WriteTimeout
+		}
+		opts, err := queueOptions(conf)
+		if err != nil {
+			return fail(errors.Wrap(err, name), w)
+		}
+		if len(opts) > 0 {
+			queueOpts[w] = opts
+		}
+		retry, err := newRetry(logger, name, w, conf)
+		if err != nil {
+			return fail(errors.Wrap(err, name), w)
+		}
+		target := w
+		if retry != nil {
+			retries[w] = retry
+			target = retry
+		}
+		var bury func(p, payload []byte, err error)
+		if deadLetter != nil {
+			bury = burier(logger, deadLetter, name)
+			if r, ok := w.(failureReporter); ok {
+				r.OnFailure(bury)
+			}
+		}
+		wal, err := newWAL(logger, name, target, conf, bury)
+		if err != nil {
+			return fail(errors.Wrap(err, name), w)
+		}
+		if wal != nil {
+			wals[w] = wal
+		}
+		names[name] = w
+		writers = append(writers, w)
+	}
 
-			w, err := writer.NewFile(
-				writer.WithLocation(fileLocation),
-			)
-			if err != nil {
-				return func(*Service) error {
-					return errors.Wrap(err, fileLocation)
-				}
+	var r *router
+	if len(c.Routes) > 0 {
+		var err error
+		if r, err = newRouter(c.Routes, names); err != nil {
+			return fail(errors.Wrap(err, "routes"))
+		}
+		for name, w := range names {
+			if !r.routed(w) {
+				logger.Warnf("no routes to writer: %s", name)
 			}
-			writers = append(writers, w)
 		}
 	}
-	return WithWriters(writers...)
+
+	return func(s *Service) error {
+		if err := WithWriters(writers...)(s); err != nil {
+			return err
+		}
+		if r != nil {
+			s.router = r
+		}
+		if c.Quorum > 0 {
+			s.quorum = c.Quorum
+		}
+		if deadLetter != nil {
+			s.deadLetter = deadLetter
+		}
+		if len(timeouts) > 0 && s.timeouts == nil {
+			s.timeouts = make(map[io.Writer]time.Duration)
+		}
+		for w, t := range timeouts {
+			s.timeouts[w] = t
+		}
+		if s.names == nil {
+			s.names = make(map[io.Writer]string)
+		}
+		for name, w := range names {
+			s.names[w] = name
+		}
+		if len(queueOpts) > 0 && s.queueOpts == nil {
+			s.queueOpts = make(map[io.Writer][]func(*writer.Queue) error)
+		}
+		for w, opts := range queueOpts {
+			s.queueOpts[w] = opts
+		}
+		if len(retries) > 0 && s.retries == nil {
+			s.retries = make(map[io.Writer]*writer.Retry)
+		}
+		for w, r := range retries {
+			s.retries[w] = r
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(wals) > 0 && s.queues == nil {
+			s.queues = make(map[io.Writer]io.Writer)
+		}
+		for w, wal := range wals {
+			s.queues[w] = wal
+		}
+		if len(filters) > 0 && s.filters == nil {
+			s.filters = make(map[io.Writer]levelFilter)
+		}
+		for w, f := range filters {
+			s.filters[w] = f
+		}
+		return nil
+	}
+}
+
+// WithDeadLetter sets the file for recording the entries that the writers
+// give up on.
+func WithDeadLetter(d *writer.DeadLetter) func(*Service) error {
+	return func(s *Service) error {
+		s.deadLetter = d
+		return nil
+	}
+}
+
+// WithAck makes the requests wait until their entries are written and
+// flushed, as if they had the "X-Logpipe-Ack: written" header.
+func WithAck() func(*Service) error {
+	return func(s *Service) error {
+		s.ack = true
+		return nil
+	}
 }
 
 // WithTimeout sets the timeout on Service. It returns an error if the timeout
@@ -10,9 +10,13 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
 	"sync"
 	"time"
 
@@ -62,6 +66,27 @@ func (s *timedWriter) Close() error {
 	return nil
 }
 
+// reopenStub counts the calls to Reopen.
+type reopenStub struct {
+	bytes.Buffer
+	sync.Mutex
+	calls int
+	err   error
+}
+
+func (r *reopenStub) Reopen() error {
+	r.Lock()
+	defer r.Unlock()
+	r.calls++
+	return r.err
+}
+
+func (r *reopenStub) Calls() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.calls
+}
+
 type logLocker struct {
 	*bytes.Buffer
 	*sync.Mutex
@@ -253,7 +278,7 @@ var _ = Describe("Handler", func() {
 
 		Context("having a writer.File in the Setting object", func() {
 			BeforeEach(func() {
-				location = "/no where to find"
+				location = path.Join(os.TempDir(), "no where to find", "file")
 			})
 			Context("when the writer.NewFile returns an error", func() {
 				It("should return with an error", func() {
@@ -329,6 +354,755 @@ var _ = Describe("Handler", func() {
 		})
 	})
 
+	Describe("WithConfWriters with file rotation", func() {
+		var (
+			location string
+			s        *handler.Service
+		)
+
+		BeforeEach(func() {
+			f, err := ioutil.TempFile("", "test_handler_rotation")
+			Expect(err).NotTo(HaveOccurred())
+			location = f.Name()
+			s = &handler.Service{}
+		})
+
+		AfterEach(func() {
+			os.Remove(location)
+		})
+
+		DescribeTable("rotation settings", func(key, value string, valid bool) {
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"file1": {
+						"type":     "file",
+						"location": location,
+						key:        value,
+					},
+				},
+			}
+			err := handler.WithConfWriters(tools.DiscardLogger(), c)(s)
+			if valid {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.Writers).To(HaveLen(1))
+				return
+			}
+			Expect(err).To(HaveOccurred())
+		},
+			Entry("size in bytes", "max_size", "1024", true),
+			Entry("size in megabytes", "max_size", "100MB", true),
+			Entry("size with a space", "max_size", "1 gb", true),
+			Entry("invalid size", "max_size", "a lot", false),
+			Entry("zero size", "max_size", "0", false),
+			Entry("backups", "max_backups", "3", true),
+			Entry("invalid backups", "max_backups", "three", false),
+			Entry("age", "max_age", "168h", true),
+			Entry("invalid age", "max_age", "a week", false),
+			Entry("entry time source", "time_source", "entry", true),
+			Entry("wall clock time source", "time_source", "wall", true),
+			Entry("invalid time source", "time_source", "sundial", false),
+			Entry("fsync on each flush", "fsync", "always", true),
+			Entry("fsync in intervals", "fsync", "interval", true),
+			Entry("unknown fsync mode", "fsync", "sometimes", false),
+			Entry("max unflushed bytes", "max_unflushed", "64KB", true),
+			Entry("invalid max unflushed bytes", "max_unflushed", "plenty", false),
+			Entry("gzip compression", "compress", "gzip", true),
+			Entry("unsupported compression", "compress", "rar", false),
+			Entry("file mode", "mode", "0600", true),
+			Entry("invalid file mode", "mode", "rw-r--r--", false),
+			Entry("file mode with other bits", "mode", "4755", false),
+			Entry("owner", "uid", fmt.Sprint(os.Getuid()), true),
+			Entry("invalid owner", "gid", "staff", false),
+			Entry("creating the directories", "create_dirs", "true", true),
+			Entry("invalid creating the directories", "create_dirs", "maybe", false),
+		)
+
+		Context("having a location in a missing directory", func() {
+			var dir string
+
+			BeforeEach(func() {
+				dir = location + ".d"
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(dir)
+			})
+
+			writers := func(conf map[string]string) *config.Setting {
+				conf["type"] = "file"
+				conf["location"] = path.Join(dir, "logs.log")
+				return &config.Setting{
+					Writers: map[string]map[string]string{"audit": conf},
+				}
+			}
+
+			It("should error with the name of the writer", func() {
+				err := handler.WithConfWriters(tools.DiscardLogger(), writers(map[string]string{}))(s)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(HavePrefix("audit: "))
+				Expect(s.Writers).To(BeEmpty())
+			})
+
+			It("should create the directory with create_dirs", func() {
+				c := writers(map[string]string{"create_dirs": "true", "mode": "0600"})
+				Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).To(Succeed())
+				Expect(s.Writers).To(HaveLen(1))
+
+				info, err := os.Stat(path.Join(dir, "logs.log"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+				s.Close()
+			})
+		})
+	})
+
+	Describe("WithConfWriters with level filters", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "test_handler_levels")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		// contents flushes the writer with the location and returns the
+		// contents of the file.
+		contents := func(s *handler.Service, location string) func() string {
+			return func() string {
+				for _, w := range s.Writers {
+					if f := w.(*writer.File); f.Name() == location {
+						f.Flush()
+					}
+				}
+				b, _ := ioutil.ReadFile(location)
+				return string(b)
+			}
+		}
+
+		It("should only write the allowed levels to the writers", func() {
+			all := path.Join(dir, "all.log")
+			important := path.Join(dir, "important.log")
+			errorsOnly := path.Join(dir, "errors.log")
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"all":       {"type": "file", "location": all},
+					"important": {"type": "file", "location": important, "min_level": "warn"},
+					"errors":    {"type": "file", "location": errorsOnly, "levels": "error"},
+				},
+			}
+			s := &handler.Service{Logger: tools.DiscardLogger()}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+
+			body := `[{"type":"info","message":"info entry"},{"type":"warning","message":"warning entry"},{"type":"error","message":"error entry"}]`
+			req, err := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+			Expect(err).NotTo(HaveOccurred())
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+
+			Eventually(contents(s, all)).Should(ContainSubstring("error entry"))
+			Expect(contents(s, all)()).To(ContainSubstring("info entry"))
+
+			Eventually(contents(s, important)).Should(ContainSubstring("error entry"))
+			Expect(contents(s, important)()).To(ContainSubstring("warning entry"))
+			Expect(contents(s, important)()).NotTo(ContainSubstring("info entry"))
+
+			Eventually(contents(s, errorsOnly)).Should(ContainSubstring("error entry"))
+			Expect(contents(s, errorsOnly)()).NotTo(ContainSubstring("warning entry"))
+		})
+
+		DescribeTable("invalid filters", func(conf map[string]string) {
+			conf["type"] = "file"
+			conf["location"] = path.Join(dir, "logs.log")
+			c := &config.Setting{Writers: map[string]map[string]string{"file1": conf}}
+			err := handler.WithConfWriters(tools.DiscardLogger(), c)(&handler.Service{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("file1"))
+		},
+			Entry("unknown min level", map[string]string{"min_level": "fatal"}),
+			Entry("unknown level", map[string]string{"levels": "error, fatal"}),
+			Entry("both keys", map[string]string{"min_level": "info", "levels": "error"}),
+			Entry("invalid timeout", map[string]string{"timeout": "soon"}),
+			Entry("negative timeout", map[string]string{"timeout": "-1s"}),
+			Entry("zero queue depth", map[string]string{"queue_depth": "0"}),
+			Entry("unknown overflow policy", map[string]string{"overflow": "drop_all"}),
+			Entry("unknown wal fsync mode", map[string]string{"wal": "/tmp", "wal_fsync": "sometimes"}),
+			Entry("invalid wal max size", map[string]string{"wal": "/tmp", "wal_max_size": "big"}),
+			Entry("zero retry attempts", map[string]string{"retry_attempts": "0"}),
+			Entry("invalid retry backoff", map[string]string{"retry_backoff": "soon"}),
+			Entry("max backoff below backoff", map[string]string{"retry_backoff": "2s", "retry_max_backoff": "1s"}),
+			Entry("negative breaker failures", map[string]string{"breaker_failures": "-1"}),
+			Entry("invalid breaker cooldown", map[string]string{"breaker_cooldown": "later"}),
+		)
+	})
+
+	Describe("WithConfWriters with routes", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "test_handler_routes")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		contents := func(s *handler.Service, location string) func() string {
+			return func() string {
+				for _, w := range s.Writers {
+					if f := w.(*writer.File); f.Name() == location {
+						f.Flush()
+					}
+				}
+				b, _ := ioutil.ReadFile(location)
+				return string(b)
+			}
+		}
+
+		It("should write the entries to the writers of the matching routes", func() {
+			billing := path.Join(dir, "billing.log")
+			staging := path.Join(dir, "staging.log")
+			rest := path.Join(dir, "rest.log")
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"billing": {"type": "file", "location": billing},
+					"staging": {"type": "file", "location": staging, "min_level": "warning"},
+					"rest":    {"type": "file", "location": rest},
+				},
+				Routes: []config.Route{
+					{
+						Match:   []config.Condition{{Field: "app", Operator: config.Equals, Value: "billing"}},
+						Writers: []string{"billing"},
+					},
+					{
+						Match: []config.Condition{
+							{Field: "env", Operator: config.Regex, Value: "^stag"},
+							{Field: "user", Operator: config.Exists, Value: "false"},
+						},
+						Writers: []string{"staging"},
+					},
+					{Writers: []string{"rest"}, Default: true},
+				},
+			}
+			s := &handler.Service{Logger: tools.DiscardLogger()}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+
+			body := `[
+				{"type":"error","message":"billing entry","app":"billing"},
+				{"type":"error","message":"billing staging entry","app":"billing","env":"staging"},
+				{"type":"info","message":"staging info entry","env":"staging"},
+				{"type":"error","message":"staging user entry","env":"staging","user":"arsham"},
+				{"type":"error","message":"other entry","app":"shop"}
+			]`
+			req, err := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+			Expect(err).NotTo(HaveOccurred())
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+
+			Eventually(contents(s, rest)).Should(ContainSubstring("other entry"))
+			Expect(contents(s, rest)()).To(ContainSubstring("staging user entry"))
+			Expect(contents(s, rest)()).NotTo(ContainSubstring("billing"))
+			// the route matches, but the staging writer does not accept the level.
+			Expect(contents(s, rest)()).NotTo(ContainSubstring("staging info entry"))
+
+			Expect(contents(s, billing)()).To(ContainSubstring("billing entry"))
+			Expect(contents(s, billing)()).To(ContainSubstring("billing staging entry"))
+			Expect(contents(s, billing)()).NotTo(ContainSubstring("other entry"))
+
+			Expect(contents(s, staging)()).To(ContainSubstring("billing staging entry"))
+			Expect(contents(s, staging)()).NotTo(ContainSubstring("staging info entry"))
+			Expect(contents(s, staging)()).NotTo(ContainSubstring("staging user entry"))
+		})
+
+		It("should log the failures with the names of the writers", func() {
+			logWriter := &logLocker{new(bytes.Buffer), new(sync.Mutex)}
+			logger := tools.WithWriter(logWriter)
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"billing": {"type": "file", "location": path.Join(dir, "billing.log")},
+					"shop":    {"type": "file", "location": path.Join(dir, "shop.log")},
+				},
+			}
+			s := &handler.Service{Logger: logger}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+			for _, w := range s.Writers {
+				f := w.(*writer.File)
+				if f.Name() == path.Join(dir, "billing.log") {
+					Expect(f.Close()).To(Succeed())
+				}
+			}
+
+			req, err := http.NewRequest("POST", "/", bytes.NewBufferString(`{"message":"entry"}`))
+			Expect(err).NotTo(HaveOccurred())
+			s.ServeHTTP(httptest.NewRecorder(), req)
+
+			Eventually(logWriter.String).Should(ContainSubstring("writer=billing"))
+			Expect(logWriter.String()).To(ContainSubstring(handler.ErrWritingEntry.Error()))
+			Expect(logWriter.String()).To(ContainSubstring("bytes=0"))
+			Consistently(logWriter.String, 0.1).ShouldNot(ContainSubstring("writer=shop"))
+		})
+
+		It("should record the entries in the wal before writing them", func() {
+			location := path.Join(dir, "logs.log")
+			walDir := path.Join(dir, "wal")
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"file1": {"type": "file", "location": location, "wal": walDir, "wal_fsync": "always"},
+				},
+			}
+			s := &handler.Service{Logger: tools.DiscardLogger()}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+
+			req, err := http.NewRequest("POST", "/", bytes.NewBufferString(`{"message":"recorded entry"}`))
+			Expect(err).NotTo(HaveOccurred())
+			s.ServeHTTP(httptest.NewRecorder(), req)
+
+			segments, err := filepath.Glob(path.Join(walDir, "*.seg"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(segments).To(HaveLen(1))
+			b, err := ioutil.ReadFile(segments[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(ContainSubstring("recorded entry"))
+			Eventually(contents(s, location)).Should(ContainSubstring("recorded entry"))
+		})
+
+		It("should open the breaker of the failing writer and report it", func() {
+			logWriter := &logLocker{new(bytes.Buffer), new(sync.Mutex)}
+			logger := tools.WithWriter(logWriter)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			addr := l.Addr().String()
+			l.Close()
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"billing": {
+						"type":             "syslog",
+						"network":          "tcp",
+						"address":          addr,
+						"retry_attempts":   "2",
+						"retry_backoff":    "1ms",
+						"breaker_failures": "2",
+						"breaker_cooldown": "1h",
+					},
+					"shop": {"type": "file", "location": path.Join(dir, "shop.log")},
+				},
+			}
+			s := &handler.Service{Logger: logger}
+			Expect(handler.WithConfWriters(logger, c)(s)).NotTo(HaveOccurred())
+			defer s.Close()
+
+			for i := 0; i < 2; i++ {
+				req, err := http.NewRequest("POST", "/", bytes.NewBufferString(`{"message":"entry"}`))
+				Expect(err).NotTo(HaveOccurred())
+				s.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			Eventually(logWriter.String).Should(ContainSubstring("breaker=open"))
+			Expect(logWriter.String()).To(ContainSubstring("writer=billing"))
+			Eventually(s.Status).Should(Equal([]handler.WriterStatus{
+				{Name: "billing", Breaker: "open"},
+				{Name: "shop"},
+			}))
+
+			req, err := http.NewRequest("GET", "/status", nil)
+			Expect(err).NotTo(HaveOccurred())
+			rec := httptest.NewRecorder()
+			s.ServeStatus(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(ContainSubstring(`"name":"billing","breaker":"open"`))
+		})
+
+		It("should error on invalid conditions", func() {
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"file1": {"type": "file", "location": path.Join(dir, "logs.log")},
+				},
+				Routes: []config.Route{{
+					Match:   []config.Condition{{Field: "app", Operator: config.Regex, Value: "["}},
+					Writers: []string{"file1"},
+				}},
+			}
+			err := handler.WithConfWriters(tools.DiscardLogger(), c)(&handler.Service{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("route 1"))
+		})
+
+		It("should close the writers that are set up when the settings fail", func() {
+			before := runtime.NumGoroutine()
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"file1": {
+						"type":     "file",
+						"location": path.Join(dir, "logs.log"),
+						"wal":      path.Join(dir, "wal"),
+					},
+					"search": {
+						"type":        "elasticsearch",
+						"url":         "http://localhost:9200",
+						"flush_delay": "10ms",
+					},
+				},
+				DeadLetter: path.Join(dir, "dead_letter.log"),
+				Routes: []config.Route{{
+					Match:   []config.Condition{{Field: "app", Operator: config.Regex, Value: "["}},
+					Writers: []string{"file1"},
+				}},
+			}
+			err := handler.WithConfWriters(tools.DiscardLogger(), c)(&handler.Service{})
+			Expect(err).To(HaveOccurred())
+			Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", before))
+		})
+	})
+
+	Describe("WithConfWriters with elasticsearch", func() {
+		var (
+			buf *bytes.Buffer
+			s   *handler.Service
+		)
+
+		BeforeEach(func() {
+			buf = new(bytes.Buffer)
+			s = &handler.Service{}
+		})
+
+		Context("having a url", func() {
+			It("should add an Elasticsearch writer", func() {
+				c := &config.Setting{
+					Writers: map[string]map[string]string{
+						"es1": {
+							"type":       "elasticsearch",
+							"url":        "http://localhost:9200",
+							"index":      "logs-2006.01.02",
+							"batch_size": "10",
+						},
+					},
+				}
+				Expect(handler.WithConfWriters(tools.WithWriter(buf), c)(s)).NotTo(HaveOccurred())
+				Expect(s.Writers).To(HaveLen(1))
+				Expect(s.Writers[0]).To(BeAssignableToTypeOf(&writer.Elasticsearch{}))
+			})
+		})
+
+		Context("having an invalid batch size", func() {
+			It("should return an error", func() {
+				c := &config.Setting{
+					Writers: map[string]map[string]string{
+						"es1": {
+							"type":       "elasticsearch",
+							"url":        "http://localhost:9200",
+							"batch_size": "ten",
+						},
+					},
+				}
+				Expect(handler.WithConfWriters(tools.WithWriter(buf), c)(s)).To(HaveOccurred())
+			})
+		})
+
+		Context("when the url is not set", func() {
+			It("should warn and skip the writer", func() {
+				c := &config.Setting{
+					Writers: map[string]map[string]string{
+						"es_without_url": {
+							"type": "elasticsearch",
+						},
+					},
+				}
+				Expect(handler.WithConfWriters(tools.WithWriter(buf), c)(s)).NotTo(HaveOccurred())
+				Expect(s.Writers).To(BeEmpty())
+				Expect(buf.String()).To(ContainSubstring("es_without_url"))
+			})
+		})
+	})
+
+	Describe("WithConfWriters with influxdb", func() {
+		It("should add an InfluxDB writer", func() {
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"influx1": {
+						"type":        "influxdb",
+						"url":         "http://localhost:8086",
+						"database":    "logpipe",
+						"tags":        "level, app",
+						"field_types": "duration: integer, ratio: float",
+					},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+			Expect(s.Writers).To(HaveLen(1))
+			Expect(s.Writers[0]).To(BeAssignableToTypeOf(&writer.InfluxDB{}))
+		})
+
+		It("should return an error on unknown versions", func() {
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"influx1": {
+						"type":    "influxdb",
+						"url":     "http://localhost:8086",
+						"version": "3",
+					},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).To(HaveOccurred())
+		})
+
+		It("should return an error on invalid field types", func() {
+			for _, types := range []string{"duration", "duration: number"} {
+				s := &handler.Service{}
+				c := &config.Setting{
+					Writers: map[string]map[string]string{
+						"influx1": {
+							"type":        "influxdb",
+							"url":         "http://localhost:8086",
+							"database":    "logpipe",
+							"field_types": types,
+						},
+					},
+				}
+				Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).To(HaveOccurred(), types)
+			}
+		})
+	})
+
+	Describe("WithConfWriters with syslog", func() {
+		It("should add a Syslog writer", func() {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"syslog1": {
+						"type":     "syslog",
+						"address":  conn.LocalAddr().String(),
+						"format":   "rfc3164",
+						"facility": "local0",
+					},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+			Expect(s.Writers).To(HaveLen(1))
+			Expect(s.Writers[0]).To(BeAssignableToTypeOf(&writer.Syslog{}))
+		})
+
+		It("should return an error on unknown formats", func() {
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"syslog1": {
+						"type":    "syslog",
+						"address": "127.0.0.1:514",
+						"format":  "rfc1",
+					},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).To(HaveOccurred())
+		})
+	})
+
+	Describe("WithConfWriters with http", func() {
+		It("should forward the entries to another instance", func() {
+			central := &timedWriter{}
+			ts := httptest.NewServer(&handler.Service{
+				Writers: []io.Writer{central},
+				Logger:  tools.DiscardLogger(),
+			})
+			defer ts.Close()
+
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"central": {
+						"type":     "http",
+						"url":      ts.URL,
+						"compress": "gzip",
+						"headers":  "X-Api-Key: secret",
+					},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+			Expect(s.Writers).To(HaveLen(1))
+			h := s.Writers[0].(*writer.HTTP)
+			defer h.Close()
+
+			_, err := h.Write([]byte(`time="2017-01-14T19:10:10Z" level=error msg="from the edge" app=billing` + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h.Flush()).To(Succeed())
+			Eventually(central.String).Should(ContainSubstring(`msg="from the edge"`))
+			Expect(central.String()).To(ContainSubstring("app=billing"))
+		})
+
+		It("should return an error on invalid headers", func() {
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"central": {
+						"type":    "http",
+						"url":     "http://localhost:8080",
+						"headers": "no colon",
+					},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).To(HaveOccurred())
+		})
+
+		It("should return an error on the max_retries key", func() {
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"central": {
+						"type":        "http",
+						"url":         "http://localhost:8080",
+						"max_retries": "3",
+					},
+				},
+			}
+			err := handler.WithConfWriters(tools.DiscardLogger(), c)(s)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("retry_*"))
+		})
+
+		It("should return an error on the breaker keys", func() {
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"central": {
+						"type":             "http",
+						"url":              "http://localhost:8080",
+						"breaker_failures": "3",
+					},
+				},
+			}
+			err := handler.WithConfWriters(tools.DiscardLogger(), c)(s)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("breaker_failures"))
+		})
+	})
+
+	Describe("WithConfWriters with console", func() {
+		It("should add a Console writer", func() {
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"stderr": {
+						"type":   "console",
+						"stream": "stderr",
+						"color":  "never",
+					},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+			Expect(s.Writers).To(HaveLen(1))
+			Expect(s.Writers[0]).To(BeAssignableToTypeOf(&writer.Console{}))
+		})
+
+		It("should return an error on unknown streams", func() {
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"console": {"type": "console", "stream": "stdin"},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).To(HaveOccurred())
+		})
+	})
+
+	Describe("WithConfWriters with loki", func() {
+		It("should add a Loki writer", func() {
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"loki1": {
+						"type":   "loki",
+						"url":    "http://localhost:3100",
+						"labels": "level, app, host",
+						"format": "json",
+					},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+			Expect(s.Writers).To(HaveLen(1))
+			Expect(s.Writers[0]).To(BeAssignableToTypeOf(&writer.Loki{}))
+		})
+
+		It("should return an error on invalid labels", func() {
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"loki1": {
+						"type":   "loki",
+						"url":    "http://localhost:3100",
+						"labels": "app.name",
+					},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).To(HaveOccurred())
+		})
+	})
+
+	Describe("WithConfWriters with splunk_hec", func() {
+		It("should add a SplunkHEC writer", func() {
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"splunk": {
+						"type":        "splunk_hec",
+						"url":         "https://localhost:8088",
+						"token":       "secret",
+						"index":       "main",
+						"ack":         "true",
+						"ack_timeout": "10s",
+					},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+			Expect(s.Writers).To(HaveLen(1))
+			Expect(s.Writers[0]).To(BeAssignableToTypeOf(&writer.SplunkHEC{}))
+		})
+
+		It("should warn and skip the writer without a token", func() {
+			buf := new(bytes.Buffer)
+			s := &handler.Service{}
+			c := &config.Setting{
+				Writers: map[string]map[string]string{
+					"splunk_without_token": {
+						"type": "splunk_hec",
+						"url":  "https://localhost:8088",
+					},
+				},
+			}
+			Expect(handler.WithConfWriters(tools.WithWriter(buf), c)(s)).NotTo(HaveOccurred())
+			Expect(s.Writers).To(BeEmpty())
+			Expect(buf.String()).To(ContainSubstring("splunk_without_token"))
+		})
+	})
+
+	Describe("Reopen", func() {
+		It("should reopen the writers that support it and log the errors", func() {
+			buf := new(bytes.Buffer)
+			w1 := &reopenStub{}
+			w2 := &reopenStub{err: errors.New("the disk is gone")}
+			s := &handler.Service{
+				Writers: []io.Writer{w1, new(bytes.Buffer), w2},
+				Logger:  tools.WithWriter(buf),
+			}
+
+			s.Reopen()
+			Expect(w1.Calls()).To(Equal(1))
+			Expect(w2.Calls()).To(Equal(1))
+			Expect(buf.String()).To(ContainSubstring("the disk is gone"))
+		})
+	})
+
 	Describe("WithTimeout", func() {
 		Context("when timeout is zero", func() {
 			It("should error", func() {
@@ -586,4 +1360,78 @@ var _ = Describe("Handler", func() {
 			})
 		})
 	})
+
+	Describe("ack mode", func() {
+		var (
+			dir      string
+			location string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "test_handler_ack")
+			Expect(err).NotTo(HaveOccurred())
+			location = path.Join(dir, "logs.log")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		newService := func(opts ...func(*handler.Service) error) (*handler.Service, *writer.File) {
+			f, err := writer.NewFile(writer.WithLocation(location), writer.WithFlushDelay(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			opts = append([]func(*handler.Service) error{
+				handler.WithLogger(tools.DiscardLogger()),
+				handler.WithWriters(f),
+			}, opts...)
+			s, err := handler.New(opts...)
+			Expect(err).NotTo(HaveOccurred())
+			return s, f
+		}
+
+		post := func(s *handler.Service, body string, ack bool) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+			Expect(err).NotTo(HaveOccurred())
+			if ack {
+				req.Header.Set(handler.AckHeader, handler.AckWritten)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			return rec
+		}
+
+		contents := func() string {
+			b, _ := ioutil.ReadFile(location)
+			return string(b)
+		}
+
+		It("should respond when the entries are written and flushed", func() {
+			s, _ := newService()
+			rec := post(s, `[{"message":"first entry"},{"message":"second entry"}]`, true)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(contents()).To(ContainSubstring("first entry"))
+			Expect(contents()).To(ContainSubstring("second entry"))
+
+			By("not waiting for the flush without the header")
+			rec = post(s, `{"message":"third entry"}`, false)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Consistently(contents, 0.05).ShouldNot(ContainSubstring("third entry"))
+		})
+
+		It("should wait for all requests with WithAck", func() {
+			s, _ := newService(handler.WithAck())
+			rec := post(s, `{"message":"the entry"}`, false)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(contents()).To(ContainSubstring("the entry"))
+		})
+
+		It("should return the errors of the failed entries", func() {
+			s, f := newService()
+			Expect(f.Close()).To(Succeed())
+			rec := post(s, `{"message":"the entry"}`, true)
+			Expect(rec.Code).To(Equal(http.StatusBadGateway))
+			Expect(rec.Body.String()).To(HavePrefix("entry 0: 1 writer(s) failed: " + location))
+		})
+	})
 })
@@ -0,0 +1,167 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// This file contains the logic for shutting down the service.
+
+// stopper is implemented by the writers and the queues that can give up on
+// their entries, like the batched writers.
+type stopper interface {
+	Stop()
+}
+
+// begin registers a request, and returns false if the service is shutting
+// down.
+func (l *Service) begin() bool {
+	l.lifeMu.Lock()
+	defer l.lifeMu.Unlock()
+	if l.closing {
+		return false
+	}
+	l.requests.Add(1)
+	return true
+}
+
+// Shutdown refuses the new requests, and waits for the requests that are
+// being handled and the entries in the queues to be written, until ctx is
+// done. Then it closes the writers, which flushes them. If ctx is done first,
+// the queues drop their entries, the retries stop waiting between the
+// attempts, and the writers are closed anyway. The remaining entries fail,
+// which are logged, and the entries in the WALs are kept for the next run. The
+// dead letter file is closed after the queues are finished. It returns the
+// first error, or ctx's error if the entries could not be written in time.
+func (l *Service) Shutdown(ctx context.Context) error {
+	l.lifeMu.Lock()
+	if l.closing {
+		l.lifeMu.Unlock()
+		return nil
+	}
+	l.closing = true
+	l.lifeMu.Unlock()
+
+	var err error
+	if !wait(ctx, l.requests.Wait) {
+		err = errors.Wrap(ctx.Err(), "waiting for the requests")
+	}
+
+	l.mu.Lock()
+	queues := make([]io.Writer, 0, len(l.queues))
+	for _, q := range l.queues {
+		queues = append(queues, q)
+	}
+	l.mu.Unlock()
+
+	var once sync.Once
+	abandon := func() {
+		once.Do(func() {
+			for _, q := range queues {
+				if s, ok := q.(stopper); ok {
+					s.Stop()
+				}
+			}
+			for _, r := range l.retries {
+				r.Stop()
+			}
+			for _, w := range l.Writers {
+				if s, ok := w.(stopper); ok {
+					s.Stop()
+				}
+			}
+		})
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		var wg sync.WaitGroup
+		for _, q := range queues {
+			if c, ok := q.(io.Closer); ok {
+				wg.Add(1)
+				go func(c io.Closer) {
+					defer wg.Done()
+					if e := c.Close(); e != nil {
+						l.Logger.Error(errors.Wrap(e, "closing the queue"))
+					}
+				}(c)
+			}
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		abandon()
+		if err == nil {
+			err = errors.Wrap(ctx.Err(), "writing the queued entries")
+		}
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		var err error
+		for _, w := range l.Writers {
+			c, ok := w.(io.Closer)
+			if !ok {
+				continue
+			}
+			if e := c.Close(); e != nil && err == nil {
+				err = errors.Wrap(e, "closing "+l.name(w))
+			}
+		}
+		closed <- err
+	}()
+	var e error
+	select {
+	case e = <-closed:
+	case <-ctx.Done():
+		// the writers could be retrying their last entries.
+		abandon()
+		if e = <-closed; e == nil {
+			e = errors.Wrap(ctx.Err(), "closing the writers")
+		}
+	}
+	if err == nil {
+		err = e
+	}
+
+	// the workers that were writing when the writers were closed might still
+	// give up on their entries.
+	<-drained
+	if l.deadLetter != nil {
+		if e := l.deadLetter.Close(); e != nil && err == nil {
+			err = errors.Wrap(e, "closing the dead letter file")
+		}
+	}
+	return err
+}
+
+// Close shuts down the service without a deadline. See Shutdown.
+func (l *Service) Close() error {
+	return l.Shutdown(context.Background())
+}
+
+// wait calls f and waits for it to return until ctx is done. It returns false
+// if ctx is done first, and f carries on in the background.
+func wait(ctx context.Context, f func()) bool {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
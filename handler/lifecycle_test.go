@@ -0,0 +1,208 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/handler"
+	"github.com/arsham/logpipe/tools"
+	"github.com/arsham/logpipe/tools/config"
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// closingWriter holds the writes until it is released or closed, and records
+// the writes and whether it is closed.
+type closingWriter struct {
+	sync.Mutex
+	gate   chan struct{}
+	once   sync.Once
+	writes int
+	closed bool
+}
+
+func (c *closingWriter) release() {
+	c.once.Do(func() { close(c.gate) })
+}
+
+func (c *closingWriter) Write(p []byte) (int, error) {
+	<-c.gate
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return 0, errors.New("closed")
+	}
+	c.writes++
+	return len(p), nil
+}
+
+func (c *closingWriter) Close() error {
+	c.Lock()
+	c.closed = true
+	c.Unlock()
+	c.release()
+	return nil
+}
+
+func (c *closingWriter) Writes() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.writes
+}
+
+func (c *closingWriter) Closed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
+var _ = Describe("Shutdown", func() {
+	var (
+		w *closingWriter
+		s *handler.Service
+	)
+
+	BeforeEach(func() {
+		w = &closingWriter{gate: make(chan struct{})}
+		var err error
+		s, err = handler.New(
+			handler.WithLogger(tools.DiscardLogger()),
+			handler.WithWriters(w),
+		)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	post := func() int {
+		req, err := http.NewRequest("POST", "/", bytes.NewBufferString(`{"message":"entry"}`))
+		Expect(err).NotTo(HaveOccurred())
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	It("should write the queued entries and close the writers", func() {
+		Expect(post()).To(Equal(http.StatusOK))
+		Expect(post()).To(Equal(http.StatusOK))
+
+		done := make(chan error)
+		go func() {
+			done <- s.Shutdown(context.Background())
+		}()
+		Consistently(done, 0.05).ShouldNot(Receive())
+		Expect(w.Closed()).To(BeFalse())
+
+		By("refusing the new requests")
+		Eventually(post).Should(Equal(http.StatusServiceUnavailable))
+
+		w.release()
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(w.Writes()).To(Equal(2))
+		Expect(w.Closed()).To(BeTrue())
+		Expect(s.Shutdown(context.Background())).To(Succeed())
+	})
+
+	It("should close the writers when the deadline passes", func() {
+		Expect(post()).To(Equal(http.StatusOK))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := s.Shutdown(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("writing the queued entries"))
+		Expect(w.Closed()).To(BeTrue())
+		Expect(w.Writes()).To(BeZero())
+	})
+
+	Context("with a dead letter file", func() {
+		var (
+			dir        string
+			deadLetter string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "test_handler_shutdown")
+			Expect(err).NotTo(HaveOccurred())
+			deadLetter = path.Join(dir, "dead.log")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		records := func() []*writer.DeadRecord {
+			f, err := os.Open(deadLetter)
+			Expect(err).NotTo(HaveOccurred())
+			defer f.Close()
+			records, err := writer.ReadDeadRecords(f)
+			Expect(err).NotTo(HaveOccurred())
+			return records
+		}
+
+		It("should record the dropped entries before closing the file", func() {
+			d, err := writer.NewDeadLetter(writer.WithDeadLetterLocation(deadLetter))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handler.WithDeadLetter(d)(s)).To(Succeed())
+			Expect(post()).To(Equal(http.StatusOK))
+			Expect(post()).To(Equal(http.StatusOK))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			Expect(s.Shutdown(ctx)).NotTo(Succeed())
+
+			recs := records()
+			Expect(recs).To(HaveLen(2))
+			errs := []string{recs[0].Error, recs[1].Error}
+			Expect(errs).To(ContainElement(writer.ErrStopped.Error()))
+		})
+
+		It("should stop the retries of the batched writers", func() {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer ts.Close()
+			c := &config.Setting{
+				DeadLetter: deadLetter,
+				Writers: map[string]map[string]string{
+					"remote": {"type": "http", "url": ts.URL, "retry_backoff": "1h", "retry_max_backoff": "1h"},
+				},
+			}
+			s, err := handler.New(
+				handler.WithLogger(tools.DiscardLogger()),
+				handler.WithConfWriters(tools.DiscardLogger(), c),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			body := `{"type":"error","message":"entry","timestamp":"2017-10-09T10:45:00Z"}`
+			req, err := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+			Expect(err).NotTo(HaveOccurred())
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			done := make(chan error)
+			go func() {
+				done <- s.Shutdown(ctx)
+			}()
+			Eventually(done).Should(Receive(HaveOccurred()))
+			recs := records()
+			Expect(recs).To(HaveLen(1))
+			Expect(recs[0].Writer).To(Equal("remote"))
+			Expect(recs[0].Entry).To(MatchJSON(body))
+		})
+	})
+})
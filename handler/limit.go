@@ -0,0 +1,99 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Defaults of the ingestion limits.
+const (
+	DefaultQueueTimeout = time.Second
+	DefaultRetryAfter   = time.Second
+)
+
+// limiter bounds the number of the requests that are handled at the same
+// time, and the number of the requests that wait for them.
+type limiter struct {
+	slots      chan struct{}
+	waiting    chan struct{}
+	timeout    time.Duration
+	retryAfter time.Duration
+}
+
+// acquire returns a function for releasing the slot of the request, or the
+// status of refusing it. The requests are refused with
+// http.StatusTooManyRequests if the queue is full, and with
+// http.StatusServiceUnavailable if they can not get a slot in time.
+func (l *limiter) acquire(ctx context.Context) (func(), int) {
+	release := func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, 0
+	default:
+	}
+
+	select {
+	case l.waiting <- struct{}{}:
+	default:
+		return nil, http.StatusTooManyRequests
+	}
+	defer func() { <-l.waiting }()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, 0
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return nil, http.StatusServiceUnavailable
+}
+
+// reject responds with the status and a Retry-After header in seconds.
+func (l *limiter) reject(w http.ResponseWriter, status int) {
+	seconds := int(math.Ceil(l.retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(status)
+	fmt.Fprint(w, http.StatusText(status))
+}
+
+// WithIngestLimit limits the number of the requests that are handled at the
+// same time to inFlight, and the number of the requests that wait for them
+// to queued. The queued requests wait up to timeout, and are refused with
+// http.StatusServiceUnavailable afterwards. The requests that don't fit in the
+// queue are refused with http.StatusTooManyRequests. The refused requests are
+// asked to retry after retryAfter. Zero inFlight means no limit, and zero
+// timeout and retryAfter fall back to their defaults.
+func WithIngestLimit(inFlight, queued int, timeout, retryAfter time.Duration) func(*Service) error {
+	return func(s *Service) error {
+		if inFlight < 0 || queued < 0 || timeout < 0 || retryAfter < 0 {
+			return fmt.Errorf("invalid ingest limit: (%d, %d, %s, %s)", inFlight, queued, timeout, retryAfter)
+		}
+		if inFlight == 0 {
+			s.limiter = nil
+			return nil
+		}
+		if timeout == 0 {
+			timeout = DefaultQueueTimeout
+		}
+		if retryAfter == 0 {
+			retryAfter = DefaultRetryAfter
+		}
+		s.limiter = &limiter{
+			slots:      make(chan struct{}, inFlight),
+			waiting:    make(chan struct{}, queued),
+			timeout:    timeout,
+			retryAfter: retryAfter,
+		}
+		return nil
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package handler_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/handler"
+	"github.com/arsham/logpipe/tools"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// gatedBody holds the reads until gate is closed. started is closed on the
+// first read.
+type gatedBody struct {
+	r       io.Reader
+	once    sync.Once
+	started chan struct{}
+	gate    chan struct{}
+}
+
+func (g *gatedBody) Read(p []byte) (int, error) {
+	g.once.Do(func() { close(g.started) })
+	<-g.gate
+	return g.r.Read(p)
+}
+
+func (g *gatedBody) Close() error { return nil }
+
+var _ = Describe("WithIngestLimit", func() {
+	const body = `{"message":"entry"}`
+
+	serve := func(s *handler.Service, r io.Reader) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/", r)
+		Expect(err).NotTo(HaveOccurred())
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	It("should error on negative values", func() {
+		_, err := handler.New(
+			handler.WithWriters(ioutil.Discard),
+			handler.WithIngestLimit(-1, 0, 0, 0),
+		)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should refuse the requests over the limit", func() {
+		s, err := handler.New(
+			handler.WithLogger(tools.DiscardLogger()),
+			handler.WithWriters(ioutil.Discard),
+			handler.WithIngestLimit(1, 1, 50*time.Millisecond, 1500*time.Millisecond),
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		slow := &gatedBody{
+			r:       strings.NewReader(body),
+			started: make(chan struct{}),
+			gate:    make(chan struct{}),
+		}
+		first := make(chan *httptest.ResponseRecorder)
+		go func() {
+			defer GinkgoRecover()
+			first <- serve(s, slow)
+		}()
+		Eventually(slow.started).Should(BeClosed())
+
+		By("queueing the next request until it times out")
+		queued := make(chan *httptest.ResponseRecorder)
+		go func() {
+			defer GinkgoRecover()
+			queued <- serve(s, bytes.NewBufferString(body))
+		}()
+		Consistently(queued, 0.02).ShouldNot(Receive())
+
+		By("refusing the requests that don't fit in the queue")
+		rec := serve(s, bytes.NewBufferString(body))
+		Expect(rec.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(rec.Header().Get("Retry-After")).To(Equal("2"))
+
+		var timedOut *httptest.ResponseRecorder
+		Eventually(queued).Should(Receive(&timedOut))
+		Expect(timedOut.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(timedOut.Header().Get("Retry-After")).To(Equal("2"))
+
+		By("accepting the requests when there is room")
+		close(slow.gate)
+		var done *httptest.ResponseRecorder
+		Eventually(first).Should(Receive(&done))
+		Expect(done.Code).To(Equal(http.StatusOK))
+		Expect(serve(s, bytes.NewBufferString(body)).Code).To(Equal(http.StatusOK))
+	})
+})
@@ -0,0 +1,58 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package handler
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/arsham/logpipe/writer"
+	"github.com/pkg/errors"
+)
+
+// The sqlite writer needs cgo, and is left out of the builds without it.
+
+func newSQLite(logger tools.FieldLogger, conf map[string]string) (io.Writer, error) {
+	dbPath, ok := conf["path"]
+	if !ok {
+		return nil, missingKeyError("path")
+	}
+
+	size, delay, err := batchSettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, dbPath)
+	}
+	attempts, backoff, maxBackoff, err := retrySettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, dbPath)
+	}
+
+	opts := []func(*writer.SQLite) error{
+		writer.WithSQLitePath(dbPath),
+		writer.WithSQLiteBatch(size, delay),
+		writer.WithSQLiteRetry(attempts, backoff, maxBackoff),
+		writer.WithSQLiteLogger(logger),
+	}
+	if table, ok := conf["table"]; ok {
+		opts = append(opts, writer.WithSQLiteTable(table))
+	}
+	if v, ok := conf["retention_days"]; ok {
+		days, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "retention_days")
+		}
+		opts = append(opts, writer.WithSQLiteRetention(days))
+	}
+
+	w, err := writer.NewSQLite(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, dbPath)
+	}
+	return w, nil
+}
@@ -0,0 +1,20 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+//go:build !cgo
+// +build !cgo
+
+package handler
+
+import (
+	"io"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/pkg/errors"
+)
+
+// newSQLite returns an error, as the sqlite writer needs cgo.
+func newSQLite(tools.FieldLogger, map[string]string) (io.Writer, error) {
+	return nil, errors.New("sqlite writer is not available in builds without cgo")
+}
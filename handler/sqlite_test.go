@@ -0,0 +1,58 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package handler_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/arsham/logpipe/handler"
+	"github.com/arsham/logpipe/tools"
+	"github.com/arsham/logpipe/tools/config"
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WithConfWriters with sqlite", func() {
+	It("should add a SQLite writer", func() {
+		dir, err := ioutil.TempDir("", "sqlite")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		s := &handler.Service{}
+		c := &config.Setting{
+			Writers: map[string]map[string]string{
+				"db": {
+					"type":           "sqlite",
+					"path":           path.Join(dir, "logs.db"),
+					"retention_days": "30",
+				},
+			},
+		}
+		Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).NotTo(HaveOccurred())
+		Expect(s.Writers).To(HaveLen(1))
+		Expect(s.Writers[0]).To(BeAssignableToTypeOf(&writer.SQLite{}))
+		Expect(s.Writers[0].(*writer.SQLite).Close()).To(Succeed())
+	})
+
+	It("should return an error on invalid retention", func() {
+		s := &handler.Service{}
+		c := &config.Setting{
+			Writers: map[string]map[string]string{
+				"db": {
+					"type":           "sqlite",
+					"path":           "logs.db",
+					"retention_days": "a week",
+				},
+			},
+		}
+		Expect(handler.WithConfWriters(tools.DiscardLogger(), c)(s)).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,69 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/arsham/logpipe/writer"
+)
+
+// WriterStatus is the state of a writer of the service.
+type WriterStatus struct {
+	Name string `json:"name"`
+
+	// Breaker is the state of the circuit breaker of the writer, if it has
+	// one.
+	Breaker string `json:"breaker,omitempty"`
+
+	// Queued is the number of the entries waiting to be written.
+	Queued int `json:"queued"`
+
+	// Dropped is the number of the entries dropped from the full queue.
+	Dropped uint64 `json:"dropped"`
+
+	// WALSize is the size of the entries in the wal that are not written
+	// yet, in bytes.
+	WALSize int64 `json:"wal_size,omitempty"`
+}
+
+// Status returns the state of the writers, sorted by their names.
+func (l *Service) Status() []WriterStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	statuses := make([]WriterStatus, 0, len(l.Writers))
+	for _, w := range l.Writers {
+		st := WriterStatus{Name: l.name(w)}
+		if r, ok := l.retries[w]; ok {
+			st.Breaker = r.State().String()
+		}
+		switch q := l.queues[w].(type) {
+		case *writer.Queue:
+			st.Queued = q.Len()
+			st.Dropped = q.Dropped()
+		case *writer.WAL:
+			st.WALSize = q.Size()
+		}
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// ServeStatus responds with the state of the writers in JSON.
+func (l *Service) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l.Status()); err != nil {
+		l.Logger.Error(err)
+	}
+}
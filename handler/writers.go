@@ -0,0 +1,652 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package handler
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/arsham/logpipe/writer"
+	"github.com/pkg/errors"
+)
+
+// This file contains the logic for creating writers from their settings.
+
+// missingKeyError is returned when a required key is not in the settings of a
+// writer.
+type missingKeyError string
+
+func (m missingKeyError) Error() string { return "no " + string(m) }
+
+func newFile(logger tools.FieldLogger, conf map[string]string) (io.Writer, error) {
+	location, ok := conf["location"]
+	if !ok {
+		return nil, missingKeyError("location")
+	}
+
+	opts := []func(*writer.File) error{
+		writer.WithLocation(location),
+	}
+	if logger != nil {
+		opts = append(opts, writer.WithLogger(logger))
+	}
+	if method, ok := conf["compress"]; ok {
+		opts = append(opts, writer.WithCompress(method))
+	}
+
+	if v, ok := conf["max_size"]; ok {
+		size, err := sizeValue(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "max_size")
+		}
+		opts = append(opts, writer.WithMaxSize(size))
+	}
+
+	if v, ok := conf["max_backups"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "max_backups")
+		}
+		opts = append(opts, writer.WithMaxBackups(n))
+	}
+
+	if v, ok := conf["max_age"]; ok {
+		age, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "max_age")
+		}
+		opts = append(opts, writer.WithMaxAge(age))
+	}
+
+	if v, ok := conf["fsync"]; ok {
+		mode, err := writer.ParseSyncMode(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "fsync")
+		}
+		interval := time.Second
+		if v, ok := conf["fsync_interval"]; ok {
+			if interval, err = time.ParseDuration(v); err != nil {
+				return nil, errors.Wrap(err, "fsync_interval")
+			}
+		}
+		opts = append(opts, writer.WithSync(mode, interval))
+	}
+
+	if v, ok := conf["max_unflushed"]; ok {
+		size, err := sizeValue(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "max_unflushed")
+		}
+		opts = append(opts, writer.WithMaxUnflushed(size))
+	}
+
+	if v, ok := conf["mode"]; ok {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return nil, errors.Wrap(err, "mode")
+		}
+		opts = append(opts, writer.WithFileMode(os.FileMode(mode)))
+	}
+
+	var err error
+	uid, gid := -1, -1
+	if v, ok := conf["uid"]; ok {
+		if uid, err = strconv.Atoi(v); err != nil {
+			return nil, errors.Wrap(err, "uid")
+		}
+	}
+	if v, ok := conf["gid"]; ok {
+		if gid, err = strconv.Atoi(v); err != nil {
+			return nil, errors.Wrap(err, "gid")
+		}
+	}
+	if uid != -1 || gid != -1 {
+		opts = append(opts, writer.WithOwner(uid, gid))
+	}
+
+	if v, ok := conf["create_dirs"]; ok {
+		create, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "create_dirs")
+		}
+		if create {
+			opts = append(opts, writer.WithCreateDirs())
+		}
+	}
+
+	switch v := conf["time_source"]; v {
+	case "":
+	case "wall", "clock":
+		opts = append(opts, writer.WithTimeSource(writer.ClockTime))
+	case "entry":
+		opts = append(opts, writer.WithTimeSource(writer.EntryTime))
+	default:
+		return nil, errors.Errorf("time_source: unknown value: %s", v)
+	}
+
+	w, err := writer.NewFile(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, location)
+	}
+	return w, nil
+}
+
+func newElasticsearch(logger tools.FieldLogger, conf map[string]string) (io.Writer, error) {
+	addr, ok := conf["url"]
+	if !ok {
+		return nil, missingKeyError("url")
+	}
+
+	size, delay, err := batchSettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	attempts, backoff, maxBackoff, err := retrySettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+
+	opts := []func(*writer.Elasticsearch) error{
+		writer.WithElasticsearchURL(addr),
+		writer.WithElasticsearchBatch(size, delay),
+		writer.WithElasticsearchRetry(attempts, backoff, maxBackoff),
+		writer.WithElasticsearchLogger(logger),
+	}
+	if index, ok := conf["index"]; ok {
+		opts = append(opts, writer.WithElasticsearchIndex(index))
+	}
+	if docType, ok := conf["doc_type"]; ok {
+		opts = append(opts, writer.WithElasticsearchDocType(docType))
+	}
+
+	w, err := writer.NewElasticsearch(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	return w, nil
+}
+
+func newInfluxDB(logger tools.FieldLogger, conf map[string]string) (io.Writer, error) {
+	addr, ok := conf["url"]
+	if !ok {
+		return nil, missingKeyError("url")
+	}
+
+	size, delay, err := batchSettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	attempts, backoff, maxBackoff, err := retrySettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+
+	opts := []func(*writer.InfluxDB) error{
+		writer.WithInfluxDBURL(addr),
+		writer.WithInfluxDBBatch(size, delay),
+		writer.WithInfluxDBRetry(attempts, backoff, maxBackoff),
+		writer.WithInfluxDBLogger(logger),
+	}
+
+	switch conf["version"] {
+	case "", "1":
+		opts = append(opts, writer.WithInfluxDBDatabase(conf["database"], conf["username"], conf["password"]))
+	case "2":
+		opts = append(opts, writer.WithInfluxDBBucket(conf["org"], conf["bucket"], conf["token"]))
+	default:
+		return nil, errors.Errorf("%s: unknown version: %s", addr, conf["version"])
+	}
+
+	if measurement, ok := conf["measurement"]; ok {
+		opts = append(opts, writer.WithInfluxDBMeasurement(measurement))
+	}
+	if tags, ok := conf["tags"]; ok {
+		opts = append(opts, writer.WithInfluxDBTags(listValue(tags)...))
+	}
+	if fields, ok := conf["fields"]; ok {
+		opts = append(opts, writer.WithInfluxDBFields(listValue(fields)...))
+	}
+	for _, item := range listValue(conf["field_types"]) {
+		i := strings.Index(item, ":")
+		if i < 0 {
+			return nil, errors.Errorf("%s: invalid field type: %s", addr, item)
+		}
+		key, typ := strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		opts = append(opts, writer.WithInfluxDBFieldType(key, typ))
+	}
+
+	w, err := writer.NewInfluxDB(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	return w, nil
+}
+
+func newSyslog(logger tools.FieldLogger, conf map[string]string) (io.Writer, error) {
+	network := conf["network"]
+	if network == "" {
+		network = "udp"
+	}
+	addr, ok := conf["address"]
+	if !ok {
+		if network != "unix" {
+			return nil, missingKeyError("address")
+		}
+		addr = "/dev/log"
+	}
+
+	opts := []func(*writer.Syslog) error{
+		writer.WithSyslogAddress(network, addr),
+		writer.WithSyslogLogger(logger),
+	}
+	switch v := strings.ToLower(conf["format"]); v {
+	case "", "rfc5424":
+	case "rfc3164":
+		opts = append(opts, writer.WithSyslogFormat(writer.RFC3164))
+	default:
+		return nil, errors.Errorf("%s: unknown format: %s", addr, v)
+	}
+	if facility, ok := conf["facility"]; ok {
+		opts = append(opts, writer.WithSyslogFacility(facility))
+	}
+	if appName, ok := conf["app_name"]; ok {
+		opts = append(opts, writer.WithSyslogAppName(appName))
+	}
+	if hostname, ok := conf["hostname"]; ok {
+		opts = append(opts, writer.WithSyslogHostname(hostname))
+	}
+
+	w, err := writer.NewSyslog(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	return w, nil
+}
+
+func newHTTP(logger tools.FieldLogger, conf map[string]string) (io.Writer, error) {
+	addr, ok := conf["url"]
+	if !ok {
+		return nil, missingKeyError("url")
+	}
+
+	size, delay, err := batchSettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	attempts, backoff, maxBackoff, err := retrySettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+
+	opts := []func(*writer.HTTP) error{
+		writer.WithHTTPURL(addr),
+		writer.WithHTTPBatch(size, delay),
+		writer.WithHTTPRetry(attempts, backoff, maxBackoff),
+		writer.WithHTTPLogger(logger),
+	}
+	if method, ok := conf["compress"]; ok {
+		opts = append(opts, writer.WithHTTPCompress(method))
+	}
+	for _, header := range listValue(conf["headers"]) {
+		i := strings.Index(header, ":")
+		if i < 0 {
+			return nil, errors.Errorf("%s: invalid header: %s", addr, header)
+		}
+		key, value := strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:])
+		opts = append(opts, writer.WithHTTPHeader(key, value))
+	}
+
+	w, err := writer.NewHTTP(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	return w, nil
+}
+
+func newConsole(conf map[string]string) (io.Writer, error) {
+	var opts []func(*writer.Console) error
+	if stream, ok := conf["stream"]; ok {
+		opts = append(opts, writer.WithConsoleStream(stream))
+	}
+	if color, ok := conf["color"]; ok {
+		opts = append(opts, writer.WithConsoleColor(color))
+	}
+	w, err := writer.NewConsole(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "console")
+	}
+	return w, nil
+}
+
+func newLoki(logger tools.FieldLogger, conf map[string]string) (io.Writer, error) {
+	addr, ok := conf["url"]
+	if !ok {
+		return nil, missingKeyError("url")
+	}
+
+	size, delay, err := batchSettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	attempts, backoff, maxBackoff, err := retrySettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+
+	opts := []func(*writer.Loki) error{
+		writer.WithLokiURL(addr),
+		writer.WithLokiBatch(size, delay),
+		writer.WithLokiRetry(attempts, backoff, maxBackoff),
+		writer.WithLokiLogger(logger),
+	}
+	if labels, ok := conf["labels"]; ok {
+		opts = append(opts, writer.WithLokiLabels(listValue(labels)...))
+	}
+	if format, ok := conf["format"]; ok {
+		opts = append(opts, writer.WithLokiFormat(format))
+	}
+
+	w, err := writer.NewLoki(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	return w, nil
+}
+
+func newSplunkHEC(logger tools.FieldLogger, conf map[string]string) (io.Writer, error) {
+	addr, ok := conf["url"]
+	if !ok {
+		return nil, missingKeyError("url")
+	}
+	token, ok := conf["token"]
+	if !ok {
+		return nil, missingKeyError("token")
+	}
+
+	size, delay, err := batchSettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	attempts, backoff, maxBackoff, err := retrySettings(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+
+	opts := []func(*writer.SplunkHEC) error{
+		writer.WithSplunkHECURL(addr),
+		writer.WithSplunkHECToken(token),
+		writer.WithSplunkHECIndex(conf["index"]),
+		writer.WithSplunkHECSourceType(conf["sourcetype"]),
+		writer.WithSplunkHECSource(conf["source"]),
+		writer.WithSplunkHECHost(conf["host"]),
+		writer.WithSplunkHECBatch(size, delay),
+		writer.WithSplunkHECRetry(attempts, backoff, maxBackoff),
+		writer.WithSplunkHECLogger(logger),
+	}
+
+	if v, ok := conf["ack"]; ok {
+		ack, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "ack")
+		}
+		timeout := 30 * time.Second
+		if v, ok := conf["ack_timeout"]; ok {
+			if timeout, err = time.ParseDuration(v); err != nil {
+				return nil, errors.Wrap(err, "ack_timeout")
+			}
+		}
+		if ack {
+			opts = append(opts, writer.WithSplunkHECAck(timeout))
+		}
+	}
+
+	w, err := writer.NewSplunkHEC(opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, addr)
+	}
+	return w, nil
+}
+
+// listValue splits a comma separated value and trims the spaces around the
+// items.
+func listValue(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// sizeValue parses sizes like 512KB, 100MB or 1GB. A number without a unit is
+// in bytes.
+func sizeValue(v string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"KB", 1 << 10},
+		{"MB", 1 << 20},
+		{"GB", 1 << 30},
+		{"B", 1},
+	}
+
+	v = strings.ToUpper(strings.TrimSpace(v))
+	multiplier := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			multiplier = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// batchSettings returns the batch_size and flush_delay values of the
+// settings, or their defaults if they are not set.
+func batchSettings(conf map[string]string) (int, time.Duration, error) {
+	var (
+		size  = writer.DefaultBatchSize
+		delay = time.Second
+		err   error
+	)
+
+	if v, ok := conf["batch_size"]; ok {
+		if size, err = strconv.Atoi(v); err != nil {
+			return 0, 0, errors.Wrap(err, "batch_size")
+		}
+	}
+
+	if v, ok := conf["flush_delay"]; ok {
+		if delay, err = time.ParseDuration(v); err != nil {
+			return 0, 0, errors.Wrap(err, "flush_delay")
+		}
+	}
+	return size, delay, nil
+}
+
+// retrySettings returns the retry_attempts, retry_backoff and
+// retry_max_backoff values of the settings, or their defaults if they are not
+// set.
+func retrySettings(conf map[string]string) (int, time.Duration, time.Duration, error) {
+	for _, key := range []string{"max_retries", "retry_delay"} {
+		if _, ok := conf[key]; ok {
+			return 0, 0, 0, errors.Errorf("%s is not supported, use the retry_* keys", key)
+		}
+	}
+
+	var (
+		attempts   = writer.DefaultRetryAttempts
+		backoff    = writer.DefaultRetryBackoff
+		maxBackoff = writer.DefaultRetryMaxBackoff
+		err        error
+	)
+	if v, ok := conf["retry_attempts"]; ok {
+		if attempts, err = strconv.Atoi(v); err != nil {
+			return 0, 0, 0, errors.Wrap(err, "retry_attempts")
+		}
+	}
+	if v, ok := conf["retry_backoff"]; ok {
+		if backoff, err = time.ParseDuration(v); err != nil {
+			return 0, 0, 0, errors.Wrap(err, "retry_backoff")
+		}
+		if maxBackoff < backoff {
+			maxBackoff = backoff
+		}
+	}
+	if v, ok := conf["retry_max_backoff"]; ok {
+		if maxBackoff, err = time.ParseDuration(v); err != nil {
+			return 0, 0, 0, errors.Wrap(err, "retry_max_backoff")
+		}
+	}
+	return attempts, backoff, maxBackoff, nil
+}
+
+// queueOptions returns the options of the queue from the queue_depth and the
+// overflow keys of the settings.
+func queueOptions(conf map[string]string) ([]func(*writer.Queue) error, error) {
+	var opts []func(*writer.Queue) error
+	if v, ok := conf["queue_depth"]; ok {
+		depth, err := strconv.Atoi(v)
+		if err != nil || depth < 1 {
+			return nil, errors.Errorf("queue_depth: invalid value: %s", v)
+		}
+		opts = append(opts, writer.WithQueueDepth(depth))
+	}
+	if v, ok := conf["overflow"]; ok {
+		policy, err := writer.ParseOverflowPolicy(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "overflow")
+		}
+		opts = append(opts, writer.WithQueuePolicy(policy))
+	}
+	return opts, nil
+}
+
+// newWAL returns a WAL for the writer from the wal, wal_max_size, wal_fsync,
+// wal_fsync_interval and wal_attempts keys of the settings. The entries that
+// the WAL gives up on are passed to onFailure, or logged if it is nil. It
+// returns nil if the wal key is not set.
+func newWAL(logger tools.FieldLogger, name string, w io.Writer, conf map[string]string, onFailure func(p, payload []byte, err error)) (*writer.WAL, error) {
+	dir, ok := conf["wal"]
+	if !ok {
+		return nil, nil
+	}
+	opts := []func(*writer.WAL) error{
+		writer.WithWALDir(dir),
+		writer.WithWALName(name),
+		writer.WithWALLogger(logger),
+	}
+	if v, ok := conf["wal_max_size"]; ok {
+		size, err := sizeValue(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "wal_max_size")
+		}
+		opts = append(opts, writer.WithWALMaxSize(size))
+	}
+	if v, ok := conf["wal_fsync"]; ok {
+		mode, err := writer.ParseSyncMode(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "wal_fsync")
+		}
+		interval := time.Second
+		if v, ok := conf["wal_fsync_interval"]; ok {
+			if interval, err = time.ParseDuration(v); err != nil {
+				return nil, errors.Wrap(err, "wal_fsync_interval")
+			}
+		}
+		opts = append(opts, writer.WithWALSync(mode, interval))
+	}
+	if v, ok := conf["wal_attempts"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "wal_attempts")
+		}
+		opts = append(opts, writer.WithWALAttempts(n))
+	}
+	if onFailure != nil {
+		opts = append(opts, writer.WithWALOnFailure(onFailure))
+	}
+	wal, err := writer.NewWAL(w, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "wal")
+	}
+	return wal, nil
+}
+
+// batcher is implemented by the writers that send the entries in batches.
+type batcher interface {
+	failureReporter
+	Flush() error
+	Stop()
+}
+
+// newRetry returns a Retry for the writer from the retry_attempts,
+// retry_backoff, retry_max_backoff, breaker_failures and breaker_cooldown
+// keys of the settings. It returns nil if none of them is set. The batched
+// writers retry the failed batches themselves with the retry_* keys, so it
+// returns nil for them, and refuses the breaker_* keys.
+func newRetry(logger tools.FieldLogger, name string, w io.Writer, conf map[string]string) (*writer.Retry, error) {
+	if _, ok := w.(batcher); ok {
+		for _, key := range []string{"breaker_failures", "breaker_cooldown"} {
+			if _, ok := conf[key]; ok {
+				return nil, errors.Errorf("%s is not supported by the batched writers", key)
+			}
+		}
+		return nil, nil
+	}
+
+	var set bool
+	for _, key := range []string{"retry_attempts", "retry_backoff", "retry_max_backoff", "breaker_failures", "breaker_cooldown"} {
+		if _, ok := conf[key]; ok {
+			set = true
+		}
+	}
+	if !set {
+		return nil, nil
+	}
+
+	attempts, backoff, maxBackoff, err := retrySettings(conf)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		failures = writer.DefaultBreakerFailures
+		cooldown = writer.DefaultBreakerCooldown
+	)
+	if v, ok := conf["breaker_failures"]; ok {
+		if failures, err = strconv.Atoi(v); err != nil {
+			return nil, errors.Wrap(err, "breaker_failures")
+		}
+	}
+	if v, ok := conf["breaker_cooldown"]; ok {
+		if cooldown, err = time.ParseDuration(v); err != nil {
+			return nil, errors.Wrap(err, "breaker_cooldown")
+		}
+	}
+
+	r, err := writer.NewRetry(w,
+		writer.WithRetryName(name),
+		writer.WithRetryAttempts(attempts),
+		writer.WithRetryBackoff(backoff, maxBackoff),
+		writer.WithRetryBreaker(failures, cooldown),
+		writer.WithRetryLogger(logger),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "retry")
+	}
+	return r, nil
+}
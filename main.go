@@ -16,6 +16,7 @@ var opts struct {
 	ConfigFile string `short:"c" long:"config-file" env:"CONFIGFILE" description:"configuration file" required:"true"`
 	LogLevel   string `short:"l" long:"log-level" env:"LOGLEVEL" default:"error" description:"application log level"`
 	Port       int    `short:"p" long:"port" default:"8080" env:"PORT" description:"port to listen for incoming payload"`
+	Replay     string `long:"replay" description:"write the entries of a dead letter file again and exit"`
 }
 
 // this main function is fully covered in the main_test.go file and is excluded
@@ -27,7 +28,11 @@ func main() {
 	}
 
 	logger := tools.GetLogger(opts.LogLevel)
-	err = handler.Bootstrap(logger, opts.ConfigFile, opts.Port)
+	if opts.Replay != "" {
+		err = handler.Replay(logger, opts.ConfigFile, opts.Replay)
+	} else {
+		err = handler.Bootstrap(logger, opts.ConfigFile, opts.Port)
+	}
 	if err != nil {
 		logger.Fatal(err)
 	}
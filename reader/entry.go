@@ -0,0 +1,130 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package reader
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Entry is the structured form of a line rendered by Plain. Writers that
+// store the entries in a structured destination can recover the entry from
+// the line they receive with ParseEntry.
+type Entry struct {
+	Kind      string
+	Message   string
+	Timestamp time.Time
+	Fields    map[string]string
+}
+
+// ParseEntry decodes a line rendered by Plain back into an Entry. It returns
+// an ErrInvalidLine error if the line can not be decoded, or it doesn't have
+// a message.
+func ParseEntry(line []byte) (*Entry, error) {
+	e := &Entry{
+		Fields: make(map[string]string),
+	}
+
+	line = bytes.TrimSpace(line)
+	for len(line) > 0 {
+		i := bytes.IndexByte(line, '=')
+		if i <= 0 {
+			return nil, errors.Wrap(ErrInvalidLine, "no key")
+		}
+		key := string(line[:i])
+		line = line[i+1:]
+
+		value, rest, err := nextValue(line)
+		if err != nil {
+			return nil, errors.Wrap(err, key)
+		}
+		line = bytes.TrimLeft(rest, " ")
+
+		switch key {
+		case "time":
+			t, err := time.Parse(TimestampFormat, value)
+			if err != nil {
+				return nil, errors.Wrap(err, ErrTimestamp.Error())
+			}
+			e.Timestamp = t
+		case "level":
+			e.Kind = value
+		case "msg":
+			e.Message = value
+		default:
+			e.Fields[key] = value
+		}
+	}
+
+	if e.Message == "" {
+		return nil, errors.Wrap(ErrInvalidLine, ErrEmptyMessage.Error())
+	}
+	if e.Kind == "" {
+		e.Kind = InfoLevel
+	}
+	return e, nil
+}
+
+// MarshalJSON returns the entry as a payload that GetPlains reads back into
+// an entry with the same message, level, timestamp and fields. The values of
+// the fields are strings, as they are in the rendered line.
+func (e *Entry) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(e.Fields)+3)
+	for key, value := range e.Fields {
+		m[key] = value
+	}
+	m["type"] = e.Kind
+	m["message"] = e.Message
+	m["timestamp"] = e.Timestamp.Format(TimestampFormat)
+	return json.Marshal(m)
+}
+
+// ParseEntries splits p into lines and returns an Entry for each non-empty
+// line. It returns an error if any of the lines can not be decoded.
+func ParseEntries(p []byte) ([]*Entry, error) {
+	var entries []*Entry
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		e, err := ParseEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// nextValue reads a value from the beginning of line and returns the rest of
+// the line. Values with spaces or special characters are quoted by the
+// formatter.
+func nextValue(line []byte) (string, []byte, error) {
+	if len(line) == 0 || line[0] != '"' {
+		i := bytes.IndexByte(line, ' ')
+		if i < 0 {
+			return string(line), nil, nil
+		}
+		return string(line[:i]), line[i:], nil
+	}
+
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++ // skipping the escaped character
+		case '"':
+			value, err := strconv.Unquote(string(line[:i+1]))
+			if err != nil {
+				return "", nil, errors.Wrap(ErrInvalidLine, err.Error())
+			}
+			return value, line[i+1:], nil
+		}
+	}
+	return "", nil, errors.Wrap(ErrInvalidLine, "unterminated quote")
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package reader_test
+
+import (
+	"io/ioutil"
+	"time"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/arsham/logpipe/tools"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+var _ = Describe("ParseEntry", func() {
+
+	Context("having a line rendered by Plain", func() {
+		var (
+			entry     *reader.Entry
+			err       error
+			timestamp = time.Date(2017, 1, 14, 19, 10, 10, 0, time.UTC)
+			message   = `this is a "quoted" message with = signs`
+		)
+
+		BeforeEach(func() {
+			p := &reader.Plain{
+				Kind:      reader.WarnLevel,
+				Message:   message,
+				Timestamp: timestamp,
+				Fields: map[string]interface{}{
+					"app":   "billing",
+					"code":  12,
+					"owner": "the team",
+				},
+				Logger: tools.DiscardLogger(),
+			}
+			line, e := ioutil.ReadAll(p)
+			Expect(e).NotTo(HaveOccurred())
+			entry, err = reader.ParseEntry(line)
+		})
+
+		It("should not error", func() {
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should recover the kind, message and timestamp", func() {
+			Expect(entry.Kind).To(Equal(reader.WarnLevel))
+			Expect(entry.Message).To(Equal(message))
+			Expect(entry.Timestamp).To(BeTemporally("==", timestamp))
+		})
+
+		It("should recover the fields", func() {
+			Expect(entry.Fields).To(HaveLen(3))
+			Expect(entry.Fields).To(HaveKeyWithValue("app", "billing"))
+			Expect(entry.Fields).To(HaveKeyWithValue("code", "12"))
+			Expect(entry.Fields).To(HaveKeyWithValue("owner", "the team"))
+		})
+
+		It("should encode to a payload of the same entry", func() {
+			b, err := entry.MarshalJSON()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(MatchJSON(`{
+				"type": "warning",
+				"message": "this is a \"quoted\" message with = signs",
+				"timestamp": "2017-01-14T19:10:10Z",
+				"app": "billing",
+				"code": "12",
+				"owner": "the team"
+			}`))
+		})
+	})
+
+	DescribeTable("having invalid lines", func(line string) {
+		entry, err := reader.ParseEntry([]byte(line))
+		Expect(errors.Cause(err)).To(Equal(reader.ErrInvalidLine))
+		Expect(entry).To(BeNil())
+	},
+		Entry("empty", ``),
+		Entry("no message", `time="2017-01-14T19:10:10Z" level=error`),
+		Entry("no key", `=value msg=blah`),
+		Entry("unterminated quote", `level=error msg="blah`),
+	)
+
+	Context("having multiple lines", func() {
+		It("should return an entry for each line", func() {
+			input := "level=error msg=one\n\nlevel=info msg=\"two\"\n"
+			entries, err := reader.ParseEntries([]byte(input))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(2))
+			Expect(entries[0].Message).To(Equal("one"))
+			Expect(entries[1].Kind).To(Equal(reader.InfoLevel))
+		})
+	})
+})
@@ -13,4 +13,6 @@ var (
 	ErrTimestamp     = errors.New("invalid timestamp")
 	ErrEmptyObject   = errors.New("empty object")
 	ErrCorruptedJSON = errors.New("corrupted json")
+	ErrInvalidLine   = errors.New("invalid line")
+	ErrUnknownLevel  = errors.New("unknown level")
 )
@@ -6,6 +6,7 @@ package reader
 
 import (
 	"io"
+	"strings"
 	"time"
 
 	"github.com/araddon/dateparse"
@@ -16,21 +17,82 @@ import (
 
 // The following constants are used for log levels.
 const (
+	DebugLevel = "debug"
 	InfoLevel  = "info"
 	ErrorLevel = "error"
 	WarnLevel  = "warning"
 )
 
+// NormalLevel returns the level in lower case, and WarnLevel for "warn". It
+// returns false if the level is not one of the levels above.
+func NormalLevel(level string) (string, bool) {
+	level = strings.ToLower(strings.TrimSpace(level))
+	switch level {
+	case "warn":
+		return WarnLevel, true
+	case DebugLevel, InfoLevel, WarnLevel, ErrorLevel:
+		return level, true
+	}
+	return level, false
+}
+
 // GetReader tries to guess an appropriate reader from the input reader and
 // returns it. It will fall back to Plain reader. It returns an error if there
-// is no type or message are in the input or the message is empty.
+// is no type or message are in the input or the message is empty, or the type
+// is not one of the levels. Any other keys in the input are passed to the
+// reader as the entry's fields.
+//
+// The input can also be an array of objects, in which case the entries are
+// read one after another.
 func GetReader(r io.Reader, logger tools.FieldLogger) (io.Reader, error) {
+	plains, err := GetPlains(r, logger)
+	if err != nil {
+		return nil, err
+	}
+	if len(plains) == 1 {
+		return plains[0], nil
+	}
+	readers := make([]io.Reader, len(plains))
+	for i, p := range plains {
+		readers[i] = p
+	}
+	return io.MultiReader(readers...), nil
+}
+
+// GetPlains returns a Plain reader for each entry in the input, which can be a
+// JSON object or an array of objects. It returns an error if any of the
+// entries are invalid.
+func GetPlains(r io.Reader, logger tools.FieldLogger) ([]*Plain, error) {
 	j, err := jason.NewFromReader(r)
 	if err != nil {
 		return nil, errors.Wrap(err, ErrCorruptedJSON.Error())
 	}
 
-	if m, err := j.Map(); err != nil {
+	arr, err := j.Array()
+	if err != nil {
+		p, err := getPlain(j, logger)
+		if err != nil {
+			return nil, err
+		}
+		return []*Plain{p}, nil
+	}
+	if len(arr) == 0 {
+		return nil, ErrEmptyObject
+	}
+	plains := make([]*Plain, len(arr))
+	for i := range arr {
+		p, err := getPlain(j.GetIndex(i), logger)
+		if err != nil {
+			return nil, errors.Wrapf(err, "entry %d", i)
+		}
+		plains[i] = p
+	}
+	return plains, nil
+}
+
+func getPlain(j *jason.Json, logger tools.FieldLogger) (*Plain, error) {
+	m, err := j.Map()
+	if err != nil {
 		return nil, errors.Wrap(err, ErrCorruptedJSON.Error())
 	} else if len(m) == 0 {
 		return nil, ErrEmptyObject
@@ -40,6 +102,10 @@ func GetReader(r io.Reader, logger tools.FieldLogger) (io.Reader, error) {
 	if err != nil || kind == "" {
 		kind = InfoLevel
 	}
+	level, ok := NormalLevel(kind)
+	if !ok {
+		return nil, errors.Wrap(ErrUnknownLevel, kind)
+	}
 
 	message, err := j.Get("message").String()
 	if err != nil {
@@ -62,10 +128,23 @@ func GetReader(r io.Reader, logger tools.FieldLogger) (io.Reader, error) {
 		return nil, err
 	}
 
+	var fields map[string]interface{}
+	for key, value := range m {
+		switch key {
+		case "type", "message", "timestamp":
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]interface{})
+		}
+		fields[key] = value
+	}
+
 	return &Plain{
 		Message:   message,
-		Kind:      kind,
+		Kind:      level,
 		Timestamp: t,
+		Fields:    fields,
 		Logger:    logger,
 	}, nil
 }
@@ -53,6 +53,7 @@ var _ = Describe("GetReader", func() {
 			Entry("all right", `{"type":"error", "message":"Devil is the king!","timestamp":"2017-01-01"}`, nil),
 			Entry("all right too", `{"message":"Devil is the king!"}`, nil),
 			Entry("capital type", `{"type":"INFO", "message":"Devil is the king!"}`, nil),
+			Entry("unknown type", `{"type":"fatal", "message":"Devil is the king!"}`, reader.ErrUnknownLevel),
 			Entry("all right + more", `{"type":"error", "message":"Devil","timestamp":"2017-01-01", "king": true}`, nil),
 			Entry("corrupted json object", `{"type":"error", ,}`, reader.ErrCorruptedJSON),
 			Entry("only one string in json object", `"type"`, reader.ErrCorruptedJSON),
@@ -106,4 +107,40 @@ var _ = Describe("GetReader", func() {
 			})
 		})
 	})
+
+	Describe("reading an array of entries", func() {
+		It("should read all the entries", func() {
+			input := `[{"type":"error","message":"first","timestamp":"2017-01-01"},{"message":"second","app":"billing"}]`
+			r, err := reader.GetReader(strings.NewReader(input), logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			buf := new(bytes.Buffer)
+			_, err = buf.ReadFrom(r)
+			Expect(err).NotTo(HaveOccurred())
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			Expect(lines).To(HaveLen(2))
+			Expect(lines[0]).To(ContainSubstring("msg=first"))
+			Expect(lines[1]).To(ContainSubstring("app=billing"))
+		})
+
+		It("should error if any of the entries are invalid", func() {
+			r, err := reader.GetReader(strings.NewReader(`[{"message":"ok"},{"type":"error"}]`), logger)
+			Expect(err.Error()).To(ContainSubstring(reader.ErrEmptyMessage.Error()))
+			Expect(r).To(BeNil())
+		})
+
+		It("should return a Plain for each entry", func() {
+			input := `[{"type":"error","message":"first"},{"type":"warning","message":"second"}]`
+			plains, err := reader.GetPlains(strings.NewReader(input), logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plains).To(HaveLen(2))
+			Expect(plains[0].Kind).To(Equal(reader.ErrorLevel))
+			Expect(plains[1].Message).To(Equal("second"))
+		})
+
+		It("should error on empty arrays", func() {
+			_, err := reader.GetReader(strings.NewReader(`[]`), logger)
+			Expect(err).To(Equal(reader.ErrEmptyObject))
+		})
+	})
 })
@@ -6,6 +6,7 @@ package reader
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"sync"
 	"time"
@@ -32,12 +33,17 @@ var TimestampFormat = time.RFC3339
 // Will become:
 //     [2017-10-09 10:45:00] [ERROR] something happened
 //
+// Any other keys in the payload are kept in Fields and are appended to the
+// line. A "time" field is renamed to "fields.time", the same as logrus does
+// with the "msg" and "level" fields.
+//
 // Because Plain might be used for multiple writes, we compile the output only
 // once.
 type Plain struct {
 	Kind      string
 	Message   string
 	Timestamp time.Time
+	Fields    map[string]interface{}
 	Logger    tools.FieldLogger
 	once      sync.Once
 	compiled  io.Reader
@@ -88,16 +94,34 @@ func (p *Plain) Read(b []byte) (int, error) {
 		p.Kind = InfoLevel
 	}
 
+	kind, ok := NormalLevel(p.Kind)
+	if !ok {
+		p.Logger.Error(errors.Wrap(ErrUnknownLevel, p.Kind))
+		return 0, ErrUnknownLevel
+	}
+	p.Kind = kind
+
 	p.once.Do(func() {
 		logger := logrus.New()
 		customFormatter := new(TextFormatter)
 		customFormatter.DisableColors = true
 		logger.Formatter = customFormatter
+		logger.Level = logrus.DebugLevel
 
 		buf := new(bytes.Buffer)
 		logger.Out = buf
-		ll := logger.WithField("time", p.Timestamp.Format(TimestampFormat))
+		fields := make(logrus.Fields, len(p.Fields)+1)
+		for key, value := range p.Fields {
+			if key == "time" {
+				key = "fields.time"
+			}
+			fields[key] = value
+		}
+		fields["time"] = p.Timestamp.Format(TimestampFormat)
+		ll := logger.WithFields(fields)
 		switch p.Kind {
+		case DebugLevel:
+			ll.Debug(p.Message)
 		case InfoLevel:
 			ll.Info(p.Message)
 		case WarnLevel:
@@ -111,3 +135,16 @@ func (p *Plain) Read(b []byte) (int, error) {
 
 	return p.compiled.Read(b)
 }
+
+// MarshalJSON returns the entry as a payload that GetPlains reads back into
+// the same entry.
+func (p *Plain) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(p.Fields)+3)
+	for key, value := range p.Fields {
+		m[key] = value
+	}
+	m["type"] = p.Kind
+	m["message"] = p.Message
+	m["timestamp"] = p.Timestamp.Format(TimestampFormat)
+	return json.Marshal(m)
+}
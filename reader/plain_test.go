@@ -195,6 +195,45 @@ var _ = Describe("Plain", func() {
 	})
 })
 
+var _ = Describe("Plain rendering", func() {
+	read := func(p *reader.Plain) (string, error) {
+		p.Message = "something happened"
+		p.Timestamp = time.Date(2017, 10, 9, 10, 45, 0, 0, time.UTC)
+		p.Logger = tools.DiscardLogger()
+		b, err := ioutil.ReadAll(p)
+		return string(b), err
+	}
+
+	It("should write the entries of all levels", func() {
+		for kind, want := range map[string]string{
+			"debug":   "level=debug",
+			"info":    "level=info",
+			"warn":    "level=warning",
+			"WARNING": "level=warning",
+			"error":   "level=error",
+		} {
+			line, err := read(&reader.Plain{Kind: kind})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(line).To(ContainSubstring(want), kind)
+		}
+	})
+
+	It("should refuse the unknown levels", func() {
+		_, err := read(&reader.Plain{Kind: "fatal"})
+		Expect(errors.Cause(err)).To(Equal(reader.ErrUnknownLevel))
+	})
+
+	It("should keep the time field of the entry", func() {
+		line, err := read(&reader.Plain{
+			Kind:   "info",
+			Fields: map[string]interface{}{"time": "yesterday"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(HavePrefix(`time="2017-10-09T10:45:00Z"`))
+		Expect(line).To(ContainSubstring("fields.time=yesterday"))
+	})
+})
+
 var _ = Describe("TextFormatter", func() {
 	Describe("Format", func() {
 		var (
@@ -282,4 +321,23 @@ var _ = Describe("TextFormatter", func() {
 			})
 		})
 	})
+
+	Describe("MarshalJSON", func() {
+		It("should return a payload that is read back into the same entry", func() {
+			body := `{"type":"error","message":"something happened","timestamp":"2017-10-09T10:45:00Z","app":"billing","count":3}`
+			plains, err := reader.GetPlains(strings.NewReader(body), tools.DiscardLogger())
+			Expect(err).NotTo(HaveOccurred())
+
+			b, err := plains[0].MarshalJSON()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b).To(MatchJSON(body))
+
+			again, err := reader.GetPlains(bytes.NewReader(b), tools.DiscardLogger())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again[0].Message).To(Equal("something happened"))
+			Expect(again[0].Kind).To(Equal("error"))
+			Expect(again[0].Timestamp.Equal(plains[0].Timestamp)).To(BeTrue())
+			Expect(again[0].Fields).To(HaveKeyWithValue("app", "billing"))
+		})
+	})
 })
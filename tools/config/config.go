@@ -7,18 +7,58 @@
 //
 //    app:
 //      log_level: info
+//      write_timeout: 5s
+//      quorum: first
+//      dead_letter: /var/lib/logpipe/dead_letter.log
+//      max_in_flight: 64
+//      max_queued: 256
+//      queue_timeout: 2s
+//      retry_after: 1s
+//      ack: written
 //    writers:
-//      elasticsearch:
+//      elastic1:
+//         type: elasticsearch
 //         url: http://localhost:9200
-//         index: logs
-//      file:
-//         path: /var/log/logpipe/logs.log
+//         index: logs-2006.01.02
+//         batch_size: 500
+//      file1:
+//         type: file
+//         location: /var/log/logpipe/logs.log
+//         levels: [error, warning]
+//         timeout: 1s
+//    routes:
+//      - match:
+//          app: billing
+//        writers: [file1]
+//      - default: true
+//        writers: [elastic1, file1]
 //
-// The app part will be collapsed as the Setting properties.
+// The app part will be collapsed as the Setting properties. Writer values can
+// be strings, numbers or booleans, and they are all passed to the writers as
+// strings. Lists of strings are passed as comma separated values. The routes
+// section is optional, and all entries are written to all writers without it.
+//
+// The write_timeout is the deadline of the writers that don't have a timeout
+// in their settings. The quorum is the number of the writers that should
+// succeed for each entry, "first" for the first one, or "all" which is the
+// default. The entries that the writers give up on are appended to the
+// dead_letter file if it is set.
+//
+// The max_in_flight is the number of the requests that are handled at the
+// same time, and max_queued is the number of the requests that wait for them
+// for up to queue_timeout. The other requests are refused, and the clients
+// are asked to retry after retry_after.
+//
+// With "ack: written", the requests wait until their entries are written and
+// flushed by the writers, or the quorum of them. The default is "none".
 package config
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
@@ -40,10 +80,44 @@ type Setting struct {
 	// logs.
 	LogLevel string
 
+	// WriteTimeout is the deadline of writing an entry into each writer.
+	// Zero means no deadline.
+	WriteTimeout time.Duration
+
+	// Quorum is the number of the writers that should succeed in writing
+	// each entry. Zero means all writers.
+	Quorum int
+
+	// DeadLetter is the file that the entries the writers give up on are
+	// appended to. Empty means the entries are only logged.
+	DeadLetter string
+
+	// MaxInFlight is the number of the requests that are handled at the same
+	// time. Zero means no limit.
+	MaxInFlight int
+
+	// MaxQueued is the number of the requests that wait for the in-flight
+	// requests.
+	MaxQueued int
+
+	// QueueTimeout is how long the queued requests wait.
+	QueueTimeout time.Duration
+
+	// RetryAfter is the time the clients are asked to wait before retrying
+	// the refused requests.
+	RetryAfter time.Duration
+
+	// Ack makes the requests wait until their entries are written.
+	Ack bool
+
 	// Writers has a map of "writer" name to its configuration.
 	// Each writer decides its own configuration.
 	// It goes as: [name:[type:file, location:foo, name:bar]],..
 	Writers map[string]map[string]string
+
+	// Routes choose the writers of each entry. If there are no routes, the
+	// entries are written to all writers.
+	Routes []Route
 }
 
 // Read loads the configurations from filename location.
@@ -70,6 +144,49 @@ func Read(filename string) (*Setting, error) {
 	if l, ok := app["log_level"]; ok {
 		s.LogLevel = l.(string)
 	}
+	if t, ok := app["write_timeout"]; ok {
+		str, _ := stringValue(t)
+		if s.WriteTimeout, err = time.ParseDuration(str); err != nil || s.WriteTimeout < 0 {
+			return nil, errors.Errorf("write_timeout: invalid duration: %v", t)
+		}
+	}
+	if q, ok := app["quorum"]; ok {
+		if s.Quorum, err = quorumValue(q); err != nil {
+			return nil, err
+		}
+	}
+
+	if d, ok := app["dead_letter"]; ok {
+		if s.DeadLetter, ok = d.(string); !ok || s.DeadLetter == "" {
+			return nil, errors.Errorf("dead_letter: invalid value: %v", d)
+		}
+	}
+
+	if s.MaxInFlight, err = intValue(app, "max_in_flight"); err != nil {
+		return nil, err
+	}
+	if s.MaxQueued, err = intValue(app, "max_queued"); err != nil {
+		return nil, err
+	}
+	if s.MaxQueued > 0 && s.MaxInFlight == 0 {
+		return nil, errors.New("max_queued: needs max_in_flight")
+	}
+	if s.QueueTimeout, err = durationValue(app, "queue_timeout"); err != nil {
+		return nil, err
+	}
+	if s.RetryAfter, err = durationValue(app, "retry_after"); err != nil {
+		return nil, err
+	}
+
+	if a, ok := app["ack"]; ok {
+		switch a {
+		case "written":
+			s.Ack = true
+		case "none":
+		default:
+			return nil, errors.Errorf("ack: invalid value: %v", a)
+		}
+	}
 
 	app = v.GetStringMap("writers")
 	if len(app) == 0 {
@@ -86,7 +203,7 @@ func Read(filename string) (*Setting, error) {
 		// setMap is: [location:foo, name:bar]
 		for name, value := range setMap {
 			var strVal string
-			if strVal, ok = value.(string); !ok {
+			if strVal, ok = stringValue(value); !ok {
 				return nil, errors.New("no string value")
 			}
 
@@ -95,6 +212,88 @@ func Read(filename string) (*Setting, error) {
 		maps[moduleName] = configs
 	}
 	s.Writers = maps
+	if s.Quorum > len(maps) {
+		return nil, errors.Errorf("quorum (%d) is more than the writers (%d)", s.Quorum, len(maps))
+	}
+
+	if v.IsSet("routes") {
+		values, ok := v.Get("routes").([]interface{})
+		if !ok {
+			return nil, errors.New("routes: not a list")
+		}
+		if s.Routes, err = readRoutes(values, maps); err != nil {
+			return nil, errors.Wrap(err, "routes")
+		}
+	}
 
 	return s, nil
 }
+
+// intValue returns the non-negative number of the key, or zero if it is not
+// set.
+func intValue(m map[string]interface{}, key string) (int, error) {
+	v, ok := m[key]
+	if !ok {
+		return 0, nil
+	}
+	str, _ := stringValue(v)
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("%s: invalid value: %v", key, v)
+	}
+	return n, nil
+}
+
+// durationValue returns the non-negative duration of the key, or zero if it
+// is not set.
+func durationValue(m map[string]interface{}, key string) (time.Duration, error) {
+	v, ok := m[key]
+	if !ok {
+		return 0, nil
+	}
+	str, _ := stringValue(v)
+	d, err := time.ParseDuration(str)
+	if err != nil || d < 0 {
+		return 0, errors.Errorf("%s: invalid duration: %v", key, v)
+	}
+	return d, nil
+}
+
+// quorumValue returns the quorum from a number, "first" or "all".
+func quorumValue(value interface{}) (int, error) {
+	str, _ := stringValue(value)
+	switch str {
+	case "first":
+		return 1, nil
+	case "all":
+		return 0, nil
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("quorum: invalid value: %v", value)
+	}
+	return n, nil
+}
+
+// stringValue returns the string representation of scalar values. Numbers and
+// booleans are accepted as they are common in the writers' settings. Lists of
+// strings are joined with commas.
+func stringValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case int, int64, float64, bool:
+		return fmt.Sprint(v), true
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", false
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ", "), true
+	}
+	return "", false
+}
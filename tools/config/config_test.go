@@ -8,9 +8,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/arsham/logpipe/tools/config"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 )
 
@@ -135,6 +137,157 @@ app:
 			})
 		})
 
+		Context("having a yaml file with numbers and booleans as values", func() {
+			BeforeEach(func() {
+				input = []byte(`
+writers:
+  w1:
+    type: elasticsearch
+    batch_size: 500
+    sniff: true
+`)
+			})
+			It("loads them as strings", func() {
+				Expect(readErr).NotTo(HaveOccurred())
+				Expect(setting.Writers["w1"]["batch_size"]).To(Equal("500"))
+				Expect(setting.Writers["w1"]["sniff"]).To(Equal("true"))
+			})
+		})
+
+		Context("having a yaml file with a list of strings", func() {
+			BeforeEach(func() {
+				input = []byte(`
+writers:
+  w1:
+    type: file
+    levels: [error, warning]
+`)
+			})
+			It("loads them as comma separated values", func() {
+				Expect(readErr).NotTo(HaveOccurred())
+				Expect(setting.Writers["w1"]["levels"]).To(Equal("error, warning"))
+			})
+		})
+
+		Context("having a yaml file with app settings", func() {
+			BeforeEach(func() {
+				input = []byte(`
+app:
+  write_timeout: 2s
+  quorum: first
+  dead_letter: /var/lib/logpipe/dead_letter.log
+  max_in_flight: 64
+  max_queued: 256
+  queue_timeout: 2s
+  retry_after: 3s
+  ack: written
+writers:
+  w1:
+    type: file
+    location: /dev/null
+`)
+			})
+			It("loads them", func() {
+				Expect(readErr).NotTo(HaveOccurred())
+				Expect(setting.WriteTimeout).To(Equal(2 * time.Second))
+				Expect(setting.Quorum).To(Equal(1))
+				Expect(setting.DeadLetter).To(Equal("/var/lib/logpipe/dead_letter.log"))
+				Expect(setting.MaxInFlight).To(Equal(64))
+				Expect(setting.MaxQueued).To(Equal(256))
+				Expect(setting.QueueTimeout).To(Equal(2 * time.Second))
+				Expect(setting.RetryAfter).To(Equal(3 * time.Second))
+				Expect(setting.Ack).To(BeTrue())
+			})
+		})
+
+		DescribeTable("having invalid app settings", func(app string) {
+			f, err := ioutil.TempFile("", "test_config")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(f.Name())
+			_, err = f.WriteString("app:\n" + app + "writers:\n  w1:\n    type: file\n    location: /dev/null\n")
+			Expect(err).NotTo(HaveOccurred())
+			s, err := config.Read(f.Name())
+			Expect(err).To(HaveOccurred())
+			Expect(s).To(BeNil())
+		},
+			Entry("invalid timeout", "  write_timeout: soon\n"),
+			Entry("negative timeout", "  write_timeout: -1s\n"),
+			Entry("invalid quorum", "  quorum: most\n"),
+			Entry("quorum more than writers", "  quorum: 2\n"),
+			Entry("empty dead letter", "  dead_letter: \"\"\n"),
+			Entry("negative max in flight", "  max_in_flight: -1\n"),
+			Entry("max queued without max in flight", "  max_queued: 10\n"),
+			Entry("invalid queue timeout", "  max_in_flight: 1\n  queue_timeout: soon\n"),
+			Entry("negative retry after", "  retry_after: -1s\n"),
+			Entry("unknown ack", "  ack: flushed\n"),
+		)
+
+		Context("having a yaml file with routes", func() {
+			BeforeEach(func() {
+				input = []byte(`
+writers:
+  billing:
+    type: file
+    location: /dev/null
+  staging:
+    type: file
+    location: /dev/null
+routes:
+  - match:
+      app: billing
+    writers: [billing]
+  - match:
+      env: staging
+      host: {regex: "^web-"}
+      trace_id: {exists: true}
+    writers: [staging, billing]
+  - default: true
+    writers: [staging]
+`)
+			})
+			It("loads the routes in order", func() {
+				Expect(readErr).NotTo(HaveOccurred())
+				Expect(setting.Routes).To(Equal([]config.Route{
+					{
+						Match:   []config.Condition{{Field: "app", Operator: config.Equals, Value: "billing"}},
+						Writers: []string{"billing"},
+					},
+					{
+						Match: []config.Condition{
+							{Field: "env", Operator: config.Equals, Value: "staging"},
+							{Field: "host", Operator: config.Regex, Value: "^web-"},
+							{Field: "trace_id", Operator: config.Exists, Value: "true"},
+						},
+						Writers: []string{"staging", "billing"},
+					},
+					{Writers: []string{"staging"}, Default: true},
+				}))
+			})
+		})
+
+		DescribeTable("having invalid routes", func(routes string) {
+			f, err := ioutil.TempFile("", "test_config")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(f.Name())
+			_, err = f.WriteString("writers:\n  w1:\n    type: file\n    location: /dev/null\nroutes:\n" + routes)
+			Expect(err).NotTo(HaveOccurred())
+			s, err := config.Read(f.Name())
+			Expect(err).To(HaveOccurred())
+			Expect(s).To(BeNil())
+		},
+			Entry("unknown writer", "  - match: {app: x}\n    writers: [w2]\n"),
+			Entry("no writers", "  - match: {app: x}\n"),
+			Entry("no conditions", "  - writers: [w1]\n"),
+			Entry("invalid regex", "  - match: {app: {regex: \"[\"}}\n    writers: [w1]\n"),
+			Entry("unknown operator", "  - match: {app: {like: x}}\n    writers: [w1]\n"),
+			Entry("non boolean exists", "  - match: {app: {exists: maybe}}\n    writers: [w1]\n"),
+			Entry("default with conditions", "  - match: {app: x}\n    default: true\n    writers: [w1]\n"),
+			Entry("two defaults", "  - default: true\n    writers: [w1]\n  - default: true\n    writers: [w1]\n"),
+			Entry("not a list", "  app: x\n"),
+			Entry("list of values", "  - match: {app: [billing, shop]}\n    writers: [w1]\n"),
+			Entry("list of operator values", "  - match: {app: {equals: [billing, shop]}}\n    writers: [w1]\n"),
+		)
+
 		Context("having a yaml file with a list as log file name", func() {
 			BeforeEach(func() {
 				input = []byte(`
@@ -0,0 +1,204 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// The operators of the conditions.
+const (
+	// Equals matches if the value of the field is equal to the condition's
+	// value.
+	Equals = "equals"
+
+	// Regex matches if the value of the field matches the regular expression
+	// in the condition's value.
+	Regex = "regex"
+
+	// Exists matches if the field is present and the condition's value is
+	// "true", or if the field is absent and the value is "false".
+	Exists = "exists"
+)
+
+// Route chooses the writers of the entries that match all of its conditions.
+// The default route has no conditions, and is used for the entries that do not
+// match any other routes.
+type Route struct {
+	// Match holds the conditions, sorted by their field names.
+	Match []Condition
+
+	// Writers has the names of the writers.
+	Writers []string
+
+	// Default is true for the default route.
+	Default bool
+}
+
+// Condition is a test on a field of the entries. The "type" and "message"
+// fields are the level and the message of the entry.
+type Condition struct {
+	Field    string
+	Operator string
+	Value    string
+}
+
+// readRoutes loads the routes from the values of the routes section. Routes
+// come in the following form:
+//
+//	routes:
+//	  - match:
+//	      app: billing
+//	      host: {regex: "^web-"}
+//	      trace_id: {exists: true}
+//	    writers: [file1, elastic1]
+//	  - default: true
+//	    writers: [file2]
+//
+// The writers must be defined in the writers section.
+func readRoutes(values []interface{}, writers map[string]map[string]string) ([]Route, error) {
+	routes := make([]Route, 0, len(values))
+	hasDefault := false
+	for i, value := range values {
+		route, err := readRoute(value, writers)
+		if err != nil {
+			return nil, errors.Wrapf(err, "route %d", i+1)
+		}
+		if route.Default {
+			if hasDefault {
+				return nil, errors.Errorf("route %d: more than one default route", i+1)
+			}
+			hasDefault = true
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func readRoute(value interface{}, writers map[string]map[string]string) (Route, error) {
+	var route Route
+	m, ok := stringMap(value)
+	if !ok {
+		return route, errors.New("not a map")
+	}
+
+	for key, v := range m {
+		switch key {
+		case "match":
+			match, ok := stringMap(v)
+			if !ok {
+				return route, errors.New("match: not a map")
+			}
+			for field, cond := range match {
+				c, err := readCondition(field, cond)
+				if err != nil {
+					return route, errors.Wrapf(err, "match: %s", field)
+				}
+				route.Match = append(route.Match, c)
+			}
+		case "writers":
+			names, ok := v.([]interface{})
+			if !ok {
+				return route, errors.New("writers: not a list")
+			}
+			for _, n := range names {
+				name, ok := n.(string)
+				if !ok {
+					return route, errors.Errorf("writers: %v is not a name", n)
+				}
+				if _, ok := writers[name]; !ok {
+					return route, errors.Errorf("writers: unknown writer: %s", name)
+				}
+				route.Writers = append(route.Writers, name)
+			}
+		case "default":
+			if route.Default, ok = v.(bool); !ok {
+				return route, errors.New("default: not a boolean")
+			}
+		default:
+			return route, errors.Errorf("unknown key: %s", key)
+		}
+	}
+
+	sort.Slice(route.Match, func(i, j int) bool {
+		return route.Match[i].Field < route.Match[j].Field
+	})
+	if len(route.Writers) == 0 {
+		return route, errors.New("no writers")
+	}
+	if route.Default && len(route.Match) > 0 {
+		return route, errors.New("default route can not have conditions")
+	}
+	if !route.Default && len(route.Match) == 0 {
+		return route, errors.New("no conditions")
+	}
+	return route, nil
+}
+
+// readCondition returns an Equals condition for scalar values, otherwise the
+// value should be a map with one of the operators as its only key. Lists are
+// refused, as a field has only one value; a regex can match any of a few
+// values.
+func readCondition(field string, value interface{}) (Condition, error) {
+	c := Condition{Field: field, Operator: Equals}
+	if _, ok := value.([]interface{}); ok {
+		return c, errors.New("lists are not supported, use a regex for matching any of the values")
+	}
+	if s, ok := stringValue(value); ok {
+		c.Value = s
+		return c, nil
+	}
+
+	m, ok := stringMap(value)
+	if !ok || len(m) != 1 {
+		return c, errors.New("should be a value or a map with one operator")
+	}
+	for op, v := range m {
+		if _, ok := v.([]interface{}); ok {
+			return c, errors.Errorf("%s: lists are not supported", op)
+		}
+		s, ok := stringValue(v)
+		if !ok {
+			return c, errors.Errorf("%s: no string value", op)
+		}
+		c.Operator, c.Value = op, s
+	}
+
+	switch c.Operator {
+	case Equals:
+	case Regex:
+		if _, err := regexp.Compile(c.Value); err != nil {
+			return c, errors.Wrap(err, "regex")
+		}
+	case Exists:
+		if _, err := strconv.ParseBool(c.Value); err != nil {
+			return c, errors.Errorf("exists: %s is not a boolean", c.Value)
+		}
+	default:
+		return c, errors.Errorf("unknown operator: %s", c.Operator)
+	}
+	return c, nil
+}
+
+// stringMap returns the map with string keys. Depending on the yaml decoder,
+// the maps in lists might have interface{} keys.
+func stringMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = val
+		}
+		return m, true
+	}
+	return nil, false
+}
@@ -0,0 +1,342 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/arsham/logpipe/tools"
+	"github.com/pkg/errors"
+)
+
+// DefaultBatchSize is the number of entries the remote writers collect before
+// sending them to their destinations.
+var DefaultBatchSize = 100
+
+// DefaultTimeout is the timeout of the requests sent to remote destinations.
+var DefaultTimeout = 10 * time.Second
+
+// Defaults of the attempts of the failed sends of the batched writers, and
+// the writes of the Retry writer.
+const (
+	DefaultRetryAttempts   = 3
+	DefaultRetryBackoff    = 100 * time.Millisecond
+	DefaultRetryMaxBackoff = 10 * time.Second
+)
+
+// batch collects the entries and hands them to send when it is full, or when
+// the delay has passed. Writers that send the entries to remote destinations
+// embed a batch and provide the send function.
+//
+// The entries are sent without holding the lock, so the entries can be added
+// while a batch is being sent or retried. A failed send is tried again with
+// the whole batch, with an exponential backoff and jitter between the
+// attempts, if the error is retryable. When all attempts fail, the entry that
+// filled the batch gets the error from Write, and the other entries are passed
+// to the failure callback. (see OnFailure)
+type batch struct {
+	sync.Mutex
+	name       string // of the writer in the logs
+	size       int
+	delay      time.Duration
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	logger     tools.FieldLogger
+	send       func([]*reader.Entry) error
+	onFailure  func(p, payload []byte, err error)
+	entries    []*reader.Entry
+	lines      []batchLine
+	lastID     uint64
+	closed     bool
+	quit       chan struct{} // stops the flush goroutine
+
+	stop     chan struct{} // interrupts the backoffs when closed
+	stopOnce sync.Once
+	sendMu   sync.Mutex // keeps the sends in order
+}
+
+// batchLine is a write of the entries in the batch, with the payload of the
+// entries if it is known.
+type batchLine struct {
+	id      uint64
+	p       []byte
+	payload []byte
+}
+
+// start sets the defaults and starts a goroutine to send the entries in
+// intervals. The name is used in the logs.
+func (b *batch) start(name string, send func([]*reader.Entry) error) {
+	if b.size == 0 {
+		b.size = DefaultBatchSize
+	}
+	if b.delay == 0 {
+		b.delay = time.Second
+	}
+	if b.attempts == 0 {
+		b.attempts = DefaultRetryAttempts
+		b.backoff = DefaultRetryBackoff
+		b.maxBackoff = DefaultRetryMaxBackoff
+	}
+	if b.logger == nil {
+		b.logger = tools.StandardLogger()
+	}
+	b.name = name
+	b.send = send
+	b.quit = make(chan struct{})
+	b.stop = make(chan struct{})
+	go b.sync()
+}
+
+// setBatch validates and sets the batch size and the delay between sends.
+func (b *batch) setBatch(size int, delay time.Duration) error {
+	if size <= 0 {
+		return ErrBatchSize
+	}
+	if delay < MinimumDelay {
+		return fmt.Errorf("low (%d) delay", delay)
+	}
+	b.size = size
+	b.delay = delay
+	return nil
+}
+
+// setRetry validates and sets the number of the attempts of each send,
+// including the first one, the delay after the first attempt, and the maximum
+// delay between the attempts.
+func (b *batch) setRetry(attempts int, backoff, max time.Duration) error {
+	if attempts < 1 {
+		return fmt.Errorf("low (%d) attempts", attempts)
+	}
+	if backoff <= 0 || max < backoff {
+		return fmt.Errorf("invalid (%s, %s) backoff", backoff, max)
+	}
+	b.attempts = attempts
+	b.backoff = backoff
+	b.maxBackoff = max
+	return nil
+}
+
+// OnFailure sets the function that is called with the writes that fail after
+// Write has returned, for example when the batch is sent in intervals. The
+// payload is the JSON payload of the entries if it is passed along with the
+// write, for example by a Distribute with a payload. If it is not set, the
+// failed entries are logged.
+func (b *batch) OnFailure(f func(p, payload []byte, err error)) {
+	b.Lock()
+	defer b.Unlock()
+	b.onFailure = f
+}
+
+// Write parses the lines in p and adds them to the batch. It sends the batch
+// if it is full, and returns any errors occurred during the send.
+func (b *batch) Write(p []byte) (int, error) {
+	return b.writePayload(p, nil)
+}
+
+// writePayload is Write that keeps the payload of the entries for the failure
+// callback.
+func (b *batch) writePayload(p, payload []byte) (int, error) {
+	entries, err := reader.ParseEntries(p)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing the entry")
+	}
+
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return 0, ErrClosed
+	}
+	b.lastID++
+	id := b.lastID
+	b.entries = append(b.entries, entries...)
+	b.lines = append(b.lines, batchLine{id: id, p: append([]byte(nil), p...), payload: payload})
+	full := len(b.entries) >= b.size
+	b.Unlock()
+
+	if !full {
+		return len(p), nil
+	}
+	if err := b.flush(id); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush sends the collected entries. The entries are also passed to the
+// failure callback if the send fails.
+func (b *batch) Flush() error {
+	return b.flush(0)
+}
+
+// Stop interrupts the backoffs of the send in progress, and the following sends
+// are not tried again. It is used for giving up on the entries when the
+// service is shutting down and can not wait any longer. The writer is not
+// closed.
+func (b *batch) Stop() {
+	b.stopOnce.Do(func() { close(b.stop) })
+}
+
+// Close sends the remaining entries and stops the flush goroutine.
+func (b *batch) Close() error {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return ErrClosed
+	}
+	b.closed = true
+	close(b.quit)
+	b.Unlock()
+	return errors.Wrap(b.flush(0), "flushing on close")
+}
+
+// flush sends the collected entries, and passes the writes to the failure
+// callback if the send fails, except the one with the trigger id which gets
+// the error. The entries are discarded after the send even if it fails, so
+// the batch doesn't grow indefinitely.
+func (b *batch) flush(trigger uint64) error {
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+
+	b.Lock()
+	entries, lines := b.entries, b.lines
+	b.entries, b.lines = nil, nil
+	b.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	err := b.retry(entries)
+	if err != nil {
+		b.fail(lines, trigger, err)
+	}
+	return err
+}
+
+// retry sends the entries until they are sent, the error is not retryable, or
+// the attempts run out. It returns a *RetryError if the entries are sent more
+// than once.
+func (b *batch) retry(entries []*reader.Entry) error {
+	for attempt := 1; ; attempt++ {
+		err := b.send(entries)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if attempt >= b.attempts {
+			return retryError(attempt, err)
+		}
+		delay := backoffDelay(b.backoff, b.maxBackoff, attempt)
+		b.logger.WithField("writer", b.name).
+			Warnf("sending the batch failed, trying again in %s: %s", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-b.stop:
+			return retryError(attempt, err)
+		}
+	}
+}
+
+// fail passes the writes, except the one with the trigger id, to the failure
+// callback. They are logged if there is no callback.
+func (b *batch) fail(lines []batchLine, trigger uint64, err error) {
+	b.Lock()
+	onFailure := b.onFailure
+	b.Unlock()
+
+	var dropped int
+	for _, l := range lines {
+		if l.id == trigger {
+			continue
+		}
+		if onFailure != nil {
+			onFailure(l.p, l.payload, err)
+			continue
+		}
+		dropped++
+	}
+	if dropped > 0 {
+		b.logger.WithField("writer", b.name).Errorf("dropping %d write(s): %s", dropped, err)
+	}
+}
+
+// sync sends the entries in intervals until the batch is closed.
+func (b *batch) sync() {
+	ticker := time.NewTicker(b.delay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(); err != nil {
+				b.logger.WithField("writer", b.name).Error(errors.Wrap(err, "sending the batch"))
+			}
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// post sends the request and returns the response body. It returns a
+// StatusError if the response is not successful.
+func post(client *http.Client, req *http.Request) ([]byte, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "sending the request")
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the response")
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return body, &StatusError{Code: res.StatusCode, Body: string(body)}
+	}
+	return body, nil
+}
+
+// backoffDelay returns the delay before the next attempt. The backoff is
+// doubled after each attempt up to max, and a random half of it is added as
+// jitter.
+func backoffDelay(backoff, max time.Duration, attempt int) time.Duration {
+	d := backoff << uint(attempt-1)
+	if d > max || d <= 0 {
+		d = max
+	}
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// retryable reports whether the write might succeed if it is sent again. The
+// writes refused by the destination, except for the rate limits, and the
+// writes into closed writers are not retryable. The partially failed bulk
+// requests are not retryable either, as the accepted items would be written
+// twice.
+func retryable(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *StatusError:
+		return e.Code >= http.StatusInternalServerError || e.Code == http.StatusTooManyRequests
+	case *BulkError:
+		return false
+	}
+	return errors.Cause(err) != ErrClosed
+}
+
+// retryError returns err as a *RetryError if it is tried more than once.
+func retryError(attempts int, err error) error {
+	if attempts == 1 {
+		return err
+	}
+	return &RetryError{Attempts: attempts, Err: err}
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// This file contains the background compression of the rotated files.
+
+// CompressRetryDelay is the delay before retrying failed compressions.
+var CompressRetryDelay = 10 * time.Second
+
+const gzipExt = ".gz"
+
+// errFileMoved is returned when a file is rotated while being compressed. It
+// will be compressed with its new name.
+var errFileMoved = errors.New("file moved while compressing")
+
+// signalCompress wakes up the compressor without blocking.
+func (f *File) signalCompress() {
+	if f.compSig == nil {
+		return
+	}
+	select {
+	case f.compSig <- struct{}{}:
+	default: // the compressor is already signalled
+	}
+}
+
+// compressor compresses the rotated files whenever it is signalled, until the
+// File is closed. If any of the files fail, it logs the error and retries
+// after CompressRetryDelay.
+func (f *File) compressor() {
+	defer f.wg.Done()
+	for {
+		select {
+		case <-f.compSig:
+		case <-f.quit:
+			return
+		}
+		failed := false
+		for _, name := range f.uncompressed() {
+			err := f.compressFile(name)
+			if err == nil || errors.Cause(err) == errFileMoved {
+				continue
+			}
+			failed = true
+			f.logger.Errorf("compressing %s: %s", name, err)
+		}
+		if failed {
+			time.AfterFunc(CompressRetryDelay, f.signalCompress)
+		}
+	}
+}
+
+// uncompressed returns the rotated files that are not compressed yet.
+func (f *File) uncompressed() []string {
+	f.compMu.Lock()
+	defer f.compMu.Unlock()
+
+	var names []string
+	backups, err := f.backups()
+	if err != nil {
+		f.logger.Errorf("listing the backups: %s", err)
+	}
+	for _, b := range backups {
+		if b.ext == "" {
+			names = append(names, b.path)
+		}
+	}
+
+	// With the entry time the previous periods might be written again.
+	if f.pattern == "" || f.timeSource == EntryTime {
+		return names
+	}
+	files, err := periodFiles(f.pattern)
+	if err != nil {
+		f.logger.Errorf("listing the files of %s: %s", f.pattern, err)
+	}
+	current := filepath.Clean(f.location)
+	for _, name := range files {
+		if name == current || strings.HasSuffix(name, gzipExt) {
+			continue
+		}
+		if strings.HasPrefix(name, current+".") {
+			continue // already in the backups
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// compressFile writes the gzipped contents of the file into a temporary file,
+// and moves it next to the file. The original file is only removed when the
+// compressed file is in place.
+func (f *File) compressFile(name string) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return errors.Wrap(err, "getting file info")
+	}
+
+	src, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "opening the file")
+	}
+	defer src.Close()
+
+	dir, base := filepath.Split(name)
+	tmp, err := ioutil.TempFile(dir, "."+base+"-")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary file")
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+
+	if err := gzipTo(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "closing temporary file")
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+		return errors.Wrap(err, "setting permissions")
+	}
+
+	f.compMu.Lock()
+	defer f.compMu.Unlock()
+	if current, err := os.Stat(name); err != nil || !os.SameFile(info, current) {
+		return errFileMoved
+	}
+	if _, err := os.Stat(name + gzipExt); err == nil {
+		return errors.New(name + gzipExt + " already exists")
+	}
+	if err := os.Rename(tmp.Name(), name+gzipExt); err != nil {
+		return errors.Wrap(err, "moving the compressed file")
+	}
+	return errors.Wrap(os.Remove(name), "removing the file")
+}
+
+func gzipTo(dst *os.File, src io.Reader) error {
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		return errors.Wrap(err, "compressing")
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Wrap(err, "closing the compressor")
+	}
+	return errors.Wrap(dst.Sync(), "syncing the compressed file")
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Console prints the log entries to stdout or stderr. The entries are
+// rendered with logrus' text formatter, which colors the output if it is a
+// terminal. It implements io.WriteCloser interface.
+type Console struct {
+	name   string
+	out    io.Writer
+	color  string
+	logger *logrus.Logger
+}
+
+// NewConsole returns a Console that prints to stdout with colors if it is a
+// terminal.
+func NewConsole(conf ...func(*Console) error) (*Console, error) {
+	c := &Console{
+		name:  "stdout",
+		out:   os.Stdout,
+		color: "auto",
+	}
+	for _, f := range conf {
+		if err := f(c); err != nil {
+			return nil, err
+		}
+	}
+
+	formatter := new(reader.TextFormatter)
+	formatter.FullTimestamp = true
+	formatter.TimestampFormat = reader.TimestampFormat
+	switch c.color {
+	case "always":
+		formatter.ForceColors = true
+	case "never":
+		formatter.DisableColors = true
+	}
+
+	c.logger = logrus.New()
+	c.logger.Out = c.out
+	c.logger.Formatter = formatter
+	c.logger.Level = logrus.DebugLevel
+	return c, nil
+}
+
+// Name returns the name of the stream.
+func (c *Console) Name() string { return c.name }
+
+// Write prints each line in p.
+func (c *Console) Write(p []byte) (int, error) {
+	entries, err := reader.ParseEntries(p)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing the entry")
+	}
+
+	for _, e := range entries {
+		fields := make(logrus.Fields, len(e.Fields)+1)
+		for k, v := range e.Fields {
+			fields[k] = v
+		}
+		fields["time"] = e.Timestamp.Format(reader.TimestampFormat)
+
+		ll := c.logger.WithFields(fields)
+		switch e.Kind {
+		case reader.ErrorLevel:
+			ll.Error(e.Message)
+		case reader.WarnLevel:
+			ll.Warn(e.Message)
+		case reader.DebugLevel:
+			ll.Debug(e.Message)
+		default:
+			ll.Info(e.Message)
+		}
+	}
+	return len(p), nil
+}
+
+// Close is a no-op, the streams are not closed.
+func (c *Console) Close() error { return nil }
+
+// WithConsoleStream sets the stream to stdout or stderr.
+func WithConsoleStream(stream string) func(*Console) error {
+	return func(c *Console) error {
+		switch stream {
+		case "stdout":
+			c.out = os.Stdout
+		case "stderr":
+			c.out = os.Stderr
+		default:
+			return fmt.Errorf("unknown (%s) stream", stream)
+		}
+		c.name = stream
+		return nil
+	}
+}
+
+// WithConsoleColor sets the color mode. It can be auto, always or never. With
+// auto the output is colored if it is a terminal.
+func WithConsoleColor(mode string) func(*Console) error {
+	return func(c *Console) error {
+		switch mode {
+		case "auto", "always", "never":
+		default:
+			return fmt.Errorf("unknown (%s) color mode", mode)
+		}
+		c.color = mode
+		return nil
+	}
+}
+
+// WithConsoleWriter prints the entries to w instead of the stream.
+func WithConsoleWriter(w io.Writer) func(*Console) error {
+	return func(c *Console) error {
+		if w == nil {
+			return errors.New("nil writer")
+		}
+		c.out = w
+		return nil
+	}
+}
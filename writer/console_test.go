@@ -0,0 +1,73 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Console", func() {
+	line := []byte(`time="2017-01-14T19:10:10Z" level=error msg="something bad happened" app=billing` + "\n")
+
+	Context("creating with bad options", func() {
+		It("should error", func() {
+			_, err := writer.NewConsole(writer.WithConsoleStream("stdin"))
+			Expect(err).To(HaveOccurred())
+			_, err = writer.NewConsole(writer.WithConsoleColor("sometimes"))
+			Expect(err).To(HaveOccurred())
+			_, err = writer.NewConsole(writer.WithConsoleWriter(nil))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("with colors disabled", func() {
+		It("should print the lines as they are", func() {
+			buf := new(bytes.Buffer)
+			c, err := writer.NewConsole(
+				writer.WithConsoleWriter(buf),
+				writer.WithConsoleColor("never"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			n, err := c.Write(append(line, line...))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(2 * len(line)))
+			Expect(buf.String()).To(Equal(strings.Repeat(string(line), 2)))
+		})
+	})
+
+	Context("with colors forced", func() {
+		It("should color the output", func() {
+			buf := new(bytes.Buffer)
+			c, err := writer.NewConsole(
+				writer.WithConsoleWriter(buf),
+				writer.WithConsoleColor("always"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = c.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf.String()).To(ContainSubstring("\x1b["))
+			Expect(buf.String()).To(ContainSubstring("something bad happened"))
+		})
+	})
+
+	Context("with auto colors", func() {
+		It("should not color the output if it is not a terminal", func() {
+			buf := new(bytes.Buffer)
+			c, err := writer.NewConsole(writer.WithConsoleWriter(buf))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = c.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buf.String()).NotTo(ContainSubstring("\x1b["))
+		})
+	})
+})
@@ -0,0 +1,126 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DeadRecord is an entry that a writer gave up on, with the JSON payload of
+// the entry.
+type DeadRecord struct {
+	Time     time.Time       `json:"time"`
+	Writer   string          `json:"writer"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	Entry    json.RawMessage `json:"entry"`
+}
+
+// DeadLetter appends the entries that the writers gave up on to a file, one
+// JSON record in each line. Each record is synced to the disk before Record
+// returns.
+type DeadLetter struct {
+	location string
+
+	// mu guards file.
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewDeadLetter returns an error if the location is not set, or the file can
+// not be opened.
+func NewDeadLetter(conf ...func(*DeadLetter) error) (*DeadLetter, error) {
+	d := &DeadLetter{}
+	for _, f := range conf {
+		if err := f(d); err != nil {
+			return nil, err
+		}
+	}
+	if d.location == "" {
+		return nil, ErrNoPath
+	}
+	file, err := os.OpenFile(d.location, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening the dead letter file")
+	}
+	d.file = file
+	return d, nil
+}
+
+// Name returns the location of the file.
+func (d *DeadLetter) Name() string { return d.location }
+
+// Record appends r to the file. The time is set to now if it is zero.
+func (d *DeadLetter) Record(r *DeadRecord) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "encoding the dead record")
+	}
+	b = append(b, '\n')
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return ErrClosed
+	}
+	if _, err := d.file.Write(b); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+// Close closes the file.
+func (d *DeadLetter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// ReadDeadRecords returns the records of a dead letter file. It returns an
+// error with the line number if a line is not a valid record.
+func ReadDeadRecords(r io.Reader) ([]*DeadRecord, error) {
+	var records []*DeadRecord
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			rec := &DeadRecord{}
+			if e := json.Unmarshal(b, rec); e != nil {
+				return nil, errors.Wrapf(e, "line %d", line)
+			}
+			records = append(records, rec)
+		}
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WithDeadLetterLocation sets the location of the file.
+func WithDeadLetterLocation(location string) func(*DeadLetter) error {
+	return func(d *DeadLetter) error {
+		d.location = location
+		return nil
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DeadLetter", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "dead_letter")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should error without a location", func() {
+		_, err := writer.NewDeadLetter()
+		Expect(err).To(Equal(writer.ErrNoPath))
+	})
+
+	It("should append the records that are read back", func() {
+		location := path.Join(dir, "dead.log")
+		d, err := writer.NewDeadLetter(writer.WithDeadLetterLocation(location))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d.Record(&writer.DeadRecord{
+			Writer:   "elastic1",
+			Error:    "connection refused",
+			Attempts: 3,
+			Entry:    []byte(`{"message":"first"}`),
+		})).To(Succeed())
+		Expect(d.Close()).To(Succeed())
+		Expect(d.Record(&writer.DeadRecord{})).To(Equal(writer.ErrClosed))
+
+		By("appending to the existing file")
+		d, err = writer.NewDeadLetter(writer.WithDeadLetterLocation(location))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d.Record(&writer.DeadRecord{Writer: "file1", Entry: []byte(`{"message":"second"}`)})).To(Succeed())
+		Expect(d.Close()).To(Succeed())
+
+		f, err := os.Open(location)
+		Expect(err).NotTo(HaveOccurred())
+		defer f.Close()
+		records, err := writer.ReadDeadRecords(f)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].Writer).To(Equal("elastic1"))
+		Expect(records[0].Error).To(Equal("connection refused"))
+		Expect(records[0].Attempts).To(Equal(3))
+		Expect(records[0].Time.IsZero()).To(BeFalse())
+		Expect(records[0].Entry).To(MatchJSON(`{"message":"first"}`))
+		Expect(records[1].Writer).To(Equal("file1"))
+	})
+
+	It("should error with the line of the invalid records", func() {
+		_, err := writer.ReadDeadRecords(strings.NewReader("{\"writer\":\"a\",\"entry\":{}}\n\nnot json\n"))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("line 3"))
+	})
+})
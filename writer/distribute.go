@@ -9,25 +9,59 @@ import (
 	"io"
 	"reflect"
 	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/pkg/errors"
 )
 
-// Distribute is a concurrent writer.
+// Distribute is a concurrent writer. Each writer can have a deadline, and a
+// writer that misses it is reported as failed without holding the others. If
+// a quorum is set, Write returns as soon as that many writers succeed. The
+// errors are returned as a *DistributeError, which names the failed writers.
+// Wrap the writers in a Queue to write into each of them in a long-lived
+// worker, instead of starting a goroutine for every write.
 type Distribute struct {
 	sync.Mutex
-	writers []io.Writer
+	writers  []io.Writer
+	timeout  time.Duration
+	timeouts map[io.Writer]time.Duration
+	names    map[io.Writer]string
+	quorum   int
+	logger   tools.FieldLogger
+
+	// onFailure is called with the error of each writer that fails.
+	onFailure func(name string, err error)
+
+	// payload is passed to the writers that report their failures later.
+	payload []byte
+
+	// flush makes the writers flush each entry after writing it.
+	flush bool
 }
 
 // NewDistribute returns no errors. It dismissed the writers with nil values.
 func NewDistribute(writers ...io.Writer) *Distribute {
-	var wrs []io.Writer
-	for _, w := range writers {
-		if w != nil && !reflect.ValueOf(w).IsNil() {
-			wrs = append(wrs, w)
+	d, _ := NewDistributeWith(WithDistributeWriters(writers...))
+	return d
+}
+
+// NewDistributeWith returns an error if the quorum is more than the number of
+// the writers.
+func NewDistributeWith(conf ...func(*Distribute) error) (*Distribute, error) {
+	d := &Distribute{
+		timeouts: make(map[io.Writer]time.Duration),
+		names:    make(map[io.Writer]string),
+	}
+	for _, f := range conf {
+		if err := f(d); err != nil {
+			return nil, err
 		}
 	}
-	return &Distribute{
-		writers: wrs,
+	if d.quorum > len(d.writers) {
+		return nil, fmt.Errorf("quorum (%d) is more than the writers (%d)", d.quorum, len(d.writers))
 	}
+	return d, nil
 }
 
 // used for sending the results back.
@@ -36,47 +70,248 @@ type result struct {
 	err error
 }
 
-// Write writes the input bytes into the writers concurrently. It returns an
-// error if any of the writers fail to write.
-func (c *Distribute) Write(p []byte) (int, error) {
-	var (
-		wg  sync.WaitGroup
-		res = make(chan result, len(c.writers))
-		err error
-		n   int
-	)
+// namer is implemented by the writers that have a name, for example the
+// location of the file.
+type namer interface {
+	Name() string
+}
+
+// Name returns the name of the writer. If it is not set with
+// WithDistributeName, the writer's Name method or its type is used.
+func (c *Distribute) Name(w io.Writer) string {
+	if name, ok := c.names[w]; ok {
+		return name
+	}
+	if n, ok := w.(namer); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", w)
+}
 
+// Write writes the input bytes into the writers concurrently, and waits for
+// the result. It returns a *DistributeError if any of the writers fail to
+// write or miss their deadline, with the errors of all failed writers. With a
+// quorum, it returns as soon as the quorum of the writers succeed, or when the
+// quorum can not be reached anymore. The writers that miss their deadline, or
+// are not finished when Write returns, carry on writing in the background.
+func (c *Distribute) Write(p []byte) (int, error) {
 	c.Lock()
 	defer c.Unlock()
 
-	for _, w := range c.writers {
-		wg.Add(1)
-		go func(w io.Writer) {
-			defer wg.Done()
-			defer func() {
-				if r := recover(); r != nil {
-					if err, ok := r.(error); ok {
-						res <- result{0, err}
-						return
-					}
-					res <- result{0, fmt.Errorf("panic: %v", r)}
-				}
-			}()
-			n, err := w.Write(p)
-			res <- result{n, err}
-		}(w)
-	}
-	wg.Wait()
-	close(res)
-
-	for r := range res {
-		if r.err != nil {
-			err = r.err
-			break
+	res := make(chan result, 1)
+	c.Send(p, func(n int, err error) {
+		res <- result{n, err}
+	})
+	r := <-res
+	return r.n, r.err
+}
+
+// submitter is implemented by the writers that write in the background, like
+// Queue. The payload is passed along to the writer.
+type submitter interface {
+	submit(p, payload []byte, done func(n int, err error))
+}
+
+// payloadWriter is implemented by the writers that report the failed entries
+// after the write has returned, like the batched writers, so they can report
+// the payload of the entries.
+type payloadWriter interface {
+	writePayload(p, payload []byte) (int, error)
+}
+
+// Send writes a copy of p into the writers concurrently, and returns without
+// waiting for them. done is called once with the same result Write would
+// return. The writers that are a Queue write in their own worker, and a
+// goroutine is started for each of the other writers. The failures are also
+// passed to the function set with WithDistributeOnFailure when the writers
+// finish, even after done is called.
+func (c *Distribute) Send(p []byte, done func(n int, err error)) {
+	if len(c.writers) == 0 {
+		done(0, nil)
+		return
+	}
+	p = append([]byte(nil), p...)
+
+	t := &tracker{
+		d:        c,
+		reported: make([]bool, len(c.writers)),
+		failures: make([]*WriterError, len(c.writers)),
+		done:     done,
+	}
+	for i, w := range c.writers {
+		i, w := i, w
+		var timer *time.Timer
+		if timeout := c.timeoutOf(w); timeout > 0 {
+			timer = time.AfterFunc(timeout, func() {
+				t.report(i, 0, errors.Wrapf(ErrTimeout, "after %s", timeout))
+			})
+		}
+		report := func(n int, err error) {
+			written := err == nil
+			if written && c.flush {
+				err = flush(w)
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			if err != nil && !written && c.onFailure != nil {
+				c.onFailure(c.Name(w), err)
+			}
+			t.report(i, n, err)
+		}
+
+		if s, ok := w.(submitter); ok {
+			s.submit(p, c.payload, report)
+			continue
+		}
+		go func() {
+			r := safeWritePayload(w, p, c.payload)
+			report(r.n, r.err)
+		}()
+	}
+}
+
+func (c *Distribute) timeoutOf(w io.Writer) time.Duration {
+	if timeout, ok := c.timeouts[w]; ok {
+		return timeout
+	}
+	return c.timeout
+}
+
+// tracker collects the results of the writers of one Send, and calls done
+// when the outcome is decided.
+type tracker struct {
+	sync.Mutex
+	d        *Distribute
+	reported []bool
+	failures []*WriterError
+	received int
+	success  int
+	failed   int
+	n        int
+	finished bool
+	done     func(n int, err error)
+}
+
+// report records the result of the writer at index i. The results of the
+// writers that have already missed their deadline are ignored. The errors
+// that are reported after the outcome is decided are logged.
+func (t *tracker) report(i, n int, err error) {
+	t.Lock()
+	if t.reported[i] {
+		t.Unlock()
+		return
+	}
+	t.reported[i] = true
+	t.received++
+	total := len(t.reported)
+	w := t.d.writers[i]
+
+	if t.finished {
+		t.Unlock()
+		if err != nil && t.d.logger != nil {
+			t.d.logger.WithField("writer", t.d.Name(w)).
+				Error(errors.Wrap(err, "writing after the quorum"))
+		}
+		return
+	}
+
+	if err != nil {
+		t.failed++
+		t.failures[i] = &WriterError{Name: t.d.Name(w), N: n, Err: err}
+	} else {
+		t.success++
+		t.n = max(t.n, n)
+	}
+
+	quorum := t.d.quorum
+	switch {
+	case quorum == 0 && t.received < total:
+		t.Unlock()
+		return
+	case quorum > 0 && t.success < quorum && t.failed <= total-quorum:
+		t.Unlock()
+		return
+	}
+	t.finished = true
+
+	var result error
+	if t.success < quorum || (quorum == 0 && t.failed > 0) {
+		e := &DistributeError{}
+		for _, f := range t.failures {
+			if f != nil {
+				e.Errors = append(e.Errors, f)
+			}
 		}
-		n = max(n, r.n)
+		result = e
 	}
-	return n, err
+	n = t.n
+	t.Unlock()
+	t.done(n, result)
+}
+
+// flusher is implemented by the writers that buffer the entries.
+type flusher interface {
+	Flush() error
+}
+
+// wrapper is implemented by the writers that write into another writer, like
+// Queue and Retry.
+type wrapper interface {
+	Writer() io.Writer
+}
+
+// flush flushes w, or the first writer with a Flush method that w wraps.
+func flush(w io.Writer) error {
+	for w != nil {
+		if f, ok := w.(flusher); ok {
+			return errors.Wrap(f.Flush(), "flushing")
+		}
+		wr, ok := w.(wrapper)
+		if !ok {
+			return nil
+		}
+		w = wr.Writer()
+	}
+	return nil
+}
+
+// safeWrite returns the panics as errors.
+func safeWrite(w io.Writer, p []byte) result {
+	return safeWritePayload(w, p, nil)
+}
+
+// safeWritePayload is safeWrite that passes the payload to the writers that
+// keep it.
+func safeWritePayload(w io.Writer, p, payload []byte) (r result) {
+	defer func() {
+		if e := recover(); e != nil {
+			if err, ok := e.(error); ok {
+				r = result{0, err}
+				return
+			}
+			r = result{0, fmt.Errorf("panic: %v", e)}
+		}
+	}()
+	if pw, ok := w.(payloadWriter); ok && payload != nil {
+		n, err := pw.writePayload(p, payload)
+		return result{n, err}
+	}
+	n, err := w.Write(p)
+	return result{n, err}
+}
+
+// isNil returns true if w is nil, or is a nil value of a type that can be nil.
+func isNil(w io.Writer) bool {
+	if w == nil {
+		return true
+	}
+	v := reflect.ValueOf(w)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Chan, reflect.Func, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
 }
 
 func max(a, b int) int {
@@ -85,3 +320,105 @@ func max(a, b int) int {
 	}
 	return b
 }
+
+// WithDistributeWriters adds the writers. It dismisses the writers with nil
+// values.
+func WithDistributeWriters(writers ...io.Writer) func(*Distribute) error {
+	return func(d *Distribute) error {
+		for _, w := range writers {
+			if !isNil(w) {
+				d.writers = append(d.writers, w)
+			}
+		}
+		return nil
+	}
+}
+
+// WithDistributeName sets the name of w in the errors.
+func WithDistributeName(w io.Writer, name string) func(*Distribute) error {
+	return func(d *Distribute) error {
+		d.names[w] = name
+		return nil
+	}
+}
+
+// WithDistributeTimeout sets the deadline of the writers that don't have their
+// own timeout. Zero means no deadline, which is the default.
+func WithDistributeTimeout(timeout time.Duration) func(*Distribute) error {
+	return func(d *Distribute) error {
+		if timeout < 0 {
+			return fmt.Errorf("negative (%s) timeout", timeout)
+		}
+		d.timeout = timeout
+		return nil
+	}
+}
+
+// WithDistributeWriterTimeout sets the deadline of writing into w. Zero means
+// no deadline for this writer.
+func WithDistributeWriterTimeout(w io.Writer, timeout time.Duration) func(*Distribute) error {
+	return func(d *Distribute) error {
+		if timeout < 0 {
+			return fmt.Errorf("negative (%s) timeout", timeout)
+		}
+		d.timeouts[w] = timeout
+		return nil
+	}
+}
+
+// WithDistributeQuorum sets the number of the writers that should succeed
+// before Write returns. 1 returns with the first successful writer, and 0
+// waits for all writers, which is the default.
+func WithDistributeQuorum(quorum int) func(*Distribute) error {
+	return func(d *Distribute) error {
+		if quorum < 0 {
+			return fmt.Errorf("negative (%d) quorum", quorum)
+		}
+		d.quorum = quorum
+		return nil
+	}
+}
+
+// WithDistributeLogger sets the logger for reporting the errors of the writers
+// that finish after Write has returned.
+func WithDistributeLogger(logger tools.FieldLogger) func(*Distribute) error {
+	return func(d *Distribute) error {
+		d.logger = logger
+		return nil
+	}
+}
+
+// WithDistributeOnFailure sets a function that is called with the name and
+// the error of each writer that fails to write an entry, when it finishes.
+// The writers that miss their deadline are passed when they fail, and not
+// when the deadline passes, since they might still succeed. The flush errors
+// are not passed, as the writers keep or report the entries they fail to
+// flush themselves.
+func WithDistributeOnFailure(f func(name string, err error)) func(*Distribute) error {
+	return func(d *Distribute) error {
+		d.onFailure = f
+		return nil
+	}
+}
+
+// WithDistributePayload sets the JSON payload of the entry that is written.
+// The writers that give up on the entry after the write has returned, like
+// the batched writers and the WALs, pass it to their failure callbacks.
+func WithDistributePayload(payload []byte) func(*Distribute) error {
+	return func(d *Distribute) error {
+		d.payload = payload
+		return nil
+	}
+}
+
+// WithDistributeFlush makes each writer flush the entry after writing it,
+// before it is counted as succeeded. If the writer wraps another writer, like
+// a Queue, the first writer with a Flush method is flushed. A WAL is flushed
+// by syncing the entry to the disk. The errors of the flushes are reported as
+// the errors of the writers.
+func WithDistributeFlush() func(*Distribute) error {
+	return func(d *Distribute) error {
+		d.flush = true
+		return nil
+	}
+}
@@ -6,8 +6,11 @@ package writer_test
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/arsham/logpipe/writer"
@@ -66,3 +69,55 @@ func BenchmarkDistribute(b *testing.B) {
 		})
 	}
 }
+
+// BenchmarkDistributeWorkers compares starting a goroutine for each writer on
+// every write, against writing into the long-lived workers of the queues. The
+// writers are set up once, as the handler does.
+func BenchmarkDistributeWorkers(b *testing.B) {
+	message := []byte(strings.Repeat("this is a message!", 10))
+
+	for _, count := range []int{1, 10, 100} {
+		writers := make([]io.Writer, count)
+		for i := range writers {
+			writers[i] = ioutil.Discard
+		}
+		queues := make([]io.Writer, count)
+		for i := range queues {
+			q, err := writer.NewQueue(ioutil.Discard)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer q.Close()
+			queues[i] = q
+		}
+
+		for _, tc := range []struct {
+			name    string
+			writers []io.Writer
+		}{
+			{"goroutines", writers},
+			{"queues", queues},
+		} {
+			d := writer.NewDistribute(tc.writers...)
+
+			b.Run(fmt.Sprintf("Write %d %s", count, tc.name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					d.Write(message)
+				}
+			})
+
+			// Send does not wait for the writers, like the handler.
+			b.Run(fmt.Sprintf("Send %d %s", count, tc.name), func(b *testing.B) {
+				b.ReportAllocs()
+				var wg sync.WaitGroup
+				wg.Add(b.N)
+				done := func(int, error) { wg.Done() }
+				for i := 0; i < b.N; i++ {
+					d.Send(message, done)
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
@@ -6,6 +6,8 @@ package writer_test
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"sync"
 	"time"
@@ -34,6 +36,43 @@ func (w *writerStub) Write(p []byte) (int, error) {
 	return copy(w.c, p), nil
 }
 
+// flushStub records the writes and the flushes, and fails the flushes while
+// failing is true.
+type flushStub struct {
+	sync.Mutex
+	failing bool
+	events  []string
+}
+
+func (f *flushStub) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.events = append(f.events, "write")
+	return len(p), nil
+}
+
+func (f *flushStub) Flush() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.failing {
+		return errors.New("buffer stuck")
+	}
+	f.events = append(f.events, "flush")
+	return nil
+}
+
+func (f *flushStub) SetFailing(failing bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.failing = failing
+}
+
+func (f *flushStub) Events() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.events...)
+}
+
 func min(a, b int) int {
 	if a <= b {
 		return a
@@ -164,4 +203,247 @@ var _ = Describe("Distribute", func() {
 			})
 		})
 	})
+
+	Describe("deadlines", func() {
+		var (
+			input = []byte("this is the message")
+			fast  *writerStub
+			hung  *writerStub
+			block chan struct{}
+		)
+
+		BeforeEach(func() {
+			block = make(chan struct{})
+			unblock := block
+			fast = &writerStub{c: make([]byte, len(input))}
+			hung = &writerStub{
+				c: make([]byte, len(input)),
+				writeFunc: func(p []byte) (int, error) {
+					<-unblock
+					return len(p), nil
+				},
+			}
+		})
+
+		AfterEach(func() {
+			close(block)
+		})
+
+		It("should report the writer that misses its deadline without holding the others", func() {
+			d, err := writer.NewDistributeWith(
+				writer.WithDistributeWriters(fast, hung),
+				writer.WithDistributeWriterTimeout(hung, 10*time.Millisecond),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			start := time.Now()
+			n, err := d.Write(input)
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(err).To(BeAssignableToTypeOf(&writer.DistributeError{}))
+			errs := err.(*writer.DistributeError).Errors
+			Expect(errs).To(HaveLen(1))
+			Expect(errs[0].Name).To(Equal("*writer_test.writerStub"))
+			Expect(errors.Cause(errs[0])).To(Equal(writer.ErrTimeout))
+			Expect(n).To(Equal(len(input)))
+			fast.RLock()
+			defer fast.RUnlock()
+			Expect(string(fast.c)).To(Equal(string(input)))
+		})
+
+		It("should apply the default timeout to all writers", func() {
+			d, err := writer.NewDistributeWith(
+				writer.WithDistributeWriters(fast, hung),
+				writer.WithDistributeTimeout(10*time.Millisecond),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = d.Write(input)
+			Expect(err).To(HaveOccurred())
+			Expect(errors.Cause(err.(*writer.DistributeError).Errors[0])).To(Equal(writer.ErrTimeout))
+		})
+
+		It("should not copy into the buffer after returning", func() {
+			d, err := writer.NewDistributeWith(
+				writer.WithDistributeWriters(hung),
+				writer.WithDistributeTimeout(time.Millisecond),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			var got []byte
+			unblock := block
+			hung.writeFunc = func(p []byte) (int, error) {
+				<-unblock
+				got = p
+				return len(p), nil
+			}
+			buf := append([]byte(nil), input...)
+			_, err = d.Write(buf)
+			Expect(err).To(HaveOccurred())
+			copy(buf, "overwritten")
+			block <- struct{}{}
+			hung.Lock()
+			defer hung.Unlock()
+			Expect(string(got)).To(Equal(string(input)))
+		})
+	})
+
+	Describe("quorum", func() {
+		var (
+			input = []byte("this is the message")
+			block chan struct{}
+			hung  *writerStub
+			bad   *writerStub
+		)
+
+		BeforeEach(func() {
+			block = make(chan struct{})
+			unblock := block
+			hung = &writerStub{writeFunc: func(p []byte) (int, error) {
+				<-unblock
+				return len(p), nil
+			}}
+			bad = &writerStub{writeFunc: func([]byte) (int, error) {
+				return 0, errors.New("bad writer")
+			}}
+		})
+
+		AfterEach(func() {
+			close(block)
+		})
+
+		It("should return with the first successful writer", func() {
+			fast := &writerStub{c: make([]byte, len(input))}
+			d, err := writer.NewDistributeWith(
+				writer.WithDistributeWriters(hung, bad, fast),
+				writer.WithDistributeQuorum(1),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			n, err := d.Write(input)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(len(input)))
+		})
+
+		It("should fail as soon as the quorum can not be reached", func() {
+			fast := &writerStub{c: make([]byte, len(input))}
+			d, err := writer.NewDistributeWith(
+				writer.WithDistributeWriters(hung, bad, fast),
+				writer.WithDistributeQuorum(3),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = d.Write(input)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("bad writer"))
+		})
+
+		It("should not accept a quorum more than the writers", func() {
+			_, err := writer.NewDistributeWith(
+				writer.WithDistributeWriters(hung),
+				writer.WithDistributeQuorum(2),
+			)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("errors", func() {
+		It("should name all failed writers with their byte counts", func() {
+			input := []byte("this is the message")
+			good := &writerStub{c: make([]byte, len(input))}
+			short := &writerStub{writeFunc: func([]byte) (int, error) {
+				return 4, errors.New("disk full")
+			}}
+			broken := &writerStub{writeFunc: func([]byte) (int, error) {
+				return 0, errors.New("connection refused")
+			}}
+			d, err := writer.NewDistributeWith(
+				writer.WithDistributeWriters(broken, good, short),
+				writer.WithDistributeName(broken, "elastic1"),
+				writer.WithDistributeName(short, "file1"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			n, err := d.Write(input)
+			Expect(n).To(Equal(len(input)))
+			Expect(err).To(BeAssignableToTypeOf(&writer.DistributeError{}))
+			errs := err.(*writer.DistributeError).Errors
+			Expect(errs).To(HaveLen(2))
+			Expect(errs[0].Name).To(Equal("elastic1"))
+			Expect(errs[0].N).To(Equal(0))
+			Expect(errs[0].Err).To(MatchError("connection refused"))
+			Expect(errs[1].Name).To(Equal("file1"))
+			Expect(errs[1].N).To(Equal(4))
+			Expect(errs[1].Err).To(MatchError("disk full"))
+			Expect(err.Error()).To(Equal("2 writer(s) failed: elastic1 (0 bytes written): connection refused; file1 (4 bytes written): disk full"))
+		})
+
+		It("should use the Name method of the writers", func() {
+			f, err := ioutil.TempFile("", "distribute")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(f.Name())
+			f.Close()
+			w, err := writer.NewFile(writer.WithLocation(f.Name()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.Close()).To(Succeed())
+
+			d := writer.NewDistribute(w)
+			_, err = d.Write([]byte("message"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*writer.DistributeError).Errors[0].Name).To(Equal(f.Name()))
+		})
+
+		It("should pass the failures to the failure function when the writers finish", func() {
+			gate := make(chan struct{})
+			slow := &writerStub{writeFunc: func([]byte) (int, error) {
+				<-gate
+				return 0, errors.New("gave up")
+			}}
+			good := &writerStub{c: make([]byte, 10)}
+			failures := make(chan string, 2)
+			d, err := writer.NewDistributeWith(
+				writer.WithDistributeWriters(slow, good),
+				writer.WithDistributeName(slow, "slow"),
+				writer.WithDistributeWriterTimeout(slow, 10*time.Millisecond),
+				writer.WithDistributeOnFailure(func(name string, err error) {
+					failures <- name + ": " + err.Error()
+				}),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = d.Write([]byte("message"))
+			Expect(err.Error()).To(ContainSubstring(writer.ErrTimeout.Error()))
+			Consistently(failures, 0.05).ShouldNot(Receive())
+
+			close(gate)
+			Eventually(failures).Should(Receive(Equal("slow: gave up")))
+			Consistently(failures, 0.05).ShouldNot(Receive())
+		})
+	})
+
+	Describe("flushing", func() {
+		It("should flush the writers that the queues wrap after writing", func() {
+			w := &flushStub{}
+			q, err := writer.NewQueue(w)
+			Expect(err).NotTo(HaveOccurred())
+			defer q.Close()
+			d, err := writer.NewDistributeWith(
+				writer.WithDistributeWriters(q),
+				writer.WithDistributeFlush(),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = d.Write([]byte("entry"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.Events()).To(Equal([]string{"write", "flush"}))
+
+			By("reporting the failed flushes")
+			w.SetFailing(true)
+			_, err = d.Write([]byte("entry"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("flushing: buffer stuck"))
+		})
+
+		It("should not flush without the option", func() {
+			w := &flushStub{}
+			_, err := writer.NewDistribute(w).Write([]byte("entry"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w.Events()).To(Equal([]string{"write"}))
+		})
+	})
 })
@@ -5,4 +5,11 @@
 // Package writer contains a series of writers that can write the log entries.
 // A File can write logs to a given file. It will collapse the object if a json
 // object is given, and uses them as the context of the log.
+//
+// Writers that send the entries to remote destinations, like Elasticsearch,
+// recover the entries from the lines with reader.ParseEntry and send them in
+// batches. Syslog sends each entry as soon as it is written.
+//
+// A Queue writes into a writer in a long-lived worker, and Distribute writes
+// into a series of writers concurrently.
 package writer
@@ -0,0 +1,249 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/arsham/logpipe/tools"
+	"github.com/pkg/errors"
+)
+
+// Elasticsearch sends the log entries to an elasticsearch cluster through the
+// bulk API. It collects the entries and sends them in batches, when the batch
+// is full or every flush delay. It implements io.WriteCloser interface.
+//
+// If the index name contains a date layout, for example logs-2006.01.02, the
+// part starting at 2006 is formatted with the entry's timestamp.
+type Elasticsearch struct {
+	batch
+	url     string
+	index   string
+	docType string
+	client  *http.Client
+}
+
+// BulkError is returned when elasticsearch rejects some of the items in a bulk
+// request.
+type BulkError struct {
+	Total  int
+	Failed []BulkItemError
+}
+
+// BulkItemError is the reason of a rejected item in a bulk request.
+type BulkItemError struct {
+	Index  string
+	Status int
+	Type   string
+	Reason string
+}
+
+func (b *BulkError) Error() string {
+	reasons := make([]string, len(b.Failed))
+	for i, f := range b.Failed {
+		reasons[i] = fmt.Sprintf("[%s] %d %s: %s", f.Index, f.Status, f.Type, f.Reason)
+	}
+	return fmt.Sprintf("%d of %d bulk items failed: %s",
+		len(b.Failed), b.Total, strings.Join(reasons, "; "))
+}
+
+type bulkAction struct {
+	Index bulkMeta `json:"index"`
+}
+
+type bulkMeta struct {
+	Index string `json:"_index"`
+	Type  string `json:"_type,omitempty"`
+}
+
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	Index  string `json:"_index"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// NewElasticsearch returns an error if the url is not provided. It starts a
+// goroutine to send the entries in intervals.
+func NewElasticsearch(conf ...func(*Elasticsearch) error) (*Elasticsearch, error) {
+	e := &Elasticsearch{index: "logs"}
+	for _, f := range conf {
+		if err := f(e); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.url == "" {
+		return nil, ErrNoURL
+	}
+
+	if e.client == nil {
+		e.client = &http.Client{Timeout: DefaultTimeout}
+	}
+
+	e.start(e.url, e.send)
+	return e, nil
+}
+
+// Name returns the url of the cluster.
+func (e *Elasticsearch) Name() string { return e.url }
+
+func (e *Elasticsearch) send(entries []*reader.Entry) error {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, entry := range entries {
+		action := bulkAction{bulkMeta{
+			Index: indexName(e.index, entry.Timestamp),
+			Type:  e.docType,
+		}}
+		if err := enc.Encode(action); err != nil {
+			return errors.Wrap(err, "encoding the action")
+		}
+		if err := enc.Encode(document(entry)); err != nil {
+			return errors.Wrap(err, "encoding the document")
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url+"/_bulk", buf)
+	if err != nil {
+		return errors.Wrap(err, "creating the request")
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	body, err := post(e.client, req)
+	if err != nil {
+		return errors.Wrap(err, "bulk request")
+	}
+
+	res := &bulkResponse{}
+	if err := json.Unmarshal(body, res); err != nil {
+		return errors.Wrap(err, "decoding the bulk response")
+	}
+	if !res.Errors {
+		return nil
+	}
+
+	bulkErr := &BulkError{Total: len(res.Items)}
+	for _, item := range res.Items {
+		for _, r := range item {
+			if r.Error == nil {
+				continue
+			}
+			bulkErr.Failed = append(bulkErr.Failed, BulkItemError{
+				Index:  r.Index,
+				Status: r.Status,
+				Type:   r.Error.Type,
+				Reason: r.Error.Reason,
+			})
+		}
+	}
+	return bulkErr
+}
+
+// indexName formats the part of the index starting at 2006 with t, as a date
+// layout.
+func indexName(index string, t time.Time) string {
+	i := strings.Index(index, "2006")
+	if i < 0 {
+		return index
+	}
+	return index[:i] + t.UTC().Format(index[i:])
+}
+
+// document returns the entry as an elasticsearch document. The fields of the
+// entry are collapsed into the document.
+func document(e *reader.Entry) map[string]interface{} {
+	doc := make(map[string]interface{}, len(e.Fields)+3)
+	for k, v := range e.Fields {
+		doc[k] = v
+	}
+	doc["@timestamp"] = e.Timestamp.Format(time.RFC3339Nano)
+	doc["level"] = e.Kind
+	doc["message"] = e.Message
+	return doc
+}
+
+// WithElasticsearchURL sets the url of the cluster. It returns an error if
+// the url is not valid.
+func WithElasticsearchURL(addr string) func(*Elasticsearch) error {
+	return func(e *Elasticsearch) error {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return errors.Wrap(err, "parsing the url")
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return errors.Wrap(ErrNoURL, addr)
+		}
+		e.url = strings.TrimRight(addr, "/")
+		return nil
+	}
+}
+
+// WithElasticsearchIndex sets the index name. Default is "logs".
+func WithElasticsearchIndex(index string) func(*Elasticsearch) error {
+	return func(e *Elasticsearch) error {
+		if index == "" {
+			return errors.New("empty index name")
+		}
+		e.index = index
+		return nil
+	}
+}
+
+// WithElasticsearchDocType sets the document type. It is only required for
+// elasticsearch versions prior to 7.
+func WithElasticsearchDocType(docType string) func(*Elasticsearch) error {
+	return func(e *Elasticsearch) error {
+		e.docType = docType
+		return nil
+	}
+}
+
+// WithElasticsearchBatch sets the batch size and the delay between sends.
+func WithElasticsearchBatch(size int, delay time.Duration) func(*Elasticsearch) error {
+	return func(e *Elasticsearch) error {
+		return e.setBatch(size, delay)
+	}
+}
+
+// WithElasticsearchRetry sets the number of the attempts of each bulk request,
+// including the first one, the delay after the first attempt, and the maximum
+// delay between the attempts.
+func WithElasticsearchRetry(attempts int, backoff, max time.Duration) func(*Elasticsearch) error {
+	return func(e *Elasticsearch) error {
+		return e.setRetry(attempts, backoff, max)
+	}
+}
+
+// WithElasticsearchClient sets the http client for sending the requests.
+func WithElasticsearchClient(client *http.Client) func(*Elasticsearch) error {
+	return func(e *Elasticsearch) error {
+		e.client = client
+		return nil
+	}
+}
+
+// WithElasticsearchLogger sets the logger for reporting errors occurred while
+// sending the entries in the background.
+func WithElasticsearchLogger(logger tools.FieldLogger) func(*Elasticsearch) error {
+	return func(e *Elasticsearch) error {
+		e.logger = logger
+		return nil
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// bulkStub records the bulk requests and responds with the response.
+type bulkStub struct {
+	sync.Mutex
+	lines    []map[string]interface{}
+	requests int
+	response string
+}
+
+func (b *bulkStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.Lock()
+	defer b.Unlock()
+	b.requests++
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		line := make(map[string]interface{})
+		json.Unmarshal(scanner.Bytes(), &line)
+		b.lines = append(b.lines, line)
+	}
+	if b.response == "" {
+		b.response = `{"errors":false,"items":[]}`
+	}
+	fmt.Fprint(w, b.response)
+}
+
+func (b *bulkStub) Lines() []map[string]interface{} {
+	b.Lock()
+	defer b.Unlock()
+	return b.lines
+}
+
+func (b *bulkStub) Requests() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.requests
+}
+
+var _ = Describe("Elasticsearch", func() {
+	var (
+		stub *bulkStub
+		ts   *httptest.Server
+		line = []byte(`time="2017-01-14T19:10:10Z" level=error msg="something happened" app=billing` + "\n")
+	)
+
+	BeforeEach(func() {
+		stub = &bulkStub{}
+		ts = httptest.NewServer(stub)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	Context("creating without a url", func() {
+		It("should error", func() {
+			e, err := writer.NewElasticsearch()
+			Expect(err).To(Equal(writer.ErrNoURL))
+			Expect(e).To(BeNil())
+		})
+	})
+
+	Context("when the batch is full", func() {
+		var e *writer.Elasticsearch
+
+		BeforeEach(func() {
+			var err error
+			e, err = writer.NewElasticsearch(
+				writer.WithElasticsearchURL(ts.URL),
+				writer.WithElasticsearchIndex("logs-2006.01.02"),
+				writer.WithElasticsearchBatch(2, time.Hour),
+			)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			e.Close()
+		})
+
+		It("should send the entries in one bulk request", func() {
+			n, err := e.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(len(line)))
+			Expect(stub.Requests()).To(BeZero())
+
+			_, err = e.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stub.Requests()).To(Equal(1))
+			Expect(stub.Lines()).To(HaveLen(4))
+		})
+
+		It("should use the date suffixed index", func() {
+			e.Write(line)
+			e.Write(line)
+			action := stub.Lines()[0]["index"].(map[string]interface{})
+			Expect(action["_index"]).To(Equal("logs-2017.01.14"))
+		})
+
+		It("should collapse the entry into the document", func() {
+			e.Write(line)
+			e.Write(line)
+			doc := stub.Lines()[1]
+			Expect(doc).To(HaveKeyWithValue("message", "something happened"))
+			Expect(doc).To(HaveKeyWithValue("level", "error"))
+			Expect(doc).To(HaveKeyWithValue("app", "billing"))
+			Expect(doc).To(HaveKeyWithValue("@timestamp", "2017-01-14T19:10:10Z"))
+		})
+	})
+
+	Context("when the delay passes", func() {
+		It("should send the entries", func() {
+			e, err := writer.NewElasticsearch(
+				writer.WithElasticsearchURL(ts.URL),
+				writer.WithElasticsearchBatch(100, writer.MinimumDelay),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer e.Close()
+
+			e.Write(line)
+			Eventually(stub.Requests).Should(Equal(1))
+		})
+	})
+
+	Context("when elasticsearch rejects some of the items", func() {
+		It("should report the failed items", func() {
+			stub.response = `{"errors":true,"items":[
+				{"index":{"_index":"logs","status":201}},
+				{"index":{"_index":"logs","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}
+			]}`
+			e, err := writer.NewElasticsearch(
+				writer.WithElasticsearchURL(ts.URL),
+				writer.WithElasticsearchBatch(2, time.Hour),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			e.Write(line)
+			_, err = e.Write(line)
+			Expect(err).To(BeAssignableToTypeOf(&writer.BulkError{}))
+			bulkErr := err.(*writer.BulkError)
+			Expect(bulkErr.Total).To(Equal(2))
+			Expect(bulkErr.Failed).To(HaveLen(1))
+			Expect(bulkErr.Failed[0].Status).To(Equal(http.StatusBadRequest))
+			Expect(bulkErr.Error()).To(ContainSubstring("failed to parse"))
+		})
+	})
+
+	Context("when closing", func() {
+		It("should send the remaining entries", func() {
+			e, err := writer.NewElasticsearch(
+				writer.WithElasticsearchURL(ts.URL),
+				writer.WithElasticsearchBatch(100, time.Hour),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			e.Write(line)
+			Expect(e.Close()).NotTo(HaveOccurred())
+			Expect(stub.Requests()).To(Equal(1))
+
+			_, err = e.Write(line)
+			Expect(err).To(Equal(writer.ErrClosed))
+		})
+	})
+
+	Context("when the server errors", func() {
+		It("should return a StatusError", func() {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer ts.Close()
+
+			e, err := writer.NewElasticsearch(
+				writer.WithElasticsearchURL(ts.URL),
+				writer.WithElasticsearchBatch(1, time.Hour),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = e.Write(line)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("500"))
+		})
+	})
+
+	Describe("batch failures", func() {
+		var (
+			ts       *httptest.Server
+			gate     chan struct{}
+			mu       sync.Mutex
+			failed   []string
+			payloads []string
+			failure  = func(p, payload []byte, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				failed = append(failed, string(p))
+				payloads = append(payloads, string(payload))
+			}
+			failures = func() []string {
+				mu.Lock()
+				defer mu.Unlock()
+				return append([]string(nil), failed...)
+			}
+		)
+
+		BeforeEach(func() {
+			failed, payloads = nil, nil
+			gate = make(chan struct{})
+			ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ioutil.ReadAll(r.Body)
+				<-gate
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+		})
+
+		AfterEach(func() {
+			ts.Close()
+		})
+
+		It("should pass the other entries of the failed batch to the failure callback", func() {
+			close(gate)
+			e, err := writer.NewElasticsearch(
+				writer.WithElasticsearchURL(ts.URL),
+				writer.WithElasticsearchBatch(2, time.Hour),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			e.OnFailure(failure)
+
+			first := []byte(`time="2017-01-14T19:10:10Z" level=info msg=first` + "\n")
+			_, err = e.Write(first)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = e.Write(line)
+			Expect(err).To(HaveOccurred())
+			Expect(failures()).To(Equal([]string{string(first)}))
+		})
+
+		It("should pass the entries of the failed interval sends to the failure callback", func() {
+			close(gate)
+			e, err := writer.NewElasticsearch(
+				writer.WithElasticsearchURL(ts.URL),
+				writer.WithElasticsearchBatch(10, writer.MinimumDelay),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer e.Close()
+			e.OnFailure(failure)
+
+			_, err = e.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(failures).Should(Equal([]string{string(line)}))
+		})
+
+		It("should pass the payload of the entries to the failure callback", func() {
+			close(gate)
+			e, err := writer.NewElasticsearch(
+				writer.WithElasticsearchURL(ts.URL),
+				writer.WithElasticsearchBatch(10, time.Hour),
+				writer.WithElasticsearchRetry(1, time.Millisecond, time.Millisecond),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			e.OnFailure(failure)
+			payload := `{"message":"something bad happened"}`
+			d, err := writer.NewDistributeWith(
+				writer.WithDistributeWriters(e),
+				writer.WithDistributePayload([]byte(payload)),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = d.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(e.Flush()).To(HaveOccurred())
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(payloads).To(Equal([]string{payload}))
+		})
+
+		It("should add the entries while a batch is being sent", func() {
+			e, err := writer.NewElasticsearch(
+				writer.WithElasticsearchURL(ts.URL),
+				writer.WithElasticsearchBatch(2, time.Hour),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			e.OnFailure(failure)
+			_, err = e.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+
+			sent := make(chan error)
+			go func() {
+				_, err := e.Write(line)
+				sent <- err
+			}()
+			Consistently(sent, 0.05).ShouldNot(Receive())
+
+			By("not waiting for the send")
+			done := make(chan error)
+			go func() {
+				_, err := e.Write(line)
+				done <- err
+			}()
+			Eventually(done).Should(Receive(BeNil()))
+
+			close(gate)
+			Eventually(sent).Should(Receive(HaveOccurred()))
+			Expect(failures()).To(HaveLen(1))
+		})
+	})
+})
@@ -0,0 +1,88 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned by the writers.
+// ErrClosed is returned when writing to a writer that is already closed.
+var (
+	ErrClosed      = errors.New("writer closed")
+	ErrNoURL       = errors.New("no url specified")
+	ErrBatchSize   = errors.New("batch size should be more than zero")
+	ErrNoDatabase  = errors.New("no database specified")
+	ErrNoBucket    = errors.New("no org or bucket specified")
+	ErrNoAddress   = errors.New("no address specified")
+	ErrNoToken     = errors.New("no token specified")
+	ErrNoPath      = errors.New("no path specified")
+	ErrTimeout     = errors.New("write timed out")
+	ErrQueueFull   = errors.New("queue is full")
+	ErrDropped     = errors.New("dropped from the full queue")
+	ErrStopped     = errors.New("dropped from the stopped queue")
+	ErrWALFull     = errors.New("wal has reached its max size")
+	ErrBreakerOpen = errors.New("circuit breaker is open")
+)
+
+// StatusError is returned when a remote destination responds with a non 2xx
+// status code.
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (s *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d: %s", s.Code, s.Body)
+}
+
+// WriterError is the failure of one of the writers of a Distribute.
+type WriterError struct {
+	// Name is the name of the writer.
+	Name string
+
+	// N is the number of bytes the writer has written.
+	N int
+
+	// Err is the error the writer has returned.
+	Err error
+}
+
+func (w *WriterError) Error() string {
+	return fmt.Sprintf("%s (%d bytes written): %s", w.Name, w.N, w.Err)
+}
+
+// Cause returns the error of the writer.
+func (w *WriterError) Cause() error { return w.Err }
+
+// DistributeError is returned when some writers of a Distribute fail. The
+// errors are in the order of the writers.
+type DistributeError struct {
+	Errors []*WriterError
+}
+
+func (d *DistributeError) Error() string {
+	msgs := make([]string, len(d.Errors))
+	for i, e := range d.Errors {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("%d writer(s) failed: %s", len(d.Errors), strings.Join(msgs, "; "))
+}
+
+// RetryError is returned when a writer fails after all attempts.
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (r *RetryError) Error() string {
+	return fmt.Sprintf("after %d attempt(s): %s", r.Attempts, r.Err)
+}
+
+// Cause returns the error of the last attempt.
+func (r *RetryError) Cause() error { return r.Err }
@@ -9,37 +9,94 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/arsham/logpipe/tools"
 	"github.com/pkg/errors"
 )
 
 // MinimumDelay is the minimum time set for flush delays.
 var MinimumDelay = 10 * time.Millisecond
 
+// DefaultFileMode is the permissions of the files that are created.
+const DefaultFileMode os.FileMode = 0644
+
 type writeCloseNamer interface {
 	io.WriteCloser
 	Name() string
 }
 
+// syncer is implemented by the files that can be synced to the disk.
+type syncer interface {
+	Sync() error
+}
+
 // File writs records log entries to a file. It buffers the writes to obtain
 // better performance. It flushes the buffer every 1 seconds. It implements
 // io.WriteCloser interface.
+//
+// If a maximum size is set, the file is rotated when the next entry would
+// make it bigger than the maximum size. The rotated files are renamed with a
+// numeric suffix, the most recent one being location.1. (see WithMaxSize)
+//
+// The location can be a strftime pattern, for example /var/log/%Y-%m-%d.log,
+// in which case the File switches to a new file when the expanded location
+// changes. (see WithTimeSource)
+//
+// Flushing the buffer leaves the data in the page cache of the operating
+// system. To make it durable, the file can be synced to the disk on each
+// flush or in intervals. (see WithSync)
 type File struct {
 	file   writeCloseNamer
 	closed uint32
 	delay  time.Duration // delay between flushes
 	sync.Mutex
 	buf *bufio.Writer
+
+	location   string
+	pattern    string // strftime pattern of the location
+	timeSource TimeSource
+	size       int64 // current size of the file, including the buffer
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+
+	mode       os.FileMode // of the new files
+	uid, gid   int         // owner of the new files, -1 keeps the default
+	createDirs bool        // creates the parent directories of the location
+
+	syncMode     SyncMode
+	syncInterval time.Duration
+	lastSync     time.Time
+	maxUnflushed int64 // bytes written before the buffer is flushed early
+	unflushed    int64
+
+	compress string        // compression method of the rotated files
+	compMu   sync.Mutex    // held while the backups are being moved
+	compSig  chan struct{} // signals the compressor to look for files
+	logger   tools.FieldLogger
+
+	quit chan struct{}  // stops the goroutines on close
+	wg   sync.WaitGroup // waits for the goroutines on close
 }
 
-// NewFile returns error if the file can not be created. It starts a goroutine
-// to flush the logs in intervals.
+// NewFile returns error if the file can not be created, or it is not
+// writable. If the file is rotated or its location is a pattern, the directory
+// should be writable too. With EntryTime, the file is opened on the first
+// write, when the time of the entries is known. It starts a goroutine to flush
+// the logs in intervals.
 func NewFile(conf ...func(*File) error) (*File, error) {
-	fl := &File{}
+	fl := &File{
+		mode: DefaultFileMode,
+		uid:  -1,
+		gid:  -1,
+	}
 
 	for _, f := range conf {
 		if err := f(fl); err != nil {
@@ -47,27 +104,86 @@ func NewFile(conf ...func(*File) error) (*File, error) {
 		}
 	}
 
+	if fl.file == nil && fl.pattern != "" && fl.timeSource == EntryTime {
+		if fl.createDirs {
+			if err := os.MkdirAll(filepath.Dir(fl.location), 0755); err != nil {
+				return nil, errors.Wrap(err, "creating the directories")
+			}
+		}
+		if err := checkDir(filepath.Dir(fl.location)); err != nil {
+			return nil, err
+		}
+		fl.buf = bufio.NewWriter(nil)
+	} else if fl.file == nil && fl.location != "" {
+		file, err := fl.open(fl.location)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening file")
+		}
+		if fl.maxSize > 0 || fl.pattern != "" {
+			if err := checkDir(filepath.Dir(fl.location)); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		if info, err := file.Stat(); err == nil {
+			fl.size = info.Size()
+		}
+		WithWriter(file)(fl)
+	}
+
 	if fl.delay == 0 {
 		WithFlushDelay(time.Second)(fl)
 	}
 
+	if fl.logger == nil {
+		fl.logger = tools.StandardLogger()
+	}
+
+	fl.quit = make(chan struct{})
+	fl.wg.Add(1)
 	go fl.sync()
 
+	if fl.compress != "" {
+		fl.compSig = make(chan struct{}, 1)
+		fl.wg.Add(1)
+		go fl.compressor()
+		fl.signalCompress() // compressing the leftovers of previous runs
+	}
+
 	return fl, nil
 }
 
-// Close closes the File.
+// Close flushes the buffer and closes the File. It stops the flushing and
+// compressing goroutines, and waits for the file that is being compressed. It
+// returns ErrClosed if the File is already closed.
 func (f *File) Close() error {
-	if err := f.Flush(); err != nil {
+	f.Lock()
+	if atomic.LoadUint32(&f.closed) > 0 {
+		f.Unlock()
+		return ErrClosed
+	}
+	if err := f.release(); err != nil {
+		f.Unlock()
 		return errors.Wrap(err, "flushing on close")
 	}
 
 	atomic.StoreUint32(&f.closed, uint32(1))
-	return f.file.Close()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+	}
+	f.Unlock()
+
+	close(f.quit)
+	f.wg.Wait()
+	return err
 }
 
 // Name returns the file location on disk.
 func (f *File) Name() string {
+	if f.file == nil {
+		return f.location
+	}
 	return f.file.Name()
 }
 
@@ -78,54 +194,219 @@ func (f *File) Write(p []byte) (int, error) {
 	defer f.Unlock()
 
 	if atomic.LoadUint32(&f.closed) > 0 {
-		return 0, errors.New("file closed")
+		return 0, ErrClosed
+	}
+
+	if f.pattern != "" && f.timeSource == EntryTime {
+		if err := f.switchTo(expand(f.pattern, entryTime(p))); err != nil {
+			return 0, errors.Wrap(err, "switching the file")
+		}
+	}
+
+	if f.shouldRotate(int64(len(p) + 1)) {
+		if err := f.rotate(); err != nil {
+			return 0, errors.Wrap(err, "rotating the file")
+		}
 	}
 
 	n, err := f.buf.Write(p)
+	f.size += int64(n)
 	if err != nil {
 		return n, errors.Wrap(err, "writing the bytes")
 	}
 
+	f.unflushed += int64(n)
+
 	if !bytes.HasSuffix(p, []byte("\n")) {
 		err = f.buf.WriteByte('\n') // required for creating a new line
+		f.size++
+		f.unflushed++
 	}
 
 	if err != nil {
 		return 0, errors.Wrap(err, "writing new line")
 	}
+
+	if f.maxUnflushed > 0 && f.unflushed >= f.maxUnflushed {
+		if err := f.flush(); err != nil {
+			return n, errors.Wrap(err, "flushing the buffer")
+		}
+	}
 	return n, nil
 }
 
-// Flush flushes the underlying buffer.
+// Reopen flushes the buffer, opens the same location again and closes the
+// previous file. It is useful when the file is moved by an external program,
+// for example logrotate. The previous file is kept open if the location can
+// not be opened. It returns an error if the File was not created with a
+// location, and ErrClosed if the File is already closed.
+func (f *File) Reopen() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if atomic.LoadUint32(&f.closed) > 0 {
+		return ErrClosed
+	}
+	if f.location == "" {
+		return errors.New("no location to reopen")
+	}
+	if f.file == nil {
+		// it is opened on the next write.
+		return nil
+	}
+	if err := f.release(); err != nil {
+		return errors.Wrap(err, "flushing the buffer")
+	}
+
+	file, err := f.open(f.location)
+	if err != nil {
+		return errors.Wrap(err, "opening file")
+	}
+	old := f.file
+	f.file = file
+	f.buf.Reset(file)
+	f.size = 0
+	if info, err := file.Stat(); err == nil {
+		f.size = info.Size()
+	}
+	return errors.Wrap(old.Close(), "closing the file")
+}
+
+// Flush flushes the underlying buffer. With SyncAlways the file is also
+// synced to the disk.
 func (f *File) Flush() error {
 	f.Lock()
 	defer f.Unlock()
-	return f.buf.Flush()
+	return f.flush()
+}
+
+// flush flushes the buffer into the file, and syncs the file with SyncAlways.
+// It should be called while the lock is held.
+func (f *File) flush() error {
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	f.unflushed = 0
+	if f.syncMode == SyncAlways {
+		return f.fsync()
+	}
+	return nil
+}
+
+// release flushes the buffer and syncs the file, unless the mode is
+// SyncNever, before the file is closed. It should be called while the lock is
+// held.
+func (f *File) release() error {
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	f.unflushed = 0
+	if f.syncMode != SyncNever {
+		return f.fsync()
+	}
+	return nil
 }
 
-// flusher flushes the logs onto the file in intervals.
+// fsync syncs the file to the disk, if the file supports it. It should be
+// called while the lock is held.
+func (f *File) fsync() error {
+	f.lastSync = time.Now()
+	if s, ok := f.file.(syncer); ok {
+		return errors.Wrap(s.Sync(), "syncing the file")
+	}
+	return nil
+}
+
+// sync flushes the logs onto the file in intervals, until the File is closed.
+// If the location is a pattern and the wall clock is used, it switches the
+// file in the same loop. With SyncInterval, the file is synced when the sync
+// interval has passed since the last sync.
 func (f *File) sync() {
+	defer f.wg.Done()
 	for {
-		<-time.After(f.delay)
-		f.Flush()
+		select {
+		case <-time.After(f.delay):
+		case <-f.quit:
+			return
+		}
+		f.Lock()
+		if atomic.LoadUint32(&f.closed) > 0 {
+			f.Unlock()
+			continue
+		}
+		if f.pattern != "" && f.timeSource == ClockTime {
+			if err := f.switchTo(expand(f.pattern, time.Now())); err != nil {
+				f.logger.Errorf("%s: %s", f.Name(), errors.Wrap(err, "switching the file"))
+			}
+		}
+		f.flush()
+		if f.syncMode == SyncInterval && time.Since(f.lastSync) >= f.syncInterval {
+			if err := f.fsync(); err != nil {
+				f.logger.Errorf("%s: %s", f.Name(), err)
+			}
+		}
+		f.Unlock()
 	}
 }
 
-// WithLocation opens a new file at location, or creates one if not exists. It
-// returns error if it could not create or have write permission to the file.
+// WithLocation sets the location of the file, which is opened by NewFile, or
+// created if not exists. If the location contains strftime directives, it is
+// expanded with the current time.
 func WithLocation(location string) func(*File) error {
 	return func(f *File) error {
-		var (
-			file *os.File
-			err  error
-		)
-		if file, err = os.OpenFile(location, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
-			if os.IsPermission(err) {
-				return errors.Wrap(err, "opening file")
-			}
+		f.pattern = ""
+		if strings.Contains(location, "%") {
+			f.pattern = location
+			location = expand(location, time.Now())
+		}
+		f.location = location
+		f.file = nil
+		return nil
+	}
+}
+
+// open opens the file at location for appending, or creates one with the mode
+// and the owner of the File if not exists. The parent directories are created
+// if the File is set to create them. It should be called while the lock is
+// held, or before the File is returned.
+func (f *File) open(location string) (*os.File, error) {
+	if f.createDirs {
+		if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+			return nil, errors.Wrap(err, "creating the directories")
+		}
+	}
+	_, err := os.Stat(location)
+	created := os.IsNotExist(err)
+
+	file, err := os.OpenFile(location, os.O_APPEND|os.O_CREATE|os.O_WRONLY, f.mode)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return file, nil
+	}
+	// the mode of a new file is masked by the umask.
+	if err := file.Chmod(f.mode); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "setting the mode")
+	}
+	if f.uid != -1 || f.gid != -1 {
+		if err := file.Chown(f.uid, f.gid); err != nil {
+			file.Close()
+			return nil, errors.Wrap(err, "setting the owner")
 		}
-		return WithWriter(file)(f)
 	}
+	return file, nil
+}
+
+// checkDir returns an error if a file can not be created in dir.
+func checkDir(dir string) error {
+	tmp, err := ioutil.TempFile(dir, ".logpipe")
+	if err != nil {
+		return errors.Wrap(err, "directory is not writable")
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
 }
 
 // WithWriter sets the output as the given writer. It wraps it in a buffer for
@@ -146,6 +427,42 @@ func WithBufWriter(w *bufio.Writer) func(*File) error {
 	}
 }
 
+// WithFileMode sets the permissions of the files that are created. Existing
+// files keep their permissions. Default is DefaultFileMode.
+func WithFileMode(mode os.FileMode) func(*File) error {
+	return func(f *File) error {
+		if mode&^os.ModePerm != 0 {
+			return fmt.Errorf("invalid (%s) file mode", mode)
+		}
+		f.mode = mode
+		return nil
+	}
+}
+
+// WithOwner sets the user and group ids of the files that are created. -1
+// keeps the default of the operating system. Changing the owner usually needs
+// privileges.
+func WithOwner(uid, gid int) func(*File) error {
+	return func(f *File) error {
+		if uid < -1 || gid < -1 {
+			return fmt.Errorf("invalid (%d:%d) owner", uid, gid)
+		}
+		f.uid = uid
+		f.gid = gid
+		return nil
+	}
+}
+
+// WithCreateDirs creates the parent directories of the location when the
+// file is opened, for example when a location pattern expands into a new
+// directory.
+func WithCreateDirs() func(*File) error {
+	return func(f *File) error {
+		f.createDirs = true
+		return nil
+	}
+}
+
 // WithFlushDelay sets the delay time between flushes.
 func WithFlushDelay(delay time.Duration) func(*File) error {
 	return func(f *File) error {
@@ -156,3 +473,102 @@ func WithFlushDelay(delay time.Duration) func(*File) error {
 		return nil
 	}
 }
+
+// WithSync sets when the file is synced to the disk. With SyncAlways the file
+// is synced on each flush, and with SyncInterval it is synced when the
+// interval has passed, which is checked on each flush. The file is also
+// synced before it is closed, rotated or switched, unless the mode is
+// SyncNever. Default is SyncNever.
+func WithSync(mode SyncMode, interval time.Duration) func(*File) error {
+	return func(f *File) error {
+		if mode == SyncInterval && interval <= 0 {
+			return fmt.Errorf("low (%s) sync interval", interval)
+		}
+		f.syncMode = mode
+		f.syncInterval = interval
+		return nil
+	}
+}
+
+// WithMaxUnflushed sets the number of bytes that can be written before the
+// buffer is flushed, without waiting for the flush delay. Zero means the
+// buffer is only flushed in intervals, or when it is full.
+func WithMaxUnflushed(n int64) func(*File) error {
+	return func(f *File) error {
+		if n < 0 {
+			return fmt.Errorf("invalid (%d) max unflushed bytes", n)
+		}
+		f.maxUnflushed = n
+		return nil
+	}
+}
+
+// WithMaxSize sets the maximum size of the file in bytes, before it is
+// rotated. It only applies to files opened with WithLocation.
+func WithMaxSize(size int64) func(*File) error {
+	return func(f *File) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid (%d) max size", size)
+		}
+		f.maxSize = size
+		return nil
+	}
+}
+
+// WithMaxBackups sets the maximum number of rotated files to keep. Zero means
+// all files are kept.
+func WithMaxBackups(n int) func(*File) error {
+	return func(f *File) error {
+		if n < 0 {
+			return fmt.Errorf("invalid (%d) max backups", n)
+		}
+		f.maxBackups = n
+		return nil
+	}
+}
+
+// WithMaxAge sets the maximum time to keep the rotated files, based on their
+// modification time. Zero means the files are kept regardless of their age.
+func WithMaxAge(age time.Duration) func(*File) error {
+	return func(f *File) error {
+		if age < 0 {
+			return fmt.Errorf("invalid (%d) max age", age)
+		}
+		f.maxAge = age
+		return nil
+	}
+}
+
+// WithTimeSource sets the time used for expanding the location pattern. With
+// ClockTime the file is switched in the flush loop, and with EntryTime it is
+// switched when an entry with a timestamp in a new period is written. With
+// EntryTime no file is opened until the first entry is written.
+func WithTimeSource(source TimeSource) func(*File) error {
+	return func(f *File) error {
+		if source != ClockTime && source != EntryTime {
+			return fmt.Errorf("invalid (%d) time source", source)
+		}
+		f.timeSource = source
+		return nil
+	}
+}
+
+// WithCompress sets the compression method for the rotated files. The files
+// are compressed in the background, and only "gzip" is supported.
+func WithCompress(method string) func(*File) error {
+	return func(f *File) error {
+		if method != "gzip" {
+			return fmt.Errorf("unsupported (%s) compression", method)
+		}
+		f.compress = method
+		return nil
+	}
+}
+
+// WithLogger sets the logger for reporting errors occurred in the background.
+func WithLogger(logger tools.FieldLogger) func(*File) error {
+	return func(f *File) error {
+		f.logger = logger
+		return nil
+	}
+}
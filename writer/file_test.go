@@ -10,7 +10,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -80,7 +82,7 @@ var _ = Describe("File", func() {
 
 				Context("obtaining a File in a non existence place", func() {
 					BeforeEach(func() {
-						filename = "/does not exist"
+						filename = path.Join(os.TempDir(), "does not exist", "file")
 					})
 					It("should error", func() {
 						Expect(err).To(HaveOccurred())
@@ -90,6 +92,9 @@ var _ = Describe("File", func() {
 
 				Context("obtaining a File in a non-writeable place", func() {
 					BeforeEach(func() {
+						if os.Geteuid() == 0 {
+							Skip("root can write anywhere")
+						}
 						filename = path.Join("/", "testfile")
 					})
 					It("should error", func() {
@@ -100,6 +105,9 @@ var _ = Describe("File", func() {
 
 				Context("obtaining a File with a non-writeable file", func() {
 					BeforeEach(func() {
+						if os.Geteuid() == 0 {
+							Skip("root can write into any file")
+						}
 						err := f.Chmod(0000)
 						Expect(err).NotTo(HaveOccurred())
 					})
@@ -380,3 +388,265 @@ func TestSync(t *testing.T) {
 		t.Errorf("want (%s) in contents, got (%s)", message, content)
 	}
 }
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	w, teardown := setup(t)
+	defer teardown()
+
+	before := runtime.NumGoroutine()
+	file, err := writer.NewFile(
+		writer.WithWriter(w),
+		writer.WithFlushDelay(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("this is the message")); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(w.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "this is the message") {
+		t.Errorf("want the message to be flushed, got (%s)", content)
+	}
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("want (%d) goroutines, got (%d)", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := file.Close(); err != writer.ErrClosed {
+		t.Errorf("want (%s), got (%v)", writer.ErrClosed, err)
+	}
+}
+
+// syncCounter counts the syncs of the file.
+type syncCounter struct {
+	*os.File
+	sync.Mutex
+	syncs int
+}
+
+func (s *syncCounter) Sync() error {
+	s.Lock()
+	defer s.Unlock()
+	s.syncs++
+	return s.File.Sync()
+}
+
+func (s *syncCounter) Syncs() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.syncs
+}
+
+func TestSyncModes(t *testing.T) {
+	tcs := []struct {
+		name  string
+		mode  writer.SyncMode
+		syncs int // after one Flush and Close
+	}{
+		{"never", writer.SyncNever, 0},
+		{"interval", writer.SyncInterval, 1},
+		{"always", writer.SyncAlways, 2},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			w, teardown := setup(t)
+			defer teardown()
+			s := &syncCounter{File: w}
+
+			file, err := writer.NewFile(
+				writer.WithWriter(s),
+				writer.WithFlushDelay(time.Hour),
+				writer.WithSync(tc.mode, time.Hour),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := file.Write([]byte("this is the message")); err != nil {
+				t.Fatal(err)
+			}
+			if err := file.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if s.Syncs() != tc.syncs {
+				t.Errorf("want (%d) syncs, got (%d)", tc.syncs, s.Syncs())
+			}
+		})
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	w, teardown := setup(t)
+	defer teardown()
+	s := &syncCounter{File: w}
+
+	file, err := writer.NewFile(
+		writer.WithWriter(s),
+		writer.WithFlushDelay(writer.MinimumDelay),
+		writer.WithSync(writer.SyncInterval, writer.MinimumDelay),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write([]byte("this is the message")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; s.Syncs() == 0; i++ {
+		if i == 100 {
+			t.Fatal("want the file to be synced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := writer.WithSync(writer.SyncInterval, 0)(&writer.File{}); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestMaxUnflushed(t *testing.T) {
+	w, teardown := setup(t)
+	defer teardown()
+
+	file, err := writer.NewFile(
+		writer.WithWriter(w),
+		writer.WithFlushDelay(time.Hour),
+		writer.WithMaxUnflushed(25),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	read := func() string {
+		content, err := ioutil.ReadFile(w.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	if _, err := file.Write([]byte("first message")); err != nil {
+		t.Fatal(err)
+	}
+	if content := read(); content != "" {
+		t.Errorf("want no contents, got (%s)", content)
+	}
+	if _, err := file.Write([]byte("second message")); err != nil {
+		t.Fatal(err)
+	}
+	if content := read(); content != "first message\nsecond message\n" {
+		t.Errorf("want both messages, got (%s)", content)
+	}
+
+	if err := writer.WithMaxUnflushed(-1)(&writer.File{}); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestNewFileOpenErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_file_open")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	location := path.Join(dir, "missing", "logs.log")
+	file, err := writer.NewFile(writer.WithLocation(location))
+	if err == nil {
+		t.Error("want error, got nil")
+	}
+	if file != nil {
+		t.Errorf("want nil file, got (%v)", file)
+	}
+
+	file, err = writer.NewFile(writer.WithLocation(location), writer.WithCreateDirs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can write into the read-only directories")
+	}
+
+	// rotation needs a writable directory
+	readOnly := path.Join(dir, "read_only")
+	if err := os.Mkdir(readOnly, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(readOnly, "logs.log"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(readOnly, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(readOnly, 0755)
+	file, err = writer.NewFile(writer.WithLocation(path.Join(readOnly, "logs.log")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	_, err = writer.NewFile(
+		writer.WithLocation(path.Join(readOnly, "logs.log")),
+		writer.WithMaxSize(1024),
+	)
+	if err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_file_mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	location := path.Join(dir, "logs.log")
+	file, err := writer.NewFile(
+		writer.WithLocation(location),
+		writer.WithFileMode(0660),
+		writer.WithOwner(os.Getuid(), -1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	info, err := os.Stat(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("want (%s), got (%s)", os.FileMode(0660), info.Mode().Perm())
+	}
+
+	// existing files keep their mode
+	file, err = writer.NewFile(writer.WithLocation(location), writer.WithFileMode(0600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if info, _ = os.Stat(location); info.Mode().Perm() != 0660 {
+		t.Errorf("want (%s), got (%s)", os.FileMode(0660), info.Mode().Perm())
+	}
+
+	if err := writer.WithFileMode(os.ModeDir | 0755)(&writer.File{}); err == nil {
+		t.Error("want error, got nil")
+	}
+	if err := writer.WithOwner(-2, 0)(&writer.File{}); err == nil {
+		t.Error("want error, got nil")
+	}
+}
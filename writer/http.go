@@ -0,0 +1,192 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/arsham/logpipe/tools"
+	"github.com/pkg/errors"
+)
+
+// HTTP forwards the log entries to another logpipe instance. The entries are
+// encoded as the JSON payload the handler accepts, and each batch is sent as
+// an array of the payloads. Failed requests are retried if the server responds
+// with a 5xx status code or is not reachable. It implements io.WriteCloser
+// interface.
+type HTTP struct {
+	batch
+	url      string
+	headers  http.Header
+	compress bool
+	client   *http.Client
+}
+
+// NewHTTP returns an error if the url is not provided. It starts a goroutine
+// to send the entries in intervals.
+func NewHTTP(conf ...func(*HTTP) error) (*HTTP, error) {
+	h := &HTTP{
+		headers: make(http.Header),
+	}
+	for _, f := range conf {
+		if err := f(h); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.url == "" {
+		return nil, ErrNoURL
+	}
+
+	if h.client == nil {
+		h.client = &http.Client{Timeout: DefaultTimeout}
+	}
+
+	h.start(h.url, h.send)
+	return h, nil
+}
+
+// Name returns the url of the server.
+func (h *HTTP) Name() string { return h.url }
+
+func (h *HTTP) send(entries []*reader.Entry) error {
+	payloads := make([]map[string]interface{}, len(entries))
+	for i, e := range entries {
+		payloads[i] = payload(e)
+	}
+
+	buf := new(bytes.Buffer)
+	if h.compress {
+		gz := gzip.NewWriter(buf)
+		if err := json.NewEncoder(gz).Encode(payloads); err != nil {
+			return errors.Wrap(err, "encoding the payload")
+		}
+		if err := gz.Close(); err != nil {
+			return errors.Wrap(err, "compressing the payload")
+		}
+	} else if err := json.NewEncoder(buf).Encode(payloads); err != nil {
+		return errors.Wrap(err, "encoding the payload")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.url, buf)
+	if err != nil {
+		return errors.Wrap(err, "creating the request")
+	}
+	for key, values := range h.headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	_, err = post(h.client, req)
+	return err
+}
+
+// payload returns the entry as the JSON payload the handler accepts. The
+// fields of the entry are collapsed into the payload.
+func payload(e *reader.Entry) map[string]interface{} {
+	p := make(map[string]interface{}, len(e.Fields)+3)
+	for k, v := range e.Fields {
+		p[k] = jsonValue(v)
+	}
+	p["type"] = e.Kind
+	p["message"] = e.Message
+	p["timestamp"] = e.Timestamp.Format(time.RFC3339Nano)
+	return p
+}
+
+// jsonValue keeps the type of numbers and booleans. Everything else is
+// encoded as a string.
+func jsonValue(v string) interface{} {
+	if _, err := strconv.ParseFloat(v, 64); err == nil && json.Valid([]byte(v)) {
+		return json.Number(v)
+	}
+	if v == "true" || v == "false" {
+		return v == "true"
+	}
+	return v
+}
+
+// WithHTTPURL sets the url of the server. It returns an error if the url is
+// not valid.
+func WithHTTPURL(addr string) func(*HTTP) error {
+	return func(h *HTTP) error {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return errors.Wrap(err, "parsing the url")
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return errors.Wrap(ErrNoURL, addr)
+		}
+		h.url = addr
+		return nil
+	}
+}
+
+// WithHTTPHeader adds a header to the requests.
+func WithHTTPHeader(key, value string) func(*HTTP) error {
+	return func(h *HTTP) error {
+		if key == "" {
+			return errors.New("empty header name")
+		}
+		h.headers.Add(key, value)
+		return nil
+	}
+}
+
+// WithHTTPCompress compresses the request bodies with the method. Only gzip is
+// supported.
+func WithHTTPCompress(method string) func(*HTTP) error {
+	return func(h *HTTP) error {
+		if method != "gzip" {
+			return fmt.Errorf("unsupported (%s) compression", method)
+		}
+		h.compress = true
+		return nil
+	}
+}
+
+// WithHTTPBatch sets the batch size and the delay between sends.
+func WithHTTPBatch(size int, delay time.Duration) func(*HTTP) error {
+	return func(h *HTTP) error {
+		return h.setBatch(size, delay)
+	}
+}
+
+// WithHTTPRetry sets the number of the attempts of each request, including the
+// first one, the delay after the first attempt, and the maximum delay between
+// the attempts.
+func WithHTTPRetry(attempts int, backoff, max time.Duration) func(*HTTP) error {
+	return func(h *HTTP) error {
+		return h.setRetry(attempts, backoff, max)
+	}
+}
+
+// WithHTTPClient sets the http client for sending the requests.
+func WithHTTPClient(client *http.Client) func(*HTTP) error {
+	return func(h *HTTP) error {
+		h.client = client
+		return nil
+	}
+}
+
+// WithHTTPLogger sets the logger for reporting errors occurred while sending
+// the entries in the background.
+func WithHTTPLogger(logger tools.FieldLogger) func(*HTTP) error {
+	return func(h *HTTP) error {
+		h.logger = logger
+		return nil
+	}
+}
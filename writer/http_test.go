@@ -0,0 +1,234 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// flakyServer responds with the codes in order, and with 200 afterwards.
+type flakyServer struct {
+	sync.Mutex
+	codes    []int
+	requests int
+}
+
+func (f *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests++
+	if len(f.codes) > 0 {
+		w.WriteHeader(f.codes[0])
+		f.codes = f.codes[1:]
+	}
+}
+
+func (f *flakyServer) Requests() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.requests
+}
+
+var _ = Describe("HTTP", func() {
+	var (
+		rec   *requestRecorder
+		ts    *httptest.Server
+		line  = []byte(`time="2017-01-14T19:10:10Z" level=error msg="something bad happened" app=billing` + "\n")
+		typed = []byte(`time="2017-01-14T19:10:10Z" level=info msg=paid amount=12.5 count=3 ok=true id=0x10 code=007` + "\n")
+	)
+
+	BeforeEach(func() {
+		rec = &requestRecorder{}
+		ts = httptest.NewServer(rec)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	Context("creating without a url", func() {
+		It("should error", func() {
+			h, err := writer.NewHTTP()
+			Expect(err).To(Equal(writer.ErrNoURL))
+			Expect(h).To(BeNil())
+		})
+	})
+
+	Context("creating with bad options", func() {
+		It("should error", func() {
+			_, err := writer.NewHTTP(writer.WithHTTPURL("localhost"))
+			Expect(err).To(HaveOccurred())
+			_, err = writer.NewHTTP(writer.WithHTTPCompress("zstd"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("flushing the entries", func() {
+		It("should send them as an array of payloads with the headers", func() {
+			h, err := writer.NewHTTP(
+				writer.WithHTTPURL(ts.URL+"/logs"),
+				writer.WithHTTPHeader("X-Api-Key", "secret"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer h.Close()
+
+			_, err = h.Write(append(line, line...))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h.Flush()).To(Succeed())
+
+			req := rec.Request()
+			Expect(req.URL.Path).To(Equal("/logs"))
+			Expect(req.Header.Get("X-Api-Key")).To(Equal("secret"))
+			Expect(req.Header.Get("Content-Type")).To(Equal("application/json"))
+
+			var payloads []map[string]string
+			Expect(json.Unmarshal([]byte(rec.Body()), &payloads)).To(Succeed())
+			Expect(payloads).To(HaveLen(2))
+			Expect(payloads[0]).To(Equal(map[string]string{
+				"type":      "error",
+				"message":   "something bad happened",
+				"timestamp": "2017-01-14T19:10:10Z",
+				"app":       "billing",
+			}))
+		})
+	})
+
+	Context("with fields of other types", func() {
+		It("should keep the numbers and booleans", func() {
+			h, err := writer.NewHTTP(writer.WithHTTPURL(ts.URL))
+			Expect(err).NotTo(HaveOccurred())
+			defer h.Close()
+
+			_, err = h.Write(typed)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h.Flush()).To(Succeed())
+
+			var payloads []map[string]interface{}
+			Expect(json.Unmarshal([]byte(rec.Body()), &payloads)).To(Succeed())
+			Expect(payloads).To(HaveLen(1))
+			Expect(payloads[0]).To(HaveKeyWithValue("amount", 12.5))
+			Expect(payloads[0]).To(HaveKeyWithValue("count", 3.0))
+			Expect(payloads[0]).To(HaveKeyWithValue("ok", true))
+			Expect(payloads[0]).To(HaveKeyWithValue("id", "0x10"))
+			Expect(payloads[0]).To(HaveKeyWithValue("code", "007"))
+			Expect(payloads[0]).To(HaveKeyWithValue("message", "paid"))
+		})
+	})
+
+	Context("with gzip compression", func() {
+		It("should compress the body", func() {
+			h, err := writer.NewHTTP(
+				writer.WithHTTPURL(ts.URL),
+				writer.WithHTTPCompress("gzip"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer h.Close()
+
+			_, err = h.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h.Flush()).To(Succeed())
+
+			Expect(rec.Request().Header.Get("Content-Encoding")).To(Equal("gzip"))
+			gz, err := gzip.NewReader(strings.NewReader(rec.Body()))
+			Expect(err).NotTo(HaveOccurred())
+			body, err := ioutil.ReadAll(gz)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(ContainSubstring(`"message":"something bad happened"`))
+		})
+	})
+
+	Context("when the server fails", func() {
+		var flaky *flakyServer
+
+		BeforeEach(func() {
+			flaky = &flakyServer{}
+			ts.Close()
+			ts = httptest.NewServer(flaky)
+		})
+
+		It("should retry on 5xx responses", func() {
+			flaky.codes = []int{http.StatusServiceUnavailable, http.StatusBadGateway}
+			h, err := writer.NewHTTP(
+				writer.WithHTTPURL(ts.URL),
+				writer.WithHTTPRetry(3, time.Millisecond, time.Millisecond),
+				writer.WithHTTPLogger(tools.DiscardLogger()),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer h.Close()
+
+			_, err = h.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h.Flush()).To(Succeed())
+			Expect(flaky.Requests()).To(Equal(3))
+		})
+
+		It("should give up after the attempts", func() {
+			flaky.codes = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+			h, err := writer.NewHTTP(
+				writer.WithHTTPURL(ts.URL),
+				writer.WithHTTPRetry(2, time.Millisecond, time.Millisecond),
+				writer.WithHTTPLogger(tools.DiscardLogger()),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer h.Close()
+
+			_, err = h.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			err = h.Flush()
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*writer.RetryError).Attempts).To(Equal(2))
+			Expect(flaky.Requests()).To(Equal(2))
+		})
+
+		It("should stop waiting between the attempts when stopped", func() {
+			flaky.codes = []int{http.StatusServiceUnavailable}
+			h, err := writer.NewHTTP(
+				writer.WithHTTPURL(ts.URL),
+				writer.WithHTTPRetry(3, time.Hour, time.Hour),
+				writer.WithHTTPLogger(tools.DiscardLogger()),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer h.Close()
+
+			_, err = h.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			done := make(chan error)
+			go func() { done <- h.Flush() }()
+			Eventually(flaky.Requests).Should(Equal(1))
+			h.Stop()
+
+			Eventually(done).Should(Receive(HaveOccurred()))
+			Expect(flaky.Requests()).To(Equal(1))
+		})
+
+		It("should not retry on 4xx responses", func() {
+			flaky.codes = []int{http.StatusBadRequest}
+			h, err := writer.NewHTTP(
+				writer.WithHTTPURL(ts.URL),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer h.Close()
+
+			_, err = h.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			err = h.Flush()
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*writer.StatusError).Code).To(Equal(http.StatusBadRequest))
+			Expect(flaky.Requests()).To(Equal(1))
+		})
+	})
+})
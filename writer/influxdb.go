@@ -0,0 +1,364 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/arsham/logpipe/tools"
+	"github.com/pkg/errors"
+)
+
+// InfluxDB sends the log entries to an InfluxDB server in line protocol. Each
+// entry becomes a point in the measurement, with the tags and fields picked
+// from the entry. The "level" and "message" keys refer to the entry's level
+// and message, and other keys refer to the entry's fields. It collects the
+// entries and sends them in batches. It implements io.WriteCloser interface.
+//
+// By default the level is the only tag, and the message and all other fields
+// of the entry are the fields of the point. The fields are written as strings,
+// unless their type is set with WithInfluxDBFieldType. InfluxDB refuses the
+// points that change the type of a field, so the type is never guessed from
+// the values.
+type InfluxDB struct {
+	batch
+	url         string
+	version     int
+	database    string
+	username    string
+	password    string
+	org         string
+	bucket      string
+	token       string
+	measurement string
+	tags        []string
+	fields      []string
+	fieldTypes  map[string]string
+	client      *http.Client
+}
+
+// NewInfluxDB returns an error if the url is not provided, or if the database
+// (v1) or the org and bucket (v2) are not set. It starts a goroutine to send
+// the entries in intervals.
+func NewInfluxDB(conf ...func(*InfluxDB) error) (*InfluxDB, error) {
+	i := &InfluxDB{
+		version:     1,
+		measurement: "logs",
+		tags:        []string{"level"},
+	}
+	for _, f := range conf {
+		if err := f(i); err != nil {
+			return nil, err
+		}
+	}
+
+	if i.url == "" {
+		return nil, ErrNoURL
+	}
+	if i.version == 1 && i.database == "" {
+		return nil, ErrNoDatabase
+	}
+	if i.version == 2 && (i.org == "" || i.bucket == "") {
+		return nil, ErrNoBucket
+	}
+
+	if i.client == nil {
+		i.client = &http.Client{Timeout: DefaultTimeout}
+	}
+
+	i.start(i.url, i.send)
+	return i, nil
+}
+
+// Name returns the url of the server.
+func (i *InfluxDB) Name() string { return i.url }
+
+func (i *InfluxDB) send(entries []*reader.Entry) error {
+	buf := new(bytes.Buffer)
+	for _, e := range entries {
+		i.writePoint(buf, e)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, i.endpoint(), buf)
+	if err != nil {
+		return errors.Wrap(err, "creating the request")
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.version == 2 {
+		req.Header.Set("Authorization", "Token "+i.token)
+	} else if i.username != "" {
+		req.SetBasicAuth(i.username, i.password)
+	}
+
+	_, err = post(i.client, req)
+	return errors.Wrap(err, "writing points")
+}
+
+func (i *InfluxDB) endpoint() string {
+	q := url.Values{}
+	q.Set("precision", "ns")
+	if i.version == 2 {
+		q.Set("org", i.org)
+		q.Set("bucket", i.bucket)
+		return i.url + "/api/v2/write?" + q.Encode()
+	}
+	q.Set("db", i.database)
+	return i.url + "/write?" + q.Encode()
+}
+
+// entryValue returns the value of the key in the entry.
+func entryValue(e *reader.Entry, key string) (string, bool) {
+	switch key {
+	case "level":
+		return e.Kind, true
+	case "message":
+		return e.Message, true
+	}
+	v, ok := e.Fields[key]
+	return v, ok
+}
+
+// writePoint writes the entry as a line in line protocol:
+//
+//	measurement,tag=value field="value",number=12i 1484421010000000000
+func (i *InfluxDB) writePoint(buf *bytes.Buffer, e *reader.Entry) {
+	buf.WriteString(measurementEscaper.Replace(i.measurement))
+
+	isTag := make(map[string]bool, len(i.tags))
+	for _, key := range i.tags {
+		isTag[key] = true
+		v, ok := entryValue(e, key)
+		if !ok || v == "" {
+			continue // empty tags are not accepted
+		}
+		buf.WriteByte(',')
+		buf.WriteString(keyEscaper.Replace(key))
+		buf.WriteByte('=')
+		buf.WriteString(keyEscaper.Replace(v))
+	}
+
+	fields := i.fields
+	if len(fields) == 0 {
+		fields = []string{"message"}
+		var extra []string
+		for key := range e.Fields {
+			if !isTag[key] {
+				extra = append(extra, key)
+			}
+		}
+		sort.Strings(extra)
+		fields = append(fields, extra...)
+	}
+
+	sep := byte(' ')
+	for _, key := range fields {
+		v, ok := entryValue(e, key)
+		if !ok {
+			continue
+		}
+		value := quoteField(v)
+		if key != "message" && key != "level" {
+			if value, ok = i.fieldValue(key, v); !ok {
+				continue
+			}
+		}
+		buf.WriteByte(sep)
+		buf.WriteString(keyEscaper.Replace(key))
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		sep = ','
+	}
+	if sep == ' ' { // a point should have at least one field
+		buf.WriteString(" message=")
+		buf.WriteString(quoteField(e.Message))
+	}
+
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(e.Timestamp.UnixNano(), 10))
+	buf.WriteByte('\n')
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	fieldEscaper       = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+func quoteField(v string) string {
+	return `"` + fieldEscaper.Replace(v) + `"`
+}
+
+// Field types that can be set with WithInfluxDBFieldType.
+const (
+	InfluxDBString  = "string"
+	InfluxDBInteger = "integer"
+	InfluxDBFloat   = "float"
+	InfluxDBBoolean = "boolean"
+)
+
+var (
+	integerValue = regexp.MustCompile(`^[+-]?[0-9]+$`)
+	floatValue   = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+)
+
+// fieldValue returns the value of the field in its configured type. It
+// returns false if the value is not of the type, so the field is left out of
+// the point. Only plain decimal numbers are accepted, as line protocol has no
+// NaN, infinity or hex floats.
+func (i *InfluxDB) fieldValue(key, v string) (string, bool) {
+	switch i.fieldTypes[key] {
+	case InfluxDBInteger:
+		if !integerValue.MatchString(v) {
+			return "", false
+		}
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return "", false
+		}
+		return v + "i", true
+	case InfluxDBFloat:
+		if !floatValue.MatchString(v) {
+			return "", false
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return "", false
+		}
+		return v, true
+	case InfluxDBBoolean:
+		if v != "true" && v != "false" {
+			return "", false
+		}
+		return v, true
+	}
+	return quoteField(v), true
+}
+
+// WithInfluxDBURL sets the url of the server. It returns an error if the url
+// is not valid.
+func WithInfluxDBURL(addr string) func(*InfluxDB) error {
+	return func(i *InfluxDB) error {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return errors.Wrap(err, "parsing the url")
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return errors.Wrap(ErrNoURL, addr)
+		}
+		i.url = strings.TrimRight(addr, "/")
+		return nil
+	}
+}
+
+// WithInfluxDBDatabase sets up the writer for the v1 write endpoint. The
+// username can be empty if the authentication is not enabled.
+func WithInfluxDBDatabase(database, username, password string) func(*InfluxDB) error {
+	return func(i *InfluxDB) error {
+		i.version = 1
+		i.database = database
+		i.username = username
+		i.password = password
+		return nil
+	}
+}
+
+// WithInfluxDBBucket sets up the writer for the v2 write endpoint.
+func WithInfluxDBBucket(org, bucket, token string) func(*InfluxDB) error {
+	return func(i *InfluxDB) error {
+		i.version = 2
+		i.org = org
+		i.bucket = bucket
+		i.token = token
+		return nil
+	}
+}
+
+// WithInfluxDBMeasurement sets the measurement name. Default is "logs".
+func WithInfluxDBMeasurement(measurement string) func(*InfluxDB) error {
+	return func(i *InfluxDB) error {
+		if measurement == "" {
+			return errors.New("empty measurement name")
+		}
+		i.measurement = measurement
+		return nil
+	}
+}
+
+// WithInfluxDBTags sets the keys that are written as tags.
+func WithInfluxDBTags(keys ...string) func(*InfluxDB) error {
+	return func(i *InfluxDB) error {
+		i.tags = keys
+		return nil
+	}
+}
+
+// WithInfluxDBFields sets the keys that are written as fields.
+func WithInfluxDBFields(keys ...string) func(*InfluxDB) error {
+	return func(i *InfluxDB) error {
+		i.fields = keys
+		return nil
+	}
+}
+
+// WithInfluxDBFieldType sets the type of the field of the key, which is one of
+// InfluxDBString, InfluxDBInteger, InfluxDBFloat or InfluxDBBoolean. The
+// values that are not of the type are left out of the points.
+func WithInfluxDBFieldType(key, typ string) func(*InfluxDB) error {
+	return func(i *InfluxDB) error {
+		switch typ {
+		case InfluxDBString, InfluxDBInteger, InfluxDBFloat, InfluxDBBoolean:
+		default:
+			return fmt.Errorf("unknown (%s) type of field %s", typ, key)
+		}
+		if key == "message" || key == "level" {
+			return fmt.Errorf("the type of %s can not be set", key)
+		}
+		if i.fieldTypes == nil {
+			i.fieldTypes = make(map[string]string)
+		}
+		i.fieldTypes[key] = typ
+		return nil
+	}
+}
+
+// WithInfluxDBBatch sets the batch size and the delay between sends.
+func WithInfluxDBBatch(size int, delay time.Duration) func(*InfluxDB) error {
+	return func(i *InfluxDB) error {
+		return i.setBatch(size, delay)
+	}
+}
+
+// WithInfluxDBRetry sets the number of the attempts of each batch, including
+// the first one, the delay after the first attempt, and the maximum delay
+// between the attempts.
+func WithInfluxDBRetry(attempts int, backoff, max time.Duration) func(*InfluxDB) error {
+	return func(i *InfluxDB) error {
+		return i.setRetry(attempts, backoff, max)
+	}
+}
+
+// WithInfluxDBClient sets the http client for sending the requests.
+func WithInfluxDBClient(client *http.Client) func(*InfluxDB) error {
+	return func(i *InfluxDB) error {
+		i.client = client
+		return nil
+	}
+}
+
+// WithInfluxDBLogger sets the logger for reporting errors occurred while
+// sending the entries in the background.
+func WithInfluxDBLogger(logger tools.FieldLogger) func(*InfluxDB) error {
+	return func(i *InfluxDB) error {
+		i.logger = logger
+		return nil
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// requestRecorder records the last request and its body.
+type requestRecorder struct {
+	sync.Mutex
+	req  *http.Request
+	body string
+	code int
+}
+
+func (r *requestRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	r.req = req
+	r.body = string(body)
+	if r.code != 0 {
+		w.WriteHeader(r.code)
+	}
+}
+
+func (r *requestRecorder) Body() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.body
+}
+
+func (r *requestRecorder) Request() *http.Request {
+	r.Lock()
+	defer r.Unlock()
+	return r.req
+}
+
+var _ = Describe("InfluxDB", func() {
+	var (
+		rec  *requestRecorder
+		ts   *httptest.Server
+		line = []byte(`time="2017-01-14T19:10:10Z" level=error msg="something \"bad\" happened" app=billing duration=12 ratio=0.5` + "\n")
+	)
+
+	BeforeEach(func() {
+		rec = &requestRecorder{code: http.StatusNoContent}
+		ts = httptest.NewServer(rec)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	Context("creating without a database", func() {
+		It("should error", func() {
+			i, err := writer.NewInfluxDB(writer.WithInfluxDBURL(ts.URL))
+			Expect(err).To(Equal(writer.ErrNoDatabase))
+			Expect(i).To(BeNil())
+		})
+	})
+
+	Context("creating v2 without a bucket", func() {
+		It("should error", func() {
+			i, err := writer.NewInfluxDB(
+				writer.WithInfluxDBURL(ts.URL),
+				writer.WithInfluxDBBucket("org", "", "token"),
+			)
+			Expect(err).To(Equal(writer.ErrNoBucket))
+			Expect(i).To(BeNil())
+		})
+	})
+
+	Context("with the default tags and fields", func() {
+		It("should write the level as a tag and the rest as fields", func() {
+			i, err := writer.NewInfluxDB(
+				writer.WithInfluxDBURL(ts.URL),
+				writer.WithInfluxDBDatabase("logpipe", "user", "pass"),
+				writer.WithInfluxDBBatch(1, time.Hour),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer i.Close()
+
+			_, err = i.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rec.Body()).To(Equal(
+				`logs,level=error message="something \"bad\" happened",app="billing",duration="12",ratio="0.5" 1484421010000000000` + "\n",
+			))
+
+			req := rec.Request()
+			Expect(req.URL.Path).To(Equal("/write"))
+			Expect(req.URL.Query().Get("db")).To(Equal("logpipe"))
+			Expect(req.URL.Query().Get("precision")).To(Equal("ns"))
+			user, pass, ok := req.BasicAuth()
+			Expect(ok).To(BeTrue())
+			Expect(user).To(Equal("user"))
+			Expect(pass).To(Equal("pass"))
+		})
+	})
+
+	Context("with v2 and custom tags and fields", func() {
+		It("should write to the bucket with the selected keys", func() {
+			i, err := writer.NewInfluxDB(
+				writer.WithInfluxDBURL(ts.URL),
+				writer.WithInfluxDBBucket("my org", "logs", "secret"),
+				writer.WithInfluxDBMeasurement("app logs"),
+				writer.WithInfluxDBTags("level", "app"),
+				writer.WithInfluxDBFields("duration"),
+				writer.WithInfluxDBFieldType("duration", writer.InfluxDBInteger),
+				writer.WithInfluxDBBatch(1, time.Hour),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer i.Close()
+
+			_, err = i.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rec.Body()).To(Equal(
+				`app\ logs,level=error,app=billing duration=12i 1484421010000000000` + "\n",
+			))
+
+			req := rec.Request()
+			Expect(req.URL.Path).To(Equal("/api/v2/write"))
+			Expect(req.URL.Query().Get("org")).To(Equal("my org"))
+			Expect(req.URL.Query().Get("bucket")).To(Equal("logs"))
+			Expect(req.Header.Get("Authorization")).To(Equal("Token secret"))
+		})
+	})
+
+	Context("with field types", func() {
+		It("should leave out the values that are not of the type", func() {
+			i, err := writer.NewInfluxDB(
+				writer.WithInfluxDBURL(ts.URL),
+				writer.WithInfluxDBDatabase("logpipe", "", ""),
+				writer.WithInfluxDBFieldType("big", writer.InfluxDBFloat),
+				writer.WithInfluxDBFieldType("count", writer.InfluxDBInteger),
+				writer.WithInfluxDBFieldType("hex", writer.InfluxDBFloat),
+				writer.WithInfluxDBFieldType("ok", writer.InfluxDBBoolean),
+				writer.WithInfluxDBFieldType("ratio", writer.InfluxDBFloat),
+				writer.WithInfluxDBBatch(1, time.Hour),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer i.Close()
+
+			_, err = i.Write([]byte(`time="2017-01-14T19:10:10Z" level=info msg=typed big=1e3 count=5.5 hex=0x1p-2 ok=true ratio=NaN` + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rec.Body()).To(Equal(
+				`logs,level=info message="typed",big=1e3,ok=true 1484421010000000000` + "\n",
+			))
+		})
+
+		It("should error on unknown types", func() {
+			i, err := writer.NewInfluxDB(
+				writer.WithInfluxDBURL(ts.URL),
+				writer.WithInfluxDBDatabase("logpipe", "", ""),
+				writer.WithInfluxDBFieldType("count", "number"),
+			)
+			Expect(err).To(HaveOccurred())
+			Expect(i).To(BeNil())
+		})
+	})
+
+	Context("when the server rejects the points", func() {
+		It("should return the error", func() {
+			rec.code = http.StatusBadRequest
+			i, err := writer.NewInfluxDB(
+				writer.WithInfluxDBURL(ts.URL),
+				writer.WithInfluxDBDatabase("logpipe", "", ""),
+				writer.WithInfluxDBBatch(1, time.Hour),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = i.Write(line)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("400"))
+		})
+	})
+})
@@ -0,0 +1,358 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/arsham/logpipe/tools"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+const lokiPushPath = "/loki/api/v1/push"
+
+// Loki pushes the log entries to a Loki server. The entries are grouped into
+// streams by the values of the label fields, and each stream is sorted by the
+// timestamps. The fields that are not labels are kept in the line in logfmt
+// format. The payloads are snappy compressed protobuf messages, or JSON
+// objects. Failed pushes are retried if the server responds with a 5xx status
+// code or is not reachable. It implements io.WriteCloser interface.
+type Loki struct {
+	batch
+	url    string
+	labels []string
+	json   bool
+	client *http.Client
+}
+
+type lokiStream struct {
+	labels  map[string]string
+	entries []*reader.Entry
+}
+
+// NewLoki returns an error if the url is not provided. It starts a goroutine
+// to send the entries in intervals.
+func NewLoki(conf ...func(*Loki) error) (*Loki, error) {
+	l := &Loki{
+		labels: []string{"level"},
+	}
+	for _, f := range conf {
+		if err := f(l); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.url == "" {
+		return nil, ErrNoURL
+	}
+
+	if l.client == nil {
+		l.client = &http.Client{Timeout: DefaultTimeout}
+	}
+
+	l.start(l.url, l.send)
+	return l, nil
+}
+
+// Name returns the url of the server.
+func (l *Loki) Name() string { return l.url }
+
+func (l *Loki) send(entries []*reader.Entry) error {
+	streams := l.streams(entries)
+
+	var (
+		body        []byte
+		contentType string
+		err         error
+	)
+	if l.json {
+		contentType = "application/json"
+		body, err = l.encodeJSON(streams)
+	} else {
+		contentType = "application/x-protobuf"
+		body = snappy.Encode(nil, l.encodeProto(streams))
+	}
+	if err != nil {
+		return errors.Wrap(err, "encoding the streams")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, l.url+lokiPushPath, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "creating the request")
+	}
+	req.Header.Set("Content-Type", contentType)
+	_, err = post(l.client, req)
+	return err
+}
+
+// streams groups the entries by their labels and sorts them by their
+// timestamps. The streams are sorted by their labels.
+func (l *Loki) streams(entries []*reader.Entry) []*lokiStream {
+	index := make(map[string]*lokiStream)
+	var streams []*lokiStream
+	for _, e := range entries {
+		labels := l.entryLabels(e)
+		key := labelString(labels)
+		s, ok := index[key]
+		if !ok {
+			s = &lokiStream{labels: labels}
+			index[key] = s
+			streams = append(streams, s)
+		}
+		s.entries = append(s.entries, e)
+	}
+
+	for _, s := range streams {
+		sort.SliceStable(s.entries, func(i, j int) bool {
+			return s.entries[i].Timestamp.Before(s.entries[j].Timestamp)
+		})
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return labelString(streams[i].labels) < labelString(streams[j].labels)
+	})
+	return streams
+}
+
+// entryLabels returns the values of the label fields of the entry. The level
+// label is the level of the entry. Missing fields are skipped.
+func (l *Loki) entryLabels(e *reader.Entry) map[string]string {
+	labels := make(map[string]string, len(l.labels))
+	for _, name := range l.labels {
+		if name == "level" {
+			labels[name] = e.Kind
+			continue
+		}
+		if v, ok := e.Fields[name]; ok {
+			labels[name] = v
+		}
+	}
+	return labels
+}
+
+// line returns the message and the fields that are not labels in logfmt
+// format.
+func (l *Loki) line(e *reader.Entry) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("msg=")
+	buf.WriteString(logfmtValue(e.Message))
+
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if l.isLabel(k) {
+			continue
+		}
+		fmt.Fprintf(buf, " %s=%s", k, logfmtValue(e.Fields[k]))
+	}
+	return buf.String()
+}
+
+func (l *Loki) isLabel(name string) bool {
+	for _, label := range l.labels {
+		if label == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Loki) encodeJSON(streams []*lokiStream) ([]byte, error) {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	payload := struct {
+		Streams []stream `json:"streams"`
+	}{}
+	for _, s := range streams {
+		values := make([][2]string, len(s.entries))
+		for i, e := range s.entries {
+			values[i] = [2]string{strconv.FormatInt(e.Timestamp.UnixNano(), 10), l.line(e)}
+		}
+		payload.Streams = append(payload.Streams, stream{Stream: s.labels, Values: values})
+	}
+	return json.Marshal(payload)
+}
+
+// encodeProto encodes the streams as a logproto.PushRequest message:
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	message EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func (l *Loki) encodeProto(streams []*lokiStream) []byte {
+	var req []byte
+	for _, s := range streams {
+		stream := appendProtoBytes(nil, 1, []byte(labelString(s.labels)))
+		for _, e := range s.entries {
+			var ts []byte
+			if secs := e.Timestamp.Unix(); secs != 0 {
+				ts = appendProtoVarint(ts, 1, uint64(secs))
+			}
+			if nanos := e.Timestamp.Nanosecond(); nanos != 0 {
+				ts = appendProtoVarint(ts, 2, uint64(nanos))
+			}
+			entry := appendProtoBytes(nil, 1, ts)
+			entry = appendProtoBytes(entry, 2, []byte(l.line(e)))
+			stream = appendProtoBytes(stream, 2, entry)
+		}
+		req = appendProtoBytes(req, 1, stream)
+	}
+	return req
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3)
+	return appendVarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// labelEscaper escapes the label values in the Prometheus format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString returns the labels in the Prometheus format, for example
+// {app="billing", level="error"}.
+func labelString(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, k, labelEscaper.Replace(labels[k]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// logfmtValue quotes the value if it is empty or has spaces, quotes or equal
+// signs.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\n\t") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// WithLokiURL sets the url of the server, without the push path. It returns
+// an error if the url is not valid.
+func WithLokiURL(addr string) func(*Loki) error {
+	return func(l *Loki) error {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return errors.Wrap(err, "parsing the url")
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return errors.Wrap(ErrNoURL, addr)
+		}
+		l.url = strings.TrimSuffix(strings.TrimRight(addr, "/"), lokiPushPath)
+		return nil
+	}
+}
+
+// WithLokiLabels sets the fields that are used as the labels of the streams.
+// The level label is the level of the entry. Default is level.
+func WithLokiLabels(labels ...string) func(*Loki) error {
+	return func(l *Loki) error {
+		for _, label := range labels {
+			if !validIdentifier(label) {
+				return fmt.Errorf("invalid (%s) label name", label)
+			}
+		}
+		l.labels = labels
+		return nil
+	}
+}
+
+// validIdentifier reports whether name matches [a-zA-Z_][a-zA-Z0-9_]*.
+func validIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WithLokiFormat sets the format of the payloads. It can be protobuf, which
+// is the default, or json.
+func WithLokiFormat(format string) func(*Loki) error {
+	return func(l *Loki) error {
+		switch format {
+		case "protobuf":
+			l.json = false
+		case "json":
+			l.json = true
+		default:
+			return fmt.Errorf("unsupported (%s) format", format)
+		}
+		return nil
+	}
+}
+
+// WithLokiRetry sets the number of the attempts of each push, including the
+// first one, the delay after the first attempt, and the maximum delay between
+// the attempts.
+func WithLokiRetry(attempts int, backoff, max time.Duration) func(*Loki) error {
+	return func(l *Loki) error {
+		return l.setRetry(attempts, backoff, max)
+	}
+}
+
+// WithLokiBatch sets the batch size and the delay between sends.
+func WithLokiBatch(size int, delay time.Duration) func(*Loki) error {
+	return func(l *Loki) error {
+		return l.setBatch(size, delay)
+	}
+}
+
+// WithLokiClient sets the http client for sending the requests.
+func WithLokiClient(client *http.Client) func(*Loki) error {
+	return func(l *Loki) error {
+		l.client = client
+		return nil
+	}
+}
+
+// WithLokiLogger sets the logger for reporting errors occurred while sending
+// the entries in the background.
+func WithLokiLogger(logger tools.FieldLogger) func(*Loki) error {
+	return func(l *Loki) error {
+		l.logger = logger
+		return nil
+	}
+}
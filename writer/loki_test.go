@@ -0,0 +1,190 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/arsham/logpipe/writer"
+	"github.com/golang/snappy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// protoField is a decoded protobuf field. Only varint and length delimited
+// fields are supported.
+type protoField struct {
+	num   int
+	value uint64
+	bytes []byte
+}
+
+func decodeProto(b []byte) []protoField {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		Expect(n).To(BeNumerically(">", 0))
+		b = b[n:]
+		f := protoField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.value, n = binary.Uvarint(b)
+			b = b[n:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			f.bytes = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			Fail("unexpected wire type")
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+type lokiPush struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	} `json:"streams"`
+}
+
+var _ = Describe("Loki", func() {
+	var (
+		rec *requestRecorder
+		ts  *httptest.Server
+
+		lines = []byte(`time="2017-01-14T19:10:12Z" level=error msg="third" app=billing
+time="2017-01-14T19:10:10Z" level=info msg="first" app=billing duration=12
+time="2017-01-14T19:10:11Z" level=error msg="second thing" app=billing
+time="2017-01-14T19:10:13Z" level=error msg="other app" app=web
+`)
+	)
+
+	BeforeEach(func() {
+		rec = &requestRecorder{code: http.StatusNoContent}
+		ts = httptest.NewServer(rec)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	Context("creating without a url", func() {
+		It("should error", func() {
+			l, err := writer.NewLoki()
+			Expect(err).To(Equal(writer.ErrNoURL))
+			Expect(l).To(BeNil())
+		})
+	})
+
+	Context("creating with bad options", func() {
+		It("should error", func() {
+			_, err := writer.NewLoki(writer.WithLokiLabels("app-name"))
+			Expect(err).To(HaveOccurred())
+			_, err = writer.NewLoki(writer.WithLokiFormat("xml"))
+			Expect(err).To(HaveOccurred())
+			_, err = writer.NewLoki(writer.WithLokiRetry(0, time.Millisecond, time.Millisecond))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("pushing json payloads", func() {
+		It("should group the entries into sorted streams", func() {
+			l, err := writer.NewLoki(
+				writer.WithLokiURL(ts.URL),
+				writer.WithLokiLabels("level", "app"),
+				writer.WithLokiFormat("json"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Close()
+
+			_, err = l.Write(lines)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(l.Flush()).To(Succeed())
+
+			Expect(rec.Request().URL.Path).To(Equal("/loki/api/v1/push"))
+			Expect(rec.Request().Header.Get("Content-Type")).To(Equal("application/json"))
+
+			push := &lokiPush{}
+			Expect(json.Unmarshal([]byte(rec.Body()), push)).To(Succeed())
+			Expect(push.Streams).To(HaveLen(3))
+
+			s := push.Streams[0]
+			Expect(s.Stream).To(Equal(map[string]string{"app": "billing", "level": "error"}))
+			Expect(s.Values).To(Equal([][2]string{
+				{"1484421011000000000", `msg="second thing"`},
+				{"1484421012000000000", "msg=third"},
+			}))
+
+			s = push.Streams[1]
+			Expect(s.Stream).To(Equal(map[string]string{"app": "billing", "level": "info"}))
+			Expect(s.Values).To(Equal([][2]string{{"1484421010000000000", "msg=first duration=12"}}))
+
+			Expect(push.Streams[2].Stream).To(Equal(map[string]string{"app": "web", "level": "error"}))
+		})
+	})
+
+	Context("pushing protobuf payloads", func() {
+		It("should send snappy compressed push requests", func() {
+			l, err := writer.NewLoki(
+				writer.WithLokiURL(ts.URL+"/loki/api/v1/push"),
+				writer.WithLokiLabels("app"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Close()
+
+			_, err = l.Write(lines)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(l.Flush()).To(Succeed())
+
+			Expect(rec.Request().URL.Path).To(Equal("/loki/api/v1/push"))
+			Expect(rec.Request().Header.Get("Content-Type")).To(Equal("application/x-protobuf"))
+
+			body, err := snappy.Decode(nil, []byte(rec.Body()))
+			Expect(err).NotTo(HaveOccurred())
+			streams := decodeProto(body)
+			Expect(streams).To(HaveLen(2))
+
+			stream := decodeProto(streams[0].bytes)
+			Expect(string(stream[0].bytes)).To(Equal(`{app="billing"}`))
+			Expect(stream).To(HaveLen(4)) // labels and three entries
+
+			entry := decodeProto(stream[1].bytes)
+			ts := decodeProto(entry[0].bytes)
+			Expect(ts[0].value).To(Equal(uint64(1484421010)))
+			Expect(string(entry[1].bytes)).To(Equal("msg=first duration=12"))
+
+			stream = decodeProto(streams[1].bytes)
+			Expect(string(stream[0].bytes)).To(Equal(`{app="web"}`))
+		})
+	})
+
+	Context("when the server fails", func() {
+		It("should retry on 5xx responses", func() {
+			flaky := &flakyServer{codes: []int{http.StatusInternalServerError}}
+			server := httptest.NewServer(flaky)
+			defer server.Close()
+
+			l, err := writer.NewLoki(
+				writer.WithLokiURL(server.URL),
+				writer.WithLokiRetry(2, time.Millisecond, time.Millisecond),
+				writer.WithLokiLogger(tools.DiscardLogger()),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Close()
+
+			_, err = l.Write(lines)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(l.Flush()).To(Succeed())
+			Expect(flaky.Requests()).To(Equal(2))
+		})
+	})
+})
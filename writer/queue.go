@@ -0,0 +1,254 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/pkg/errors"
+)
+
+// DefaultQueueDepth is the number of the entries a queue holds if the depth is
+// not set.
+const DefaultQueueDepth = 1024
+
+// OverflowPolicy decides what happens to the entries that are written to a
+// full queue.
+type OverflowPolicy int
+
+const (
+	// Block waits until there is room in the queue.
+	Block OverflowPolicy = iota
+
+	// DropNewest drops the entry that is being written.
+	DropNewest
+
+	// DropOldest drops the oldest entry in the queue to make room.
+	DropOldest
+)
+
+// ParseOverflowPolicy returns the policy from its name, which is one of block,
+// drop_newest or drop_oldest.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch strings.ToLower(name) {
+	case "block":
+		return Block, nil
+	case "drop_newest":
+		return DropNewest, nil
+	case "drop_oldest":
+		return DropOldest, nil
+	}
+	return Block, fmt.Errorf("unknown overflow policy: %s", name)
+}
+
+// job is an entry waiting in the queue. done is called with the result of the
+// write, or when the entry is dropped.
+type job struct {
+	p       []byte
+	payload []byte
+	done    func(n int, err error)
+}
+
+// Queue writes the entries into a writer in a long-lived goroutine, in the
+// order they are written. The entries wait in a bounded queue, and the
+// overflow policy decides what happens when the queue is full. It implements
+// io.WriteCloser interface.
+type Queue struct {
+	w       io.Writer
+	name    string
+	depth   int
+	policy  OverflowPolicy
+	logger  tools.FieldLogger
+	jobs    chan *job
+	dropped uint64
+	stopped int32
+
+	// mu guards closed, and the senders hold its read lock while sending on
+	// jobs, so Close can close the channel safely.
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewQueue returns an error if w is nil. It starts the worker goroutine.
+func NewQueue(w io.Writer, conf ...func(*Queue) error) (*Queue, error) {
+	if w == nil {
+		return nil, errors.New("nil writer")
+	}
+	q := &Queue{
+		w:     w,
+		depth: DefaultQueueDepth,
+	}
+	for _, f := range conf {
+		if err := f(q); err != nil {
+			return nil, err
+		}
+	}
+	q.jobs = make(chan *job, q.depth)
+
+	q.wg.Add(1)
+	go q.work()
+	return q, nil
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for j := range q.jobs {
+		if atomic.LoadInt32(&q.stopped) == 1 {
+			j.done(0, ErrStopped)
+			continue
+		}
+		r := safeWritePayload(q.w, j.p, j.payload)
+		j.done(r.n, r.err)
+	}
+}
+
+// Name returns the name of the queue. If it is not set, the name of the writer
+// is used.
+func (q *Queue) Name() string {
+	if q.name != "" {
+		return q.name
+	}
+	if n, ok := q.w.(namer); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", q.w)
+}
+
+// Writer returns the writer of the queue.
+func (q *Queue) Writer() io.Writer { return q.w }
+
+// Len returns the number of the entries waiting in the queue.
+func (q *Queue) Len() int { return len(q.jobs) }
+
+// Dropped returns the number of the entries that have been dropped because the
+// queue was full.
+func (q *Queue) Dropped() uint64 { return atomic.LoadUint64(&q.dropped) }
+
+// Write puts a copy of p in the queue and returns. The errors of writing the
+// entry are logged. It returns ErrQueueFull if the queue is full and the
+// policy is DropNewest, or ErrClosed if the queue is closed.
+func (q *Queue) Write(p []byte) (int, error) {
+	var err error
+	q.submit(append([]byte(nil), p...), nil, func(n int, e error) {
+		switch {
+		case e == ErrQueueFull || e == ErrClosed:
+			// these are reported before submit returns.
+			err = e
+		case e != nil && q.logger != nil:
+			q.logger.WithField("writer", q.Name()).Error(errors.Wrap(e, "writing the entry"))
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// submit puts p in the queue, and done is called with the result of writing
+// it. The caller should not modify p or the payload afterwards. If the entry
+// is not queued, done is called before submit returns.
+func (q *Queue) submit(p, payload []byte, done func(n int, err error)) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		done(0, ErrClosed)
+		return
+	}
+
+	j := &job{p: p, payload: payload, done: done}
+	switch q.policy {
+	case DropNewest:
+		select {
+		case q.jobs <- j:
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+			done(0, ErrQueueFull)
+		}
+	case DropOldest:
+		for {
+			select {
+			case q.jobs <- j:
+				return
+			default:
+			}
+			select {
+			case old := <-q.jobs:
+				atomic.AddUint64(&q.dropped, 1)
+				old.done(0, ErrDropped)
+			default:
+			}
+		}
+	default:
+		q.jobs <- j
+	}
+}
+
+// Close stops accepting new entries, and returns when the queued entries are
+// written. It doesn't close the writer.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.jobs)
+	q.mu.Unlock()
+
+	q.wg.Wait()
+	return nil
+}
+
+// Stop makes the worker fail the queued entries with ErrStopped instead of
+// writing them. The entry that is being written is not interrupted. It is used
+// for giving up on the entries when the service is shutting down and can not
+// wait any longer.
+func (q *Queue) Stop() {
+	atomic.StoreInt32(&q.stopped, 1)
+}
+
+// WithQueueName sets the name of the queue for the errors.
+func WithQueueName(name string) func(*Queue) error {
+	return func(q *Queue) error {
+		q.name = name
+		return nil
+	}
+}
+
+// WithQueueDepth sets the number of the entries the queue can hold. It
+// returns an error if depth is less than one.
+func WithQueueDepth(depth int) func(*Queue) error {
+	return func(q *Queue) error {
+		if depth < 1 {
+			return fmt.Errorf("low (%d) queue depth", depth)
+		}
+		q.depth = depth
+		return nil
+	}
+}
+
+// WithQueuePolicy sets the policy for writing to a full queue. Default is
+// Block.
+func WithQueuePolicy(policy OverflowPolicy) func(*Queue) error {
+	return func(q *Queue) error {
+		q.policy = policy
+		return nil
+	}
+}
+
+// WithQueueLogger sets the logger for reporting the errors of the entries
+// that are written with Write.
+func WithQueueLogger(logger tools.FieldLogger) func(*Queue) error {
+	return func(q *Queue) error {
+		q.logger = logger
+		return nil
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// gatedWriter records the writes, and holds each write until it receives on
+// gate. started receives when a write begins.
+type gatedWriter struct {
+	sync.Mutex
+	gate    chan struct{}
+	started chan struct{}
+	writes  []string
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{
+		gate:    make(chan struct{}),
+		started: make(chan struct{}, 100),
+	}
+}
+
+func (g *gatedWriter) Write(p []byte) (int, error) {
+	g.started <- struct{}{}
+	<-g.gate
+	g.Lock()
+	defer g.Unlock()
+	g.writes = append(g.writes, string(p))
+	return len(p), nil
+}
+
+func (g *gatedWriter) Writes() []string {
+	g.Lock()
+	defer g.Unlock()
+	return append([]string(nil), g.writes...)
+}
+
+var _ = Describe("Queue", func() {
+
+	DescribeTable("parsing the overflow policy", func(name string, expected writer.OverflowPolicy, fails bool) {
+		policy, err := writer.ParseOverflowPolicy(name)
+		if fails {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(Equal(expected))
+	},
+		Entry("block", "block", writer.Block, false),
+		Entry("drop newest", "drop_newest", writer.DropNewest, false),
+		Entry("drop oldest", "DROP_OLDEST", writer.DropOldest, false),
+		Entry("unknown", "drop_all", writer.Block, true),
+	)
+
+	It("should write the entries in order", func() {
+		w := &writerStub{}
+		var got []string
+		w.writeFunc = func(p []byte) (int, error) {
+			got = append(got, string(p))
+			return len(p), nil
+		}
+		q, err := writer.NewQueue(w)
+		Expect(err).NotTo(HaveOccurred())
+
+		buf := []byte("entry 0")
+		for i := 0; i < 10; i++ {
+			buf[6] = byte('0' + i)
+			n, err := q.Write(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(len(buf)))
+		}
+		Expect(q.Close()).To(Succeed())
+
+		Expect(got).To(HaveLen(10))
+		for i, entry := range got {
+			Expect(entry).To(Equal("entry " + string(byte('0'+i))))
+		}
+	})
+
+	Context("when the queue is full", func() {
+		var g *gatedWriter
+
+		BeforeEach(func() {
+			g = newGatedWriter()
+		})
+
+		// fill writes the first entry, which the worker holds, and fills the
+		// queue with the second one.
+		fill := func(q *writer.Queue) {
+			_, err := q.Write([]byte("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(g.started).Should(Receive())
+			_, err = q.Write([]byte("second"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(q.Len()).To(Equal(1))
+		}
+
+		It("should drop the newest entry with DropNewest", func() {
+			q, err := writer.NewQueue(g, writer.WithQueueDepth(1), writer.WithQueuePolicy(writer.DropNewest))
+			Expect(err).NotTo(HaveOccurred())
+			fill(q)
+
+			_, err = q.Write([]byte("third"))
+			Expect(err).To(Equal(writer.ErrQueueFull))
+			Expect(q.Dropped()).To(BeEquivalentTo(1))
+
+			close(g.gate)
+			Expect(q.Close()).To(Succeed())
+			Expect(g.Writes()).To(Equal([]string{"first", "second"}))
+		})
+
+		It("should drop the oldest entry with DropOldest", func() {
+			q, err := writer.NewQueue(g, writer.WithQueueDepth(1), writer.WithQueuePolicy(writer.DropOldest))
+			Expect(err).NotTo(HaveOccurred())
+			fill(q)
+
+			_, err = q.Write([]byte("third"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(q.Dropped()).To(BeEquivalentTo(1))
+
+			close(g.gate)
+			Expect(q.Close()).To(Succeed())
+			Expect(g.Writes()).To(Equal([]string{"first", "third"}))
+		})
+
+		It("should wait for room with Block", func() {
+			q, err := writer.NewQueue(g, writer.WithQueueDepth(1))
+			Expect(err).NotTo(HaveOccurred())
+			fill(q)
+
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				_, err := q.Write([]byte("third"))
+				Expect(err).NotTo(HaveOccurred())
+				close(done)
+			}()
+			Consistently(done, 0.05).ShouldNot(BeClosed())
+
+			close(g.gate)
+			Eventually(done).Should(BeClosed())
+			Expect(q.Close()).To(Succeed())
+			Expect(g.Writes()).To(Equal([]string{"first", "second", "third"}))
+			Expect(q.Dropped()).To(BeZero())
+		})
+	})
+
+	Context("closing", func() {
+		It("should write the queued entries and refuse the new ones", func() {
+			g := newGatedWriter()
+			close(g.gate)
+			q, err := writer.NewQueue(g)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = q.Write([]byte("entry"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(q.Close()).To(Succeed())
+			Expect(g.Writes()).To(Equal([]string{"entry"}))
+			_, err = q.Write([]byte("late"))
+			Expect(err).To(Equal(writer.ErrClosed))
+			Expect(q.Close()).To(Succeed())
+		})
+
+		It("should drop the queued entries when stopped", func() {
+			g := newGatedWriter()
+			q, err := writer.NewQueue(g)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = q.Write([]byte("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(g.started).Should(Receive())
+			_, err = q.Write([]byte("second"))
+			Expect(err).NotTo(HaveOccurred())
+
+			q.Stop()
+			close(g.gate)
+			Expect(q.Close()).To(Succeed())
+			Expect(g.Writes()).To(Equal([]string{"first"}))
+		})
+	})
+
+	Context("with Distribute", func() {
+		It("should report the results of the workers", func() {
+			g := newGatedWriter()
+			bad := &writerStub{writeFunc: func([]byte) (int, error) {
+				return 0, writer.ErrClosed
+			}}
+			q1, err := writer.NewQueue(g)
+			Expect(err).NotTo(HaveOccurred())
+			q2, err := writer.NewQueue(bad, writer.WithQueueName("bad"))
+			Expect(err).NotTo(HaveOccurred())
+			defer q1.Close()
+			defer q2.Close()
+
+			d, err := writer.NewDistributeWith(
+				writer.WithDistributeWriters(q1, q2),
+				writer.WithDistributeWriterTimeout(q1, 10*time.Millisecond),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = d.Write([]byte("entry"))
+			Expect(err).To(HaveOccurred())
+			errs := err.(*writer.DistributeError).Errors
+			Expect(errs).To(HaveLen(2))
+			Expect(errs[0].Err.Error()).To(ContainSubstring(writer.ErrTimeout.Error()))
+			Expect(errs[1].Name).To(Equal("bad"))
+			Expect(errs[1].Err).To(Equal(writer.ErrClosed))
+
+			close(g.gate)
+			Eventually(g.Writes).Should(Equal([]string{"entry"}))
+		})
+	})
+})
@@ -0,0 +1,370 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/pkg/errors"
+)
+
+// Defaults of the circuit breaker of the Retry writer. The defaults of the
+// attempts are shared with the batched writers.
+const (
+	DefaultBreakerFailures  = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+	breakerDisabledFailures = 0
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets the writes through.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen refuses the writes until the cooldown is passed.
+	BreakerOpen
+
+	// BreakerHalfOpen lets one write through to probe the writer.
+	BreakerHalfOpen
+)
+
+// prober is implemented by the writers that can check the destination without
+// writing an entry, like the Syslog writer connecting to its server.
+type prober interface {
+	Probe() error
+}
+
+func (b BreakerState) String() string {
+	switch b {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Retry writes into a writer again when it fails, with an exponential backoff
+// and jitter between the attempts. The errors that can not be fixed by trying
+// again, like writing into a closed writer, are returned without retrying.
+// After a number of consecutive failed writes, the circuit breaker opens and
+// the writes are refused with ErrBreakerOpen without touching the writer. When
+// the cooldown is passed, the breaker becomes half-open and the writer is
+// probed: the writers that can check their destination, like Syslog, are
+// probed right away, and the others with the next write, which is tried once.
+// The breaker closes if the probe succeeds, or opens again. The state changes
+// are logged. It implements io.Writer interface.
+//
+// Retry is for the writers that write the entries before Write returns. The
+// batched writers send the entries later, and retry the failed batches
+// themselves, so they should not be wrapped in a Retry.
+type Retry struct {
+	w          io.Writer
+	name       string
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	threshold  int
+	cooldown   time.Duration
+	logger     tools.FieldLogger
+
+	quit     chan struct{} // interrupts the backoffs when closed
+	stopOnce sync.Once
+
+	// mu guards the following fields.
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	probing  bool        // the writer is being probed
+	timer    *time.Timer // half-opens the breaker after the cooldown
+	stopped  bool
+}
+
+// NewRetry returns an error if w is nil.
+func NewRetry(w io.Writer, conf ...func(*Retry) error) (*Retry, error) {
+	if w == nil {
+		return nil, errors.New("nil writer")
+	}
+	r := &Retry{
+		w:          w,
+		attempts:   DefaultRetryAttempts,
+		backoff:    DefaultRetryBackoff,
+		maxBackoff: DefaultRetryMaxBackoff,
+		threshold:  DefaultBreakerFailures,
+		cooldown:   DefaultBreakerCooldown,
+		quit:       make(chan struct{}),
+	}
+	for _, f := range conf {
+		if err := f(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Name returns the name of the Retry. If it is not set, the name of the
+// writer is used.
+func (r *Retry) Name() string {
+	if r.name != "" {
+		return r.name
+	}
+	if n, ok := r.w.(namer); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", r.w)
+}
+
+// Writer returns the writer of the Retry.
+func (r *Retry) Writer() io.Writer { return r.w }
+
+// State returns the state of the circuit breaker.
+func (r *Retry) State() BreakerState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// Write writes p into the writer, and tries again if it fails. It returns a
+// *RetryError with the number of attempts if all attempts fail, or
+// ErrBreakerOpen if the breaker is open. It stops trying when the breaker is
+// opened by the other writes. After Stop is called, it gives up after the
+// first failed attempt.
+func (r *Retry) Write(p []byte) (int, error) {
+	probe, ok := r.allow()
+	if !ok {
+		return 0, ErrBreakerOpen
+	}
+	attempts := r.attempts
+	if probe {
+		attempts = 1
+	}
+
+	var (
+		n       int
+		err     error
+		attempt int
+	)
+	for attempt = 1; ; attempt++ {
+		res := safeWrite(r.w, p)
+		if res.err == nil {
+			r.succeeded()
+			return res.n, nil
+		}
+		n, err = res.n, res.err
+		if !retryable(err) {
+			r.abandoned(probe)
+			return n, err
+		}
+		if attempt >= attempts || r.State() == BreakerOpen || !r.wait(attempt) {
+			break
+		}
+	}
+	r.failed()
+	return n, &RetryError{Attempts: attempt, Err: err}
+}
+
+// wait waits before the next attempt, and returns false if the Retry is
+// stopped.
+func (r *Retry) wait(attempt int) bool {
+	select {
+	case <-time.After(backoffDelay(r.backoff, r.maxBackoff, attempt)):
+		return true
+	case <-r.quit:
+		return false
+	}
+}
+
+// Stop interrupts the backoffs of the writes in progress, and the following
+// writes are not tried again. The breaker is not probed anymore. It is used
+// for giving up on the entries when the service is shutting down and can not
+// wait any longer. The writer is not closed.
+func (r *Retry) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.quit)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.stopped = true
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+	})
+}
+
+// allow returns false if the breaker is open, or the writer is being probed.
+// probe is true if the write should probe the writer.
+func (r *Retry) allow() (probe, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.state {
+	case BreakerOpen:
+		return false, false
+	case BreakerHalfOpen:
+		if r.probing {
+			return false, false
+		}
+		r.probing = true
+		return true, true
+	}
+	return false, true
+}
+
+func (r *Retry) succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = 0
+	r.probing = false
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.state != BreakerClosed {
+		r.setState(BreakerClosed)
+	}
+}
+
+// abandoned is called when the write fails with an error that says nothing
+// about the health of the destination. The next write probes the writer
+// instead.
+func (r *Retry) abandoned(probe bool) {
+	if !probe {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.probing = false
+}
+
+// failed records a failed write, and opens the breaker if the threshold is
+// reached or the writer has failed the probe.
+func (r *Retry) failed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures++
+	if r.threshold == breakerDisabledFailures || r.state == BreakerOpen {
+		return
+	}
+	if r.state == BreakerHalfOpen || r.failures >= r.threshold {
+		r.open()
+	}
+}
+
+// open opens the breaker and starts the cooldown. It should be called while
+// holding the lock.
+func (r *Retry) open() {
+	r.probing = false
+	r.setState(BreakerOpen)
+	if !r.stopped {
+		r.timer = time.AfterFunc(r.cooldown, r.probe)
+	}
+}
+
+// probe half-opens the breaker after the cooldown. If the writer can probe its
+// destination, the breaker is closed or opened again with the result.
+// Otherwise the next write probes the writer.
+func (r *Retry) probe() {
+	r.mu.Lock()
+	if r.state != BreakerOpen || r.stopped {
+		r.mu.Unlock()
+		return
+	}
+	r.setState(BreakerHalfOpen)
+	p, ok := r.w.(prober)
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	r.probing = true
+	r.mu.Unlock()
+
+	err := p.Probe()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != BreakerHalfOpen || !r.probing {
+		return
+	}
+	r.probing = false
+	if err != nil {
+		r.failures++
+		r.open()
+		return
+	}
+	r.failures = 0
+	r.setState(BreakerClosed)
+}
+
+// setState should be called while holding the lock.
+func (r *Retry) setState(state BreakerState) {
+	if r.logger != nil {
+		r.logger.WithField("writer", r.Name()).
+			WithField("breaker", state.String()).
+			Warnf("circuit breaker changed from %s to %s after %d failures", r.state, state, r.failures)
+	}
+	r.state = state
+}
+
+// WithRetryName sets the name of the Retry for the logs.
+func WithRetryName(name string) func(*Retry) error {
+	return func(r *Retry) error {
+		r.name = name
+		return nil
+	}
+}
+
+// WithRetryAttempts sets the number of the attempts of each write, including
+// the first one.
+func WithRetryAttempts(attempts int) func(*Retry) error {
+	return func(r *Retry) error {
+		if attempts < 1 {
+			return fmt.Errorf("low (%d) attempts", attempts)
+		}
+		r.attempts = attempts
+		return nil
+	}
+}
+
+// WithRetryBackoff sets the delay after the first attempt, and the maximum
+// delay between the attempts.
+func WithRetryBackoff(backoff, max time.Duration) func(*Retry) error {
+	return func(r *Retry) error {
+		if backoff <= 0 || max < backoff {
+			return fmt.Errorf("invalid (%s, %s) backoff", backoff, max)
+		}
+		r.backoff = backoff
+		r.maxBackoff = max
+		return nil
+	}
+}
+
+// WithRetryBreaker sets the number of the consecutive failures that opens the
+// circuit breaker, and the cooldown before probing the writer. Zero failures
+// disables the breaker.
+func WithRetryBreaker(failures int, cooldown time.Duration) func(*Retry) error {
+	return func(r *Retry) error {
+		if failures < 0 {
+			return fmt.Errorf("negative (%d) failures", failures)
+		}
+		if failures > 0 && cooldown <= 0 {
+			return fmt.Errorf("low (%s) cooldown", cooldown)
+		}
+		r.threshold = failures
+		r.cooldown = cooldown
+		return nil
+	}
+}
+
+// WithRetryLogger sets the logger for reporting the state changes of the
+// circuit breaker.
+func WithRetryLogger(logger tools.FieldLogger) func(*Retry) error {
+	return func(r *Retry) error {
+		r.logger = logger
+		return nil
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// countingWriter counts the writes, and fails while failing is true.
+type countingWriter struct {
+	recorder
+	calls int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.Lock()
+	c.calls++
+	c.Unlock()
+	return c.recorder.Write(p)
+}
+
+func (c *countingWriter) Calls() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.calls
+}
+
+// probingWriter is a countingWriter that can probe its destination, which
+// fails while failing is true.
+type probingWriter struct {
+	countingWriter
+	probes int
+}
+
+func (p *probingWriter) Probe() error {
+	p.Lock()
+	defer p.Unlock()
+	p.probes++
+	if p.failing {
+		return errors.New("destination is down")
+	}
+	return nil
+}
+
+func (p *probingWriter) Probes() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.probes
+}
+
+// safeBuffer is a bytes.Buffer that is safe for concurrent use.
+type safeBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *safeBuffer) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *safeBuffer) String() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.buf.String()
+}
+
+var _ = Describe("Retry", func() {
+	var w *countingWriter
+
+	BeforeEach(func() {
+		w = &countingWriter{}
+	})
+
+	newRetry := func(opts ...func(*writer.Retry) error) *writer.Retry {
+		opts = append([]func(*writer.Retry) error{
+			writer.WithRetryBackoff(time.Millisecond, 2*time.Millisecond),
+			writer.WithRetryLogger(tools.DiscardLogger()),
+		}, opts...)
+		r, err := writer.NewRetry(w, opts...)
+		Expect(err).NotTo(HaveOccurred())
+		return r
+	}
+
+	It("should error on invalid settings", func() {
+		_, err := writer.NewRetry(nil)
+		Expect(err).To(HaveOccurred())
+		_, err = writer.NewRetry(w, writer.WithRetryAttempts(0))
+		Expect(err).To(HaveOccurred())
+		_, err = writer.NewRetry(w, writer.WithRetryBackoff(time.Second, time.Millisecond))
+		Expect(err).To(HaveOccurred())
+		_, err = writer.NewRetry(w, writer.WithRetryBreaker(1, 0))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should write once when the writer succeeds", func() {
+		r := newRetry()
+		n, err := r.Write([]byte("entry"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(5))
+		Expect(w.Calls()).To(Equal(1))
+		Expect(w.Writes()).To(Equal([]string{"entry"}))
+	})
+
+	It("should try again up to the max attempts", func() {
+		w.SetFailing(true)
+		r := newRetry(writer.WithRetryAttempts(3), writer.WithRetryBreaker(0, 0))
+		_, err := r.Write([]byte("entry"))
+		Expect(err).To(HaveOccurred())
+		re, ok := err.(*writer.RetryError)
+		Expect(ok).To(BeTrue())
+		Expect(re.Attempts).To(Equal(3))
+		Expect(w.Calls()).To(Equal(3))
+		Expect(r.State()).To(Equal(writer.BreakerClosed))
+	})
+
+	It("should wait longer after each attempt", func() {
+		w.SetFailing(true)
+		r := newRetry(
+			writer.WithRetryAttempts(3),
+			writer.WithRetryBackoff(20*time.Millisecond, time.Second),
+			writer.WithRetryBreaker(0, 0),
+		)
+		start := time.Now()
+		_, err := r.Write([]byte("entry"))
+		Expect(err).To(HaveOccurred())
+		// at least half of 20ms and 40ms.
+		Expect(time.Since(start)).To(BeNumerically(">=", 30*time.Millisecond))
+	})
+
+	It("should stop waiting between the attempts when stopped", func() {
+		w.SetFailing(true)
+		r := newRetry(
+			writer.WithRetryAttempts(5),
+			writer.WithRetryBackoff(time.Hour, time.Hour),
+			writer.WithRetryBreaker(0, 0),
+		)
+		done := make(chan error)
+		go func() {
+			_, err := r.Write([]byte("entry"))
+			done <- err
+		}()
+		Eventually(w.Calls).Should(Equal(1))
+		r.Stop()
+		r.Stop()
+
+		var err error
+		Eventually(done).Should(Receive(&err))
+		re, ok := err.(*writer.RetryError)
+		Expect(ok).To(BeTrue())
+		Expect(re.Attempts).To(Equal(1))
+
+		By("not trying the next writes again")
+		_, err = r.Write([]byte("entry"))
+		Expect(err).To(HaveOccurred())
+		Expect(w.Calls()).To(Equal(2))
+	})
+
+	It("should not try again when the writer is closed", func() {
+		c := &writerStub{writeFunc: func([]byte) (int, error) {
+			return 0, writer.ErrClosed
+		}}
+		r, err := writer.NewRetry(c, writer.WithRetryAttempts(3), writer.WithRetryBreaker(1, time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = r.Write([]byte("entry"))
+		Expect(err).To(Equal(writer.ErrClosed))
+		Expect(r.State()).To(Equal(writer.BreakerClosed))
+	})
+
+	Context("with the circuit breaker", func() {
+		It("should open after the failures and refuse the writes", func() {
+			logs := &safeBuffer{}
+			w.SetFailing(true)
+			r := newRetry(
+				writer.WithRetryName("billing"),
+				writer.WithRetryAttempts(2),
+				writer.WithRetryBreaker(2, time.Hour),
+				writer.WithRetryLogger(tools.WithWriter(logs)),
+			)
+			defer r.Stop()
+			_, err := r.Write([]byte("first"))
+			Expect(err).To(HaveOccurred())
+			Expect(r.State()).To(Equal(writer.BreakerClosed))
+
+			By("counting the failed writes, not the attempts")
+			_, err = r.Write([]byte("second"))
+			Expect(err.(*writer.RetryError).Attempts).To(Equal(2))
+			Expect(r.State()).To(Equal(writer.BreakerOpen))
+			Expect(w.Calls()).To(Equal(4))
+			Expect(logs.String()).To(ContainSubstring("writer=billing"))
+			Expect(logs.String()).To(ContainSubstring("breaker=open"))
+
+			_, err = r.Write([]byte("third"))
+			Expect(err).To(Equal(writer.ErrBreakerOpen))
+			Expect(w.Calls()).To(Equal(4))
+		})
+
+		It("should probe the writer after the cooldown", func() {
+			w.SetFailing(true)
+			r := newRetry(writer.WithRetryAttempts(3), writer.WithRetryBreaker(1, 20*time.Millisecond))
+			defer r.Stop()
+			_, err := r.Write([]byte("first"))
+			Expect(err).To(HaveOccurred())
+			Expect(r.State()).To(Equal(writer.BreakerOpen))
+
+			By("half-opening without a write")
+			Eventually(r.State).Should(Equal(writer.BreakerHalfOpen))
+			Expect(w.Calls()).To(Equal(3))
+
+			By("opening again when the probe fails")
+			_, err = r.Write([]byte("probe"))
+			Expect(err).To(HaveOccurred())
+			Expect(w.Calls()).To(Equal(4))
+			Expect(r.State()).To(Equal(writer.BreakerOpen))
+
+			By("closing when the probe succeeds")
+			w.SetFailing(false)
+			Eventually(r.State).Should(Equal(writer.BreakerHalfOpen))
+			_, err = r.Write([]byte("probe"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.State()).To(Equal(writer.BreakerClosed))
+			Expect(w.Writes()).To(Equal([]string{"probe"}))
+		})
+
+		It("should probe the writers that can probe after the cooldown", func() {
+			p := &probingWriter{}
+			p.SetFailing(true)
+			r, err := writer.NewRetry(p,
+				writer.WithRetryAttempts(1),
+				writer.WithRetryBreaker(1, 20*time.Millisecond),
+				writer.WithRetryLogger(tools.DiscardLogger()),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer r.Stop()
+			_, err = r.Write([]byte("first"))
+			Expect(err).To(HaveOccurred())
+			Expect(r.State()).To(Equal(writer.BreakerOpen))
+
+			By("opening again when the probe fails")
+			Eventually(p.Probes).Should(BeNumerically(">=", 2))
+			Expect(r.State()).NotTo(Equal(writer.BreakerClosed))
+
+			By("closing when the probe succeeds")
+			p.SetFailing(false)
+			Eventually(r.State).Should(Equal(writer.BreakerClosed))
+			Expect(p.Calls()).To(Equal(1))
+		})
+	})
+})
@@ -0,0 +1,253 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/pkg/errors"
+)
+
+// This file contains the rotation logic of the File.
+
+// TimeSource decides which time is used for expanding the location pattern of
+// a File.
+type TimeSource int
+
+const (
+	// ClockTime uses the wall clock.
+	ClockTime TimeSource = iota
+
+	// EntryTime uses the timestamp of the entries being written.
+	EntryTime
+)
+
+// backup is a rotated file. For example for location.2.gz, the index is 2 and
+// the ext is ".gz". Files with other extensions are not considered backups.
+type backup struct {
+	path    string
+	index   int
+	ext     string
+	modTime time.Time
+}
+
+// shouldRotate reports whether writing n more bytes would make the file bigger
+// than the maximum size. An empty file is never rotated.
+func (f *File) shouldRotate(n int64) bool {
+	if f.maxSize == 0 || f.location == "" || f.size == 0 {
+		return false
+	}
+	return f.size+n > f.maxSize
+}
+
+// rotate flushes the buffer, moves the file to location.1 and opens a new file
+// at location. The current file is kept open if the file can not be moved, or
+// the new file can not be opened. It should be called while the lock is held.
+func (f *File) rotate() error {
+	if err := f.release(); err != nil {
+		return errors.Wrap(err, "flushing the buffer")
+	}
+	if err := f.shiftBackups(); err != nil {
+		return errors.Wrap(err, "moving the backups")
+	}
+
+	file, err := f.open(f.location)
+	if err != nil {
+		// the current file is moved back, so it is rotated on the next write.
+		os.Rename(f.backupName(1, ""), f.location)
+		return errors.Wrap(err, "opening file")
+	}
+	f.signalCompress()
+	old := f.file
+	f.file = file
+	f.buf.Reset(file)
+	f.size = 0
+
+	if err := old.Close(); err != nil {
+		return errors.Wrap(err, "closing the file")
+	}
+	return errors.Wrap(f.prune(), "removing old backups")
+}
+
+// switchTo flushes the buffer into the current file and continues writing to
+// the file at location. The current file is kept open if the new file can not
+// be opened. It opens the first file of the File with EntryTime. It should be
+// called while the lock is held.
+func (f *File) switchTo(location string) error {
+	if location == f.location && f.file != nil {
+		return nil
+	}
+	if err := f.release(); err != nil {
+		return errors.Wrap(err, "flushing the buffer")
+	}
+
+	file, err := f.open(location)
+	if err != nil {
+		return errors.Wrap(err, "opening file")
+	}
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			file.Close()
+			return errors.Wrap(err, "closing the file")
+		}
+	}
+
+	f.file = file
+	f.buf.Reset(file)
+	f.compMu.Lock()
+	f.location = location
+	f.compMu.Unlock()
+	f.size = 0
+	if info, err := file.Stat(); err == nil {
+		f.size = info.Size()
+	}
+	f.signalCompress()
+
+	return errors.Wrap(f.prune(), "removing old files")
+}
+
+// entryTime returns the timestamp of the first entry in p, or the current time
+// if p can not be parsed.
+func entryTime(p []byte) time.Time {
+	if i := bytes.IndexByte(p, '\n'); i >= 0 {
+		p = p[:i]
+	}
+	e, err := reader.ParseEntry(p)
+	if err != nil || e.Timestamp.IsZero() {
+		return time.Now()
+	}
+	return e.Timestamp
+}
+
+// shiftBackups adds one to the index of each backup, and moves the file to the
+// first index.
+func (f *File) shiftBackups() error {
+	f.compMu.Lock()
+	defer f.compMu.Unlock()
+
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+	for _, b := range backups {
+		if err := os.Rename(b.path, f.backupName(b.index+1, b.ext)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(f.location, f.backupName(1, ""))
+}
+
+// prune removes the backups that exceed the maximum number of backups or are
+// older than the maximum age. If the location is a pattern, the files of the
+// previous periods older than the maximum age are also removed.
+func (f *File) prune() error {
+	if f.maxBackups == 0 && f.maxAge == 0 {
+		return nil
+	}
+	backups, err := f.backups()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-f.maxAge)
+	if f.pattern != "" && f.maxAge > 0 {
+		if err := f.prunePeriods(cutoff); err != nil {
+			return err
+		}
+	}
+	for _, b := range backups {
+		tooMany := f.maxBackups > 0 && b.index > f.maxBackups
+		tooOld := f.maxAge > 0 && b.modTime.Before(cutoff)
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// prunePeriods removes the files expanded from the pattern, and their backups,
+// that are modified before the cutoff.
+func (f *File) prunePeriods(cutoff time.Time) error {
+	names, err := periodFiles(f.pattern)
+	if err != nil {
+		return err
+	}
+
+	current := filepath.Clean(f.location)
+	for _, name := range names {
+		if name == current {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil || info.IsDir() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) backupName(index int, ext string) string {
+	return fmt.Sprintf("%s.%d%s", f.location, index, ext)
+}
+
+// backups returns the rotated files of the location, sorted from the oldest
+// to the most recent one.
+func (f *File) backups() ([]backup, error) {
+	dir, base := filepath.Split(f.location)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backup
+	prefix := base + "."
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		suffix := name[len(prefix):]
+		i := 0
+		for i < len(suffix) && suffix[i] >= '0' && suffix[i] <= '9' {
+			i++
+		}
+		if i == 0 || (suffix[i:] != "" && suffix[i:] != gzipExt) {
+			continue
+		}
+		index, err := strconv.Atoi(suffix[:i])
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{
+			path:    filepath.Join(dir, name),
+			index:   index,
+			ext:     suffix[i:],
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].index > backups[j].index
+	})
+	return backups, nil
+}
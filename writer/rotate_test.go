@@ -0,0 +1,506 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arsham/logpipe/writer"
+)
+
+func setupDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func writeLines(t *testing.T, file *writer.File, lines ...string) {
+	for _, l := range lines {
+		if _, err := file.Write([]byte(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestRotateMaxSize(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+	location := path.Join(dir, "logs.log")
+
+	file, err := writer.NewFile(
+		writer.WithLocation(location),
+		writer.WithMaxSize(25),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	line := strings.Repeat("a", 9) // 10 bytes with the new line
+	writeLines(t, file, line+"1", line+"2", line+"3", line+"4", line+"5")
+
+	tcs := []struct {
+		name string
+		want string
+	}{
+		{location + ".2", line + "1\n" + line + "2\n"},
+		{location + ".1", line + "3\n" + line + "4\n"},
+		{location, line + "5\n"},
+	}
+	for _, tc := range tcs {
+		if got := readFile(t, tc.name); got != tc.want {
+			t.Errorf("%s: want (%s), got (%s)", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestRotateKeepsFileOnError(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+	location := path.Join(dir, "logs.log")
+
+	file, err := writer.NewFile(
+		writer.WithLocation(location),
+		writer.WithMaxSize(25),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// the file can not be renamed to a directory that is not empty.
+	if err := os.MkdirAll(path.Join(location+".1", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	line := strings.Repeat("a", 9) // 10 bytes with the new line
+	writeLines(t, file, line+"1", line+"2")
+	if _, err := file.Write([]byte(line + "3")); err == nil {
+		t.Fatal("want error for rotating the file, got nil")
+	}
+
+	if err := os.RemoveAll(location + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, file, line+"3")
+
+	tcs := []struct {
+		name string
+		want string
+	}{
+		{location + ".1", line + "1\n" + line + "2\n"},
+		{location, line + "3\n"},
+	}
+	for _, tc := range tcs {
+		if got := readFile(t, tc.name); got != tc.want {
+			t.Errorf("%s: want (%s), got (%s)", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestRotateMaxBackups(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+	location := path.Join(dir, "logs.log")
+
+	file, err := writer.NewFile(
+		writer.WithLocation(location),
+		writer.WithMaxSize(10),
+		writer.WithMaxBackups(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writeLines(t, file, "line 1", "line 2", "line 3", "line 4")
+
+	if _, err := os.Stat(location + ".1"); err != nil {
+		t.Errorf("want (%s) to exist, got (%v)", location+".1", err)
+	}
+	if _, err := os.Stat(location + ".2"); !os.IsNotExist(err) {
+		t.Errorf("want (%s) to be removed, got (%v)", location+".2", err)
+	}
+	if got := readFile(t, location+".1"); got != "line 3\n" {
+		t.Errorf("want (line 3), got (%s)", got)
+	}
+}
+
+func TestRotateMaxAge(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+	location := path.Join(dir, "logs.log")
+
+	old := location + ".1"
+	if err := ioutil.WriteFile(old, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := writer.NewFile(
+		writer.WithLocation(location),
+		writer.WithMaxSize(10),
+		writer.WithMaxAge(24*time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writeLines(t, file, "line 1", "line 2")
+
+	if got := readFile(t, location+".1"); got != "line 1\n" {
+		t.Errorf("want (line 1), got (%s)", got)
+	}
+	if _, err := os.Stat(location + ".2"); !os.IsNotExist(err) {
+		t.Errorf("want the old backup to be removed, got (%v)", err)
+	}
+}
+
+func TestRotateOptionErrors(t *testing.T) {
+	file := &writer.File{}
+	if err := writer.WithMaxSize(0)(file); err == nil {
+		t.Error("want error, got nil")
+	}
+	if err := writer.WithMaxBackups(-1)(file); err == nil {
+		t.Error("want error, got nil")
+	}
+	if err := writer.WithMaxAge(-time.Second)(file); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestPatternWithEntryTime(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+
+	file, err := writer.NewFile(
+		writer.WithLocation(path.Join(dir, "%Y-%m-%d.log")),
+		writer.WithTimeSource(writer.EntryTime),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	day1 := `time="2017-01-14T10:00:00+00:00" level=info msg=first`
+	day2 := `time="2017-01-15T10:00:00+00:00" level=info msg=second`
+	writeLines(t, file, day1, day2)
+
+	tcs := []struct {
+		day  time.Time
+		want string
+	}{
+		{time.Date(2017, 1, 14, 10, 0, 0, 0, time.UTC), day1 + "\n"},
+		{time.Date(2017, 1, 15, 10, 0, 0, 0, time.UTC), day2 + "\n"},
+	}
+	for _, tc := range tcs {
+		name := path.Join(dir, tc.day.Local().Format("2006-01-02")+".log")
+		if got := readFile(t, name); got != tc.want {
+			t.Errorf("%s: want (%s), got (%s)", name, tc.want, got)
+		}
+	}
+	if file.Name() != path.Join(dir, "2017-01-15.log") {
+		t.Errorf("want the file to be switched, got (%s)", file.Name())
+	}
+}
+
+func TestPatternWithEntryTimeOpensLazily(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+
+	file, err := writer.NewFile(
+		writer.WithLocation(path.Join(dir, "%Y-%m-%d.log")),
+		writer.WithTimeSource(writer.EntryTime),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("want no files before the first entry, got (%d)", len(files))
+	}
+
+	day := `time="2017-01-14T10:00:00+00:00" level=info msg=first`
+	writeLines(t, file, day)
+	files, err = ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2017, 1, 14, 10, 0, 0, 0, time.UTC).Local().Format("2006-01-02") + ".log"
+	if len(files) != 1 || files[0].Name() != want {
+		t.Errorf("want only (%s), got (%v)", want, files)
+	}
+}
+
+func TestPatternWithClockTime(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+
+	old := path.Join(dir, "2001-01-01.log")
+	if err := ioutil.WriteFile(old, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := writer.NewFile(
+		writer.WithLocation(path.Join(dir, "%Y-%m-%d.log")),
+		writer.WithMaxAge(24*time.Hour),
+		writer.WithMaxSize(10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	want := path.Join(dir, time.Now().Format("2006-01-02")+".log")
+	if file.Name() != want {
+		t.Errorf("want (%s), got (%s)", want, file.Name())
+	}
+
+	writeLines(t, file, "line 1", "line 2") // forcing a rotation
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("want the old period to be removed, got (%v)", err)
+	}
+}
+
+func TestPatternKeepsOtherFiles(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+
+	past := time.Now().Add(-48 * time.Hour)
+	old := path.Join(dir, "2001-01-01.log")
+	notes := path.Join(dir, "my-old-notes.log")
+	for _, name := range []string{old, old + ".1", notes, notes + ".1"} {
+		if err := ioutil.WriteFile(name, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := writer.NewFile(
+		writer.WithLocation(path.Join(dir, "%Y-%m-%d.log")),
+		writer.WithTimeSource(writer.EntryTime),
+		writer.WithMaxAge(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writeLines(t, file,
+		`time="2017-01-14T10:00:00+00:00" level=info msg=first`,
+		`time="2017-01-16T10:00:00+00:00" level=info msg=second`,
+	)
+
+	for _, name := range []string{old, old + ".1"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("want (%s) to be removed, got (%v)", name, err)
+		}
+	}
+	for _, name := range []string{notes, notes + ".1"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("want (%s) to be kept, got (%v)", name, err)
+		}
+	}
+}
+
+func TestCompressRotated(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+	location := path.Join(dir, "logs.log")
+
+	file, err := writer.NewFile(
+		writer.WithLocation(location),
+		writer.WithMaxSize(10),
+		writer.WithCompress("gzip"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writeLines(t, file, "line 1", "line 2", "line 3")
+
+	var content []byte
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		f, err := os.Open(location + ".2.gz")
+		if err != nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err = ioutil.ReadAll(gz)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+
+	if string(content) != "line 1\n" {
+		t.Errorf("want (line 1) in the compressed file, got (%s)", content)
+	}
+	if _, err := os.Stat(location + ".2"); !os.IsNotExist(err) {
+		t.Errorf("want the uncompressed file to be removed, got (%v)", err)
+	}
+}
+
+func TestCompressKeepsOtherFiles(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+
+	old := path.Join(dir, "2001-01-01.log")
+	notes := path.Join(dir, "my-old-notes.log")
+	for _, name := range []string{old, notes} {
+		if err := ioutil.WriteFile(name, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := writer.NewFile(
+		writer.WithLocation(path.Join(dir, "%Y-%m-%d.log")),
+		writer.WithCompress("gzip"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(old + ".gz"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(old + ".gz"); err != nil {
+		t.Errorf("want the old period to be compressed, got (%v)", err)
+	}
+	if got := readFile(t, notes); got != "old" {
+		t.Errorf("want (%s) to be kept, got (%s)", notes, got)
+	}
+	if _, err := os.Stat(notes + ".gz"); !os.IsNotExist(err) {
+		t.Errorf("want (%s) not to be compressed, got (%v)", notes, err)
+	}
+}
+
+func TestCompressUnsupported(t *testing.T) {
+	file := &writer.File{}
+	if err := writer.WithCompress("zstd")(file); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+	location := path.Join(dir, "logs.log")
+
+	file, err := writer.NewFile(writer.WithLocation(location))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writeLines(t, file, "line 1")
+	if err := os.Rename(location, location+".rotated"); err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, file, "line 2") // still going to the moved file
+
+	if err := file.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	writeLines(t, file, "line 3")
+
+	if got := readFile(t, location+".rotated"); got != "line 1\nline 2\n" {
+		t.Errorf("want the first two lines in the moved file, got (%s)", got)
+	}
+	if got := readFile(t, location); got != "line 3\n" {
+		t.Errorf("want (line 3) in the new file, got (%s)", got)
+	}
+}
+
+func TestReopenErrors(t *testing.T) {
+	w, teardown := setup(t)
+	defer teardown()
+
+	file, err := writer.NewFile(writer.WithWriter(w))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Reopen(); err == nil {
+		t.Error("want error for a file without location, got nil")
+	}
+
+	file.Close()
+	if err := file.Reopen(); err != writer.ErrClosed {
+		t.Errorf("want ErrClosed for a closed file, got (%v)", err)
+	}
+}
+
+func TestReopenKeepsFileOnError(t *testing.T) {
+	dir, teardown := setupDir(t)
+	defer teardown()
+	location := path.Join(dir, "logs.log")
+
+	file, err := writer.NewFile(writer.WithLocation(location))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writeLines(t, file, "line 1")
+	if err := os.Rename(location, location+".rotated"); err != nil {
+		t.Fatal(err)
+	}
+	// the location can not be opened as a file.
+	if err := os.Mkdir(location, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Reopen(); err == nil {
+		t.Error("want error for opening a directory, got nil")
+	}
+	writeLines(t, file, "line 2")
+
+	if got := readFile(t, location+".rotated"); got != "line 1\nline 2\n" {
+		t.Errorf("want both lines in the previous file, got (%s)", got)
+	}
+}
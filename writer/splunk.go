@@ -0,0 +1,314 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/arsham/logpipe/tools"
+	"github.com/pkg/errors"
+)
+
+// SplunkHECAckInterval is the delay between the queries of the acknowledgement
+// status of the events.
+var SplunkHECAckInterval = time.Second
+
+// SplunkHEC sends the log entries to a Splunk HTTP Event Collector. Each batch
+// is sent as newline separated events in one request. If acknowledgement is
+// enabled, it waits until Splunk has indexed the events, and sends them again
+// if they are not acknowledged before the timeout. Failed requests are retried
+// if the server responds with a 5xx status code or is not reachable. It
+// implements io.WriteCloser interface.
+type SplunkHEC struct {
+	batch
+	url        string
+	token      string
+	index      string
+	sourceType string
+	source     string
+	host       string
+	channel    string
+	ackTimeout time.Duration
+	client     *http.Client
+}
+
+type splunkEvent struct {
+	Time       json.Number       `json:"time"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	SourceType string            `json:"sourcetype,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Event      map[string]string `json:"event"`
+}
+
+type splunkResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+// NewSplunkHEC returns an error if the url or the token is not provided. It
+// starts a goroutine to send the entries in intervals.
+func NewSplunkHEC(conf ...func(*SplunkHEC) error) (*SplunkHEC, error) {
+	s := &SplunkHEC{}
+	for _, f := range conf {
+		if err := f(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.url == "" {
+		return nil, ErrNoURL
+	}
+	if s.token == "" {
+		return nil, ErrNoToken
+	}
+
+	if s.client == nil {
+		s.client = &http.Client{Timeout: DefaultTimeout}
+	}
+	if s.ackTimeout > 0 {
+		channel, err := newChannel()
+		if err != nil {
+			return nil, errors.Wrap(err, "creating the ack channel")
+		}
+		s.channel = channel
+	}
+
+	s.start(s.url, s.send)
+	return s, nil
+}
+
+// Name returns the url of the collector.
+func (s *SplunkHEC) Name() string { return s.url }
+
+func (s *SplunkHEC) send(entries []*reader.Entry) error {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, e := range entries {
+		event := splunkEvent{
+			Time:       json.Number(fmt.Sprintf("%d.%03d", e.Timestamp.Unix(), e.Timestamp.Nanosecond()/1e6)),
+			Host:       s.host,
+			Source:     s.source,
+			SourceType: s.sourceType,
+			Index:      s.index,
+			Event:      make(map[string]string, len(e.Fields)+2),
+		}
+		for k, v := range e.Fields {
+			event.Event[k] = v
+		}
+		event.Event["level"] = e.Kind
+		event.Event["message"] = e.Message
+		if err := enc.Encode(event); err != nil {
+			return errors.Wrap(err, "encoding the event")
+		}
+	}
+	body := buf.Bytes()
+
+	ackID, err := s.post(body)
+	if err != nil || s.channel == "" {
+		return err
+	}
+	return s.waitForAck(ackID)
+}
+
+// post sends the events and returns the ack id.
+func (s *SplunkHEC) post(body []byte) (int64, error) {
+	req, err := s.request("/services/collector/event", body)
+	if err != nil {
+		return 0, err
+	}
+	resBody, err := post(s.client, req)
+	if err != nil {
+		return 0, errors.Wrap(err, "sending the events")
+	}
+	if s.channel == "" {
+		return 0, nil
+	}
+
+	res := &splunkResponse{}
+	if err := json.Unmarshal(resBody, res); err != nil {
+		return 0, errors.Wrap(err, "decoding the response")
+	}
+	if res.AckID == nil {
+		return 0, errors.New("no ackId in the response, is acknowledgement enabled for the token?")
+	}
+	return *res.AckID, nil
+}
+
+// waitForAck queries the status of the ack id until it is acknowledged, the
+// ack timeout is passed, or the writer is stopped.
+func (s *SplunkHEC) waitForAck(ackID int64) error {
+	body, err := json.Marshal(map[string][]int64{"acks": {ackID}})
+	if err != nil {
+		return errors.Wrap(err, "encoding the ack query")
+	}
+
+	deadline := time.Now().Add(s.ackTimeout)
+	for {
+		req, err := s.request("/services/collector/ack", body)
+		if err != nil {
+			return err
+		}
+		resBody, err := post(s.client, req)
+		if err != nil {
+			return errors.Wrap(err, "querying the ack status")
+		}
+
+		res := &struct {
+			Acks map[string]bool `json:"acks"`
+		}{}
+		if err := json.Unmarshal(resBody, res); err != nil {
+			return errors.Wrap(err, "decoding the ack status")
+		}
+		if res.Acks[strconv.FormatInt(ackID, 10)] {
+			return nil
+		}
+
+		if time.Now().Add(SplunkHECAckInterval).After(deadline) {
+			return fmt.Errorf("events with ack id %d not acknowledged in %s", ackID, s.ackTimeout)
+		}
+		select {
+		case <-time.After(SplunkHECAckInterval):
+		case <-s.stop:
+			return fmt.Errorf("stopped waiting for ack id %d", ackID)
+		}
+	}
+}
+
+func (s *SplunkHEC) request(path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating the request")
+	}
+	req.Header.Set("Authorization", "Splunk "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	if s.channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", s.channel)
+	}
+	return req, nil
+}
+
+// newChannel returns a random UUID for the ack channel.
+func newChannel() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// WithSplunkHECURL sets the url of the collector, without the path. It
+// returns an error if the url is not valid.
+func WithSplunkHECURL(addr string) func(*SplunkHEC) error {
+	return func(s *SplunkHEC) error {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return errors.Wrap(err, "parsing the url")
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return errors.Wrap(ErrNoURL, addr)
+		}
+		s.url = strings.TrimRight(addr, "/")
+		return nil
+	}
+}
+
+// WithSplunkHECToken sets the token of the collector.
+func WithSplunkHECToken(token string) func(*SplunkHEC) error {
+	return func(s *SplunkHEC) error {
+		s.token = token
+		return nil
+	}
+}
+
+// WithSplunkHECIndex sets the index of the events. If not set, the default
+// index of the token is used.
+func WithSplunkHECIndex(index string) func(*SplunkHEC) error {
+	return func(s *SplunkHEC) error {
+		s.index = index
+		return nil
+	}
+}
+
+// WithSplunkHECSourceType sets the sourcetype of the events.
+func WithSplunkHECSourceType(sourceType string) func(*SplunkHEC) error {
+	return func(s *SplunkHEC) error {
+		s.sourceType = sourceType
+		return nil
+	}
+}
+
+// WithSplunkHECSource sets the source of the events.
+func WithSplunkHECSource(source string) func(*SplunkHEC) error {
+	return func(s *SplunkHEC) error {
+		s.source = source
+		return nil
+	}
+}
+
+// WithSplunkHECHost sets the host of the events.
+func WithSplunkHECHost(host string) func(*SplunkHEC) error {
+	return func(s *SplunkHEC) error {
+		s.host = host
+		return nil
+	}
+}
+
+// WithSplunkHECAck enables the acknowledgement of the events. The events are
+// sent again if they are not acknowledged before the timeout.
+func WithSplunkHECAck(timeout time.Duration) func(*SplunkHEC) error {
+	return func(s *SplunkHEC) error {
+		if timeout <= 0 {
+			return fmt.Errorf("low (%s) ack timeout", timeout)
+		}
+		s.ackTimeout = timeout
+		return nil
+	}
+}
+
+// WithSplunkHECRetry sets the number of the attempts of each batch, including
+// the first one, the delay after the first attempt, and the maximum delay
+// between the attempts.
+func WithSplunkHECRetry(attempts int, backoff, max time.Duration) func(*SplunkHEC) error {
+	return func(s *SplunkHEC) error {
+		return s.setRetry(attempts, backoff, max)
+	}
+}
+
+// WithSplunkHECBatch sets the batch size and the delay between sends.
+func WithSplunkHECBatch(size int, delay time.Duration) func(*SplunkHEC) error {
+	return func(s *SplunkHEC) error {
+		return s.setBatch(size, delay)
+	}
+}
+
+// WithSplunkHECClient sets the http client for sending the requests.
+func WithSplunkHECClient(client *http.Client) func(*SplunkHEC) error {
+	return func(s *SplunkHEC) error {
+		s.client = client
+		return nil
+	}
+}
+
+// WithSplunkHECLogger sets the logger for reporting errors occurred while
+// sending the entries in the background.
+func WithSplunkHECLogger(logger tools.FieldLogger) func(*SplunkHEC) error {
+	return func(s *SplunkHEC) error {
+		s.logger = logger
+		return nil
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// hecStub is a stand-in for the Splunk HTTP Event Collector. It acknowledges
+// the events after the number of queries in pending, if ack is enabled.
+type hecStub struct {
+	sync.Mutex
+	ack      bool
+	pending  int
+	requests []*http.Request
+	events   []map[string]interface{}
+	channels []string
+	queries  int
+	nextAck  int
+}
+
+func (h *hecStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	h.requests = append(h.requests, r)
+
+	if r.Header.Get("Authorization") != "Splunk secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"text":"Invalid token","code":4}`)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/services/collector/event":
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			event := make(map[string]interface{})
+			json.Unmarshal(scanner.Bytes(), &event)
+			h.events = append(h.events, event)
+		}
+		if !h.ack {
+			fmt.Fprint(w, `{"text":"Success","code":0}`)
+			return
+		}
+		h.channels = append(h.channels, r.Header.Get("X-Splunk-Request-Channel"))
+		fmt.Fprintf(w, `{"text":"Success","code":0,"ackId":%d}`, h.nextAck)
+		h.nextAck++
+
+	case "/services/collector/ack":
+		h.queries++
+		acks := struct {
+			Acks []int `json:"acks"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&acks)
+		status := make(map[string]bool)
+		for _, id := range acks.Acks {
+			status[fmt.Sprint(id)] = h.queries > h.pending
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"acks": status})
+	}
+}
+
+func (h *hecStub) Events() []map[string]interface{} {
+	h.Lock()
+	defer h.Unlock()
+	return h.events
+}
+
+func (h *hecStub) Requests() []*http.Request {
+	h.Lock()
+	defer h.Unlock()
+	return h.requests
+}
+
+func (h *hecStub) Channels() []string {
+	h.Lock()
+	defer h.Unlock()
+	return h.channels
+}
+
+func (h *hecStub) Queries() int {
+	h.Lock()
+	defer h.Unlock()
+	return h.queries
+}
+
+var _ = Describe("SplunkHEC", func() {
+	var (
+		stub *hecStub
+		ts   *httptest.Server
+		line = []byte(`time="2017-01-14T19:10:10.25Z" level=error msg="something bad happened" app=billing` + "\n")
+	)
+
+	BeforeEach(func() {
+		stub = &hecStub{}
+		ts = httptest.NewServer(stub)
+		writer.SplunkHECAckInterval = time.Millisecond
+	})
+
+	AfterEach(func() {
+		ts.Close()
+		writer.SplunkHECAckInterval = time.Second
+	})
+
+	Context("creating without a url or token", func() {
+		It("should error", func() {
+			_, err := writer.NewSplunkHEC(writer.WithSplunkHECToken("secret"))
+			Expect(err).To(Equal(writer.ErrNoURL))
+			_, err = writer.NewSplunkHEC(writer.WithSplunkHECURL(ts.URL))
+			Expect(err).To(Equal(writer.ErrNoToken))
+		})
+	})
+
+	Context("sending a batch", func() {
+		It("should send newline separated events with the metadata", func() {
+			s, err := writer.NewSplunkHEC(
+				writer.WithSplunkHECURL(ts.URL),
+				writer.WithSplunkHECToken("secret"),
+				writer.WithSplunkHECIndex("main"),
+				writer.WithSplunkHECSourceType("logpipe"),
+				writer.WithSplunkHECSource("billing"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			_, err = s.Write(append(line, line...))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Flush()).To(Succeed())
+
+			Expect(stub.Requests()).To(HaveLen(1))
+			Expect(stub.Requests()[0].Header.Get("X-Splunk-Request-Channel")).To(BeEmpty())
+
+			events := stub.Events()
+			Expect(events).To(HaveLen(2))
+			Expect(events[0]).To(Equal(map[string]interface{}{
+				"time":       1484421010.25,
+				"index":      "main",
+				"sourcetype": "logpipe",
+				"source":     "billing",
+				"event": map[string]interface{}{
+					"level":   "error",
+					"message": "something bad happened",
+					"app":     "billing",
+				},
+			}))
+		})
+	})
+
+	Context("with a wrong token", func() {
+		It("should not retry", func() {
+			s, err := writer.NewSplunkHEC(
+				writer.WithSplunkHECURL(ts.URL),
+				writer.WithSplunkHECToken("wrong"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			_, err = s.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			err = s.Flush()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Invalid token"))
+			Expect(stub.Requests()).To(HaveLen(1))
+		})
+	})
+
+	Context("with acknowledgement", func() {
+		BeforeEach(func() {
+			stub.ack = true
+		})
+
+		It("should wait until the events are acknowledged", func() {
+			stub.pending = 2
+			s, err := writer.NewSplunkHEC(
+				writer.WithSplunkHECURL(ts.URL),
+				writer.WithSplunkHECToken("secret"),
+				writer.WithSplunkHECAck(time.Second),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			_, err = s.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Flush()).To(Succeed())
+
+			Expect(stub.Queries()).To(Equal(3))
+			Expect(stub.Events()).To(HaveLen(1))
+			Expect(stub.Channels()[0]).To(MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+			for _, r := range stub.Requests() {
+				Expect(r.Header.Get("X-Splunk-Request-Channel")).To(Equal(stub.Channels()[0]))
+			}
+		})
+
+		It("should send the events again if they are not acknowledged", func() {
+			stub.pending = 1000
+			s, err := writer.NewSplunkHEC(
+				writer.WithSplunkHECURL(ts.URL),
+				writer.WithSplunkHECToken("secret"),
+				writer.WithSplunkHECAck(20*time.Millisecond),
+				writer.WithSplunkHECRetry(2, time.Millisecond, time.Millisecond),
+				writer.WithSplunkHECLogger(tools.DiscardLogger()),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			_, err = s.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			err = s.Flush()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("not acknowledged"))
+			Expect(stub.Events()).To(HaveLen(2))
+		})
+
+		It("should stop waiting for the ack when stopped", func() {
+			stub.pending = 1000
+			s, err := writer.NewSplunkHEC(
+				writer.WithSplunkHECURL(ts.URL),
+				writer.WithSplunkHECToken("secret"),
+				writer.WithSplunkHECAck(time.Hour),
+				writer.WithSplunkHECLogger(tools.DiscardLogger()),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			_, err = s.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			done := make(chan error)
+			go func() { done <- s.Flush() }()
+			Eventually(stub.Queries).ShouldNot(BeZero())
+			s.Stop()
+
+			var flushErr error
+			Eventually(done).Should(Receive(&flushErr))
+			Expect(flushErr.Error()).To(ContainSubstring("stopped waiting"))
+			Expect(stub.Events()).To(HaveLen(1))
+		})
+
+		It("should error if the token does not have acknowledgement enabled", func() {
+			stub.ack = false
+			s, err := writer.NewSplunkHEC(
+				writer.WithSplunkHECURL(ts.URL),
+				writer.WithSplunkHECToken("secret"),
+				writer.WithSplunkHECAck(time.Second),
+				writer.WithSplunkHECRetry(1, time.Millisecond, time.Millisecond),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			_, err = s.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			err = s.Flush()
+			Expect(err).To(HaveOccurred())
+			Expect(strings.ToLower(err.Error())).To(ContainSubstring("ackid"))
+		})
+	})
+})
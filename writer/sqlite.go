@@ -0,0 +1,227 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package writer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/arsham/logpipe/tools"
+	// registers the sqlite3 driver.
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// SQLiteTimeFormat is the format of the timestamps in the database. It sorts
+// in the chronological order and can be used with the sqlite date functions.
+const SQLiteTimeFormat = "2006-01-02 15:04:05.000"
+
+// SQLitePruneInterval is the interval between applying the retention policy.
+var SQLitePruneInterval = time.Hour
+
+// SQLite inserts the log entries into a table in a sqlite database. The table
+// has timestamp, level and message columns, and the fields of the entries are
+// stored as a JSON object in the fields column. The timestamps are stored in
+// UTC with SQLiteTimeFormat format. The entries are inserted in a transaction
+// when the batch is full or every flush delay. If the retention is set, the
+// older rows are deleted every SQLitePruneInterval. It implements
+// io.WriteCloser interface.
+type SQLite struct {
+	batch
+	path      string
+	table     string
+	retention time.Duration
+	db        *sql.DB
+	insert    string
+	lastPrune time.Time
+}
+
+// NewSQLite returns an error if the path is not provided, or the database can
+// not be set up. It starts a goroutine to insert the entries in intervals.
+func NewSQLite(conf ...func(*SQLite) error) (*SQLite, error) {
+	s := &SQLite{table: "logs"}
+	for _, f := range conf {
+		if err := f(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.path == "" {
+		return nil, ErrNoPath
+	}
+
+	db, err := sql.Open("sqlite3", s.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening the database")
+	}
+	// sqlite only allows one writer at a time.
+	db.SetMaxOpenConns(1)
+	s.db = db
+
+	if err := s.setup(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.prune(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s.insert = fmt.Sprintf(`INSERT INTO %s (timestamp, level, message, fields) VALUES (?, ?, ?, ?)`, s.table)
+	s.start(s.path, s.send)
+	return s, nil
+}
+
+// Name returns the path of the database.
+func (s *SQLite) Name() string { return s.path }
+
+// Close inserts the remaining entries and closes the database.
+func (s *SQLite) Close() error {
+	err := s.batch.Close()
+	if e := s.db.Close(); e != nil && err == nil {
+		err = errors.Wrap(e, "closing the database")
+	}
+	return err
+}
+
+func (s *SQLite) setup() error {
+	statements := []string{
+		`PRAGMA journal_mode=WAL`,
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp TEXT NOT NULL,
+			level     TEXT NOT NULL,
+			message   TEXT NOT NULL,
+			fields    TEXT NOT NULL DEFAULT '{}'
+		)`, s.table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %[1]s_timestamp ON %[1]s (timestamp)`, s.table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %[1]s_level ON %[1]s (level, timestamp)`, s.table),
+	}
+	for _, stmt := range statements {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return errors.Wrap(err, "setting up the database")
+		}
+	}
+	return nil
+}
+
+func (s *SQLite) send(entries []*reader.Entry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "starting the transaction")
+	}
+	stmt, err := tx.Prepare(s.insert)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "preparing the statement")
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		fields := e.Fields
+		if fields == nil {
+			fields = map[string]string{}
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "encoding the fields")
+		}
+		ts := e.Timestamp.UTC().Format(SQLiteTimeFormat)
+		if _, err := stmt.Exec(ts, e.Kind, e.Message, string(b)); err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "inserting the entry")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing the transaction")
+	}
+
+	// the entries are committed, so a failed prune is not an error of the
+	// batch and is only logged.
+	if time.Since(s.lastPrune) < SQLitePruneInterval {
+		return nil
+	}
+	if err := s.prune(); err != nil && s.logger != nil {
+		s.logger.WithField("writer", s.Name()).Error(err)
+	}
+	return nil
+}
+
+// prune deletes the rows older than the retention.
+func (s *SQLite) prune() error {
+	s.lastPrune = time.Now()
+	if s.retention == 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-s.retention).UTC().Format(SQLiteTimeFormat)
+	query := fmt.Sprintf(`DELETE FROM %s WHERE timestamp < ?`, s.table)
+	if _, err := s.db.Exec(query, cutoff); err != nil {
+		return errors.Wrap(err, "removing old rows")
+	}
+	return nil
+}
+
+// WithSQLitePath sets the path of the database file. The file is created if
+// it doesn't exist.
+func WithSQLitePath(path string) func(*SQLite) error {
+	return func(s *SQLite) error {
+		s.path = path
+		return nil
+	}
+}
+
+// WithSQLiteTable sets the name of the table. Default is "logs".
+func WithSQLiteTable(table string) func(*SQLite) error {
+	return func(s *SQLite) error {
+		if !validIdentifier(table) {
+			return fmt.Errorf("invalid (%s) table name", table)
+		}
+		s.table = table
+		return nil
+	}
+}
+
+// WithSQLiteRetention deletes the rows that are older than the given days.
+func WithSQLiteRetention(days int) func(*SQLite) error {
+	return func(s *SQLite) error {
+		if days <= 0 {
+			return fmt.Errorf("low (%d) retention", days)
+		}
+		s.retention = time.Duration(days) * 24 * time.Hour
+		return nil
+	}
+}
+
+// WithSQLiteBatch sets the batch size and the delay between inserts.
+func WithSQLiteBatch(size int, delay time.Duration) func(*SQLite) error {
+	return func(s *SQLite) error {
+		return s.setBatch(size, delay)
+	}
+}
+
+// WithSQLiteRetry sets the number of the attempts of each insert, including the
+// first one, the delay after the first attempt, and the maximum delay between
+// the attempts.
+func WithSQLiteRetry(attempts int, backoff, max time.Duration) func(*SQLite) error {
+	return func(s *SQLite) error {
+		return s.setRetry(attempts, backoff, max)
+	}
+}
+
+// WithSQLiteLogger sets the logger for reporting errors occurred while
+// inserting the entries in the background.
+func WithSQLiteLogger(logger tools.FieldLogger) func(*SQLite) error {
+	return func(s *SQLite) error {
+		s.logger = logger
+		return nil
+	}
+}
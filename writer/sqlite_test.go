@@ -0,0 +1,157 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package writer_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SQLite", func() {
+	var (
+		dir    string
+		dbPath string
+		dbs    []*sql.DB
+		line   = []byte(`time="2017-01-14T19:10:10Z" level=error msg="something bad happened" app=billing` + "\n")
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "sqlite")
+		Expect(err).NotTo(HaveOccurred())
+		dbPath = path.Join(dir, "logs.db")
+	})
+
+	AfterEach(func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+		dbs = nil
+		os.RemoveAll(dir)
+	})
+
+	query := func(q string, args ...interface{}) *sql.Rows {
+		db, err := sql.Open("sqlite3", dbPath)
+		Expect(err).NotTo(HaveOccurred())
+		dbs = append(dbs, db)
+		rows, err := db.Query(q, args...)
+		Expect(err).NotTo(HaveOccurred())
+		return rows
+	}
+
+	Context("creating with bad options", func() {
+		It("should error", func() {
+			_, err := writer.NewSQLite()
+			Expect(err).To(Equal(writer.ErrNoPath))
+			_, err = writer.NewSQLite(writer.WithSQLitePath(dbPath), writer.WithSQLiteTable("logs; drop"))
+			Expect(err).To(HaveOccurred())
+			_, err = writer.NewSQLite(writer.WithSQLitePath(dbPath), writer.WithSQLiteRetention(0))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("writing entries", func() {
+		It("should insert them when the batch is full", func() {
+			s, err := writer.NewSQLite(
+				writer.WithSQLitePath(dbPath),
+				writer.WithSQLiteBatch(2, time.Hour),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			_, err = s.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = s.Write([]byte(`time="2017-01-14T19:10:11Z" level=info msg=second`))
+			Expect(err).NotTo(HaveOccurred())
+
+			rows := query(`SELECT timestamp, level, message, fields FROM logs ORDER BY timestamp`)
+			defer rows.Close()
+			var got []string
+			for rows.Next() {
+				var ts, level, msg, fields string
+				Expect(rows.Scan(&ts, &level, &msg, &fields)).To(Succeed())
+				got = append(got, fmt.Sprintf("%s|%s|%s|%s", ts, level, msg, fields))
+			}
+			Expect(got).To(Equal([]string{
+				`2017-01-14 19:10:10.000|error|something bad happened|{"app":"billing"}`,
+				`2017-01-14 19:10:11.000|info|second|{}`,
+			}))
+		})
+
+		It("should use the WAL mode and create the indexes", func() {
+			s, err := writer.NewSQLite(writer.WithSQLitePath(dbPath))
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			rows := query(`PRAGMA journal_mode`)
+			var mode string
+			Expect(rows.Next()).To(BeTrue())
+			Expect(rows.Scan(&mode)).To(Succeed())
+			rows.Close()
+			Expect(mode).To(Equal("wal"))
+
+			rows = query(`SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = 'logs' ORDER BY name`)
+			defer rows.Close()
+			var indexes []string
+			for rows.Next() {
+				var name string
+				Expect(rows.Scan(&name)).To(Succeed())
+				indexes = append(indexes, name)
+			}
+			Expect(indexes).To(Equal([]string{"logs_level", "logs_timestamp"}))
+		})
+
+		It("should insert the remaining entries on close", func() {
+			s, err := writer.NewSQLite(writer.WithSQLitePath(dbPath), writer.WithSQLiteTable("entries"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = s.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Close()).To(Succeed())
+
+			rows := query(`SELECT COUNT(*) FROM entries`)
+			defer rows.Close()
+			var count int
+			Expect(rows.Next()).To(BeTrue())
+			Expect(rows.Scan(&count)).To(Succeed())
+			Expect(count).To(Equal(1))
+		})
+	})
+
+	Context("with a retention", func() {
+		It("should delete the old rows", func() {
+			s, err := writer.NewSQLite(writer.WithSQLitePath(dbPath))
+			Expect(err).NotTo(HaveOccurred())
+			recent := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+			_, err = s.Write(append(line, []byte(`time="`+recent+`" level=info msg=recent`)...))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Close()).To(Succeed())
+
+			s, err = writer.NewSQLite(writer.WithSQLitePath(dbPath), writer.WithSQLiteRetention(7))
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			rows := query(`SELECT message FROM logs`)
+			defer rows.Close()
+			var messages []string
+			for rows.Next() {
+				var msg string
+				Expect(rows.Scan(&msg)).To(Succeed())
+				messages = append(messages, msg)
+			}
+			Expect(messages).To(Equal([]string{"recent"}))
+		})
+	})
+})
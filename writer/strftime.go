@@ -0,0 +1,142 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// strftime directives supported in file location patterns, and their Go
+// layouts.
+var directives = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'H': "15",
+	'M': "04",
+	'S': "05",
+	'b': "Jan",
+	'a': "Mon",
+}
+
+// expand replaces the strftime directives in the pattern with the values of t
+// in local time. The %j directive is the day of the year, and %% is a literal
+// percent sign. Unknown directives are left untouched.
+func expand(pattern string, t time.Time) string {
+	t = t.Local()
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c != '%' || i == len(pattern)-1 {
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		switch d := pattern[i]; d {
+		case '%':
+			buf.WriteByte('%')
+		case 'j':
+			fmt.Fprintf(buf, "%03d", t.YearDay())
+		default:
+			if layout, ok := directives[d]; ok {
+				buf.WriteString(t.Format(layout))
+				continue
+			}
+			buf.WriteByte('%')
+			buf.WriteByte(d)
+		}
+	}
+	return buf.String()
+}
+
+// patterns of the directives, for matching the expanded file names.
+var directivePatterns = map[byte]string{
+	'Y': `\d{4}`,
+	'y': `\d{2}`,
+	'm': `\d{2}`,
+	'd': `\d{2}`,
+	'H': `\d{2}`,
+	'M': `\d{2}`,
+	'S': `\d{2}`,
+	'j': `\d{3}`,
+	'b': `[A-Z][a-z]{2}`,
+	'a': `[A-Z][a-z]{2}`,
+}
+
+// patternGlob returns a glob that matches all expansions of the pattern. The
+// glob also matches other files, for example *-*-*.log matches notes-old.log,
+// so the names should be checked with patternRegexp.
+func patternGlob(pattern string) string {
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c != '%' || i == len(pattern)-1 {
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		if pattern[i] == '%' {
+			buf.WriteByte('%')
+			continue
+		}
+		buf.WriteByte('*')
+	}
+	return buf.String()
+}
+
+// patternRegexp returns a regexp that only matches the expansions of the
+// pattern, and their rotated or compressed files.
+func patternRegexp(pattern string) *regexp.Regexp {
+	buf := new(bytes.Buffer)
+	buf.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c != '%' || i == len(pattern)-1 {
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+			continue
+		}
+		i++
+		d := pattern[i]
+		if p, ok := directivePatterns[d]; ok {
+			buf.WriteString(p)
+			continue
+		}
+		if d != '%' {
+			buf.WriteString(regexp.QuoteMeta("%"))
+		}
+		buf.WriteString(regexp.QuoteMeta(string(d)))
+	}
+	buf.WriteString(`(\.\d+)?(` + regexp.QuoteMeta(gzipExt) + `)?$`)
+	return regexp.MustCompile(buf.String())
+}
+
+// periodFiles returns the files that are expanded from the pattern, with
+// their rotated and compressed files.
+func periodFiles(pattern string) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	glob := patternGlob(pattern)
+	files, err := filepath.Glob(glob)
+	if err != nil {
+		return nil, err
+	}
+	rotated, err := filepath.Glob(glob + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	re := patternRegexp(pattern)
+	var names []string
+	for _, name := range append(files, rotated...) {
+		if re.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,321 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/reader"
+	"github.com/arsham/logpipe/tools"
+	"github.com/pkg/errors"
+)
+
+// SyslogFormat is the format of the messages sent to the syslog server.
+type SyslogFormat int
+
+// Supported syslog formats.
+const (
+	RFC5424 SyslogFormat = iota
+	RFC3164
+)
+
+// Syslog sends the log entries to a syslog server. The entries' levels are
+// mapped to syslog severities. Over TCP the messages are framed with octet
+// counting, over UDP and unix datagram sockets each message is a datagram, and
+// over unix stream sockets the messages are terminated by new lines. If the
+// server is not reachable it connects on the next write, and if the
+// connection fails, it reconnects and tries once more. It implements
+// io.WriteCloser interface.
+type Syslog struct {
+	sync.Mutex
+	network  string
+	address  string
+	format   SyslogFormat
+	facility int
+	appName  string
+	hostname string
+	conn     net.Conn
+	closed   bool
+	logger   tools.FieldLogger
+}
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3,
+	"auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// severity returns the syslog severity of the level.
+func severity(level string) int {
+	switch level {
+	case reader.ErrorLevel:
+		return 3
+	case reader.WarnLevel:
+		return 4
+	case reader.DebugLevel:
+		return 7
+	}
+	return 6 // informational
+}
+
+// NewSyslog returns an error if the address is not provided. If the server is
+// not reachable, the error is logged and the connection is made on the first
+// write.
+func NewSyslog(conf ...func(*Syslog) error) (*Syslog, error) {
+	s := &Syslog{
+		facility: facilities["user"],
+		appName:  "logpipe",
+	}
+	for _, f := range conf {
+		if err := f(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.address == "" {
+		return nil, ErrNoAddress
+	}
+	if s.hostname == "" {
+		s.hostname, _ = os.Hostname()
+	}
+
+	if err := s.connect(); err != nil && s.logger != nil {
+		s.logger.WithField("writer", s.Name()).Warn(err)
+	}
+	return s, nil
+}
+
+// Name returns the address of the server.
+func (s *Syslog) Name() string { return s.network + "://" + s.address }
+
+// Write sends each line in p as a syslog message.
+func (s *Syslog) Write(p []byte) (int, error) {
+	entries, err := reader.ParseEntries(p)
+	if err != nil {
+		return 0, errors.Wrap(err, "parsing the entry")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	for _, e := range entries {
+		if err := s.send(s.message(e)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Probe connects to the server if it is not connected, so the circuit breaker
+// of a Retry can be closed without an entry.
+func (s *Syslog) Probe() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.conn != nil {
+		return nil
+	}
+	return s.connect()
+}
+
+// Close closes the connection.
+func (s *Syslog) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// send writes the message and reconnects once if it fails. It should be called
+// while the lock is held.
+func (s *Syslog) send(msg []byte) error {
+	var err error
+	for i := 0; i < 2; i++ {
+		if s.conn == nil {
+			if err = s.connect(); err != nil {
+				continue
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
+		if _, err = s.conn.Write(s.frame(msg)); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return errors.Wrap(err, "sending to syslog")
+}
+
+func (s *Syslog) connect() error {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if s.network == "unix" {
+		// unix sockets, like /dev/log, are usually datagram sockets.
+		if conn, err = net.DialTimeout("unixgram", s.address, DefaultTimeout); err == nil {
+			s.network = "unixgram"
+		} else {
+			conn, err = net.DialTimeout("unix", s.address, DefaultTimeout)
+		}
+	} else {
+		conn, err = net.DialTimeout(s.network, s.address, DefaultTimeout)
+	}
+	if err != nil {
+		return errors.Wrap(err, "connecting to syslog")
+	}
+	s.conn = conn
+	return nil
+}
+
+// frame adds the framing of the stream transports to the message.
+func (s *Syslog) frame(msg []byte) []byte {
+	switch s.network {
+	case "tcp", "tcp4", "tcp6":
+		return append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	case "unix":
+		return append(msg, '\n')
+	}
+	return msg
+}
+
+func (s *Syslog) message(e *reader.Entry) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "<%d>", s.facility*8+severity(e.Kind))
+
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if s.format == RFC3164 {
+		fmt.Fprintf(buf, "%s %s %s: %s",
+			e.Timestamp.Format(time.Stamp), s.hostname, s.appName, e.Message)
+		for _, k := range keys {
+			fmt.Fprintf(buf, " %s=%q", k, e.Fields[k])
+		}
+		return buf.Bytes()
+	}
+
+	fmt.Fprintf(buf, "1 %s %s %s - - ",
+		e.Timestamp.Format(time.RFC3339Nano), nilValue(s.hostname), nilValue(s.appName))
+	writeStructuredData(buf, keys, e.Fields)
+	buf.WriteByte(' ')
+	buf.WriteString(e.Message)
+	return buf.Bytes()
+}
+
+// sdEscaper escapes the characters that are not allowed in the structured
+// data param values.
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// writeStructuredData writes the fields as an RFC5424 structured data element.
+// Field names that are not valid param names are skipped.
+func writeStructuredData(buf *bytes.Buffer, keys []string, fields map[string]string) {
+	var params []string
+	for _, k := range keys {
+		if len(k) > 32 || strings.ContainsAny(k, `= ]"`) {
+			continue
+		}
+		params = append(params, fmt.Sprintf(`%s="%s"`, k, sdEscaper.Replace(fields[k])))
+	}
+	if len(params) == 0 {
+		buf.WriteByte('-')
+		return
+	}
+	fmt.Fprintf(buf, "[fields@32473 %s]", strings.Join(params, " "))
+}
+
+func nilValue(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// WithSyslogAddress sets the network and the address of the server. The
+// network can be udp, tcp or unix.
+func WithSyslogAddress(network, address string) func(*Syslog) error {
+	return func(s *Syslog) error {
+		switch network {
+		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6", "unix", "unixgram":
+		default:
+			return fmt.Errorf("unsupported (%s) network", network)
+		}
+		s.network = network
+		s.address = address
+		return nil
+	}
+}
+
+// WithSyslogFormat sets the format of the messages. Default is RFC5424.
+func WithSyslogFormat(format SyslogFormat) func(*Syslog) error {
+	return func(s *Syslog) error {
+		if format != RFC5424 && format != RFC3164 {
+			return fmt.Errorf("unsupported (%d) format", format)
+		}
+		s.format = format
+		return nil
+	}
+}
+
+// WithSyslogFacility sets the facility by its name, for example local0.
+// Default is user.
+func WithSyslogFacility(name string) func(*Syslog) error {
+	return func(s *Syslog) error {
+		facility, ok := facilities[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown (%s) facility", name)
+		}
+		s.facility = facility
+		return nil
+	}
+}
+
+// WithSyslogAppName sets the app name in the messages. Default is logpipe.
+func WithSyslogAppName(appName string) func(*Syslog) error {
+	return func(s *Syslog) error {
+		s.appName = appName
+		return nil
+	}
+}
+
+// WithSyslogHostname sets the hostname in the messages. Default is the
+// hostname of the machine.
+func WithSyslogHostname(hostname string) func(*Syslog) error {
+	return func(s *Syslog) error {
+		s.hostname = hostname
+		return nil
+	}
+}
+
+// WithSyslogLogger sets the logger for reporting the failed connections.
+func WithSyslogLogger(logger tools.FieldLogger) func(*Syslog) error {
+	return func(s *Syslog) error {
+		s.logger = logger
+		return nil
+	}
+}
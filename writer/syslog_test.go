@@ -0,0 +1,260 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+// readFrame reads an octet counted message.
+func readFrame(r *bufio.Reader) string {
+	size, err := r.ReadString(' ')
+	Expect(err).NotTo(HaveOccurred())
+	n, err := strconv.Atoi(strings.TrimSpace(size))
+	Expect(err).NotTo(HaveOccurred())
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	Expect(err).NotTo(HaveOccurred())
+	return string(msg)
+}
+
+var _ = Describe("Syslog", func() {
+	line := []byte(`time="2017-01-14T19:10:10Z" level=error msg="something bad happened" app=billing` + "\n")
+
+	Context("creating without an address", func() {
+		It("should error", func() {
+			s, err := writer.NewSyslog()
+			Expect(err).To(Equal(writer.ErrNoAddress))
+			Expect(s).To(BeNil())
+		})
+	})
+
+	Context("creating with bad options", func() {
+		It("should error", func() {
+			_, err := writer.NewSyslog(writer.WithSyslogAddress("http", "localhost"))
+			Expect(err).To(HaveOccurred())
+			_, err = writer.NewSyslog(writer.WithSyslogFacility("nothing"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("writing over udp", func() {
+		var conn net.PacketConn
+
+		BeforeEach(func() {
+			var err error
+			conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			conn.Close()
+		})
+
+		read := func() string {
+			buf := make([]byte, 1024)
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			Expect(err).NotTo(HaveOccurred())
+			return string(buf[:n])
+		}
+
+		It("should send RFC5424 messages", func() {
+			s, err := writer.NewSyslog(
+				writer.WithSyslogAddress("udp", conn.LocalAddr().String()),
+				writer.WithSyslogFacility("local0"),
+				writer.WithSyslogHostname("web1"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			n, err := s.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(len(line)))
+			Expect(read()).To(Equal(`<131>1 2017-01-14T19:10:10Z web1 logpipe - - [fields@32473 app="billing"] something bad happened`))
+		})
+
+		It("should send RFC3164 messages", func() {
+			s, err := writer.NewSyslog(
+				writer.WithSyslogAddress("udp", conn.LocalAddr().String()),
+				writer.WithSyslogFormat(writer.RFC3164),
+				writer.WithSyslogHostname("web1"),
+				writer.WithSyslogAppName("billing"),
+			)
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			_, err = s.Write([]byte(`time="2017-01-04T19:10:10Z" level=warning msg="disk is full"`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(read()).To(Equal(`<12>Jan  4 19:10:10 web1 billing: disk is full`))
+		})
+	})
+
+	Context("writing over tcp", func() {
+		var l net.Listener
+
+		BeforeEach(func() {
+			var err error
+			l, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			l.Close()
+		})
+
+		It("should frame the messages with their length", func() {
+			s, err := writer.NewSyslog(writer.WithSyslogAddress("tcp", l.Addr().String()))
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			conn, err := l.Accept()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			_, err = s.Write(append(line, line...))
+			Expect(err).NotTo(HaveOccurred())
+
+			r := bufio.NewReader(conn)
+			Expect(readFrame(r)).To(HaveSuffix("something bad happened"))
+			Expect(readFrame(r)).To(HaveSuffix("something bad happened"))
+		})
+
+		It("should reconnect when the connection is closed", func() {
+			s, err := writer.NewSyslog(writer.WithSyslogAddress("tcp", l.Addr().String()))
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			conn, err := l.Accept()
+			Expect(err).NotTo(HaveOccurred())
+			conn.Close()
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err == nil {
+					accepted <- conn
+				}
+			}()
+
+			// The first writes might be accepted by the kernel before the
+			// closed connection is noticed.
+			Eventually(func() error {
+				_, err := s.Write(line)
+				if err != nil {
+					return err
+				}
+				select {
+				case conn := <-accepted:
+					accepted <- conn
+					return nil
+				case <-time.After(50 * time.Millisecond):
+					return errors.New("not reconnected yet")
+				}
+			}, 5*time.Second).Should(Succeed())
+
+			conn = <-accepted
+			defer conn.Close()
+			Expect(readFrame(bufio.NewReader(conn))).To(HaveSuffix("something bad happened"))
+		})
+	})
+
+	Context("creating with an unreachable server", func() {
+		It("should connect on the next write", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			addr := l.Addr().String()
+			l.Close()
+
+			s, err := writer.NewSyslog(writer.WithSyslogAddress("tcp", addr))
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+			_, err = s.Write(line)
+			Expect(err).To(HaveOccurred())
+
+			l, err = net.Listen("tcp", addr)
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Close()
+			_, err = s.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+
+			conn, err := l.Accept()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			Expect(readFrame(bufio.NewReader(conn))).To(HaveSuffix("something bad happened"))
+		})
+
+		It("should connect when probed", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			addr := l.Addr().String()
+			l.Close()
+
+			s, err := writer.NewSyslog(writer.WithSyslogAddress("tcp", addr))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Probe()).NotTo(Succeed())
+
+			l, err = net.Listen("tcp", addr)
+			Expect(err).NotTo(HaveOccurred())
+			defer l.Close()
+			Expect(s.Probe()).To(Succeed())
+			Expect(s.Close()).To(Succeed())
+			Expect(s.Probe()).To(Equal(writer.ErrClosed))
+		})
+	})
+
+	Context("writing to a unix socket", func() {
+		It("should send datagrams", func() {
+			dir, err := ioutil.TempDir("", "syslog")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			addr := path.Join(dir, "log.sock")
+			conn, err := net.ListenPacket("unixgram", addr)
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			s, err := writer.NewSyslog(writer.WithSyslogAddress("unix", addr))
+			Expect(err).NotTo(HaveOccurred())
+			defer s.Close()
+
+			_, err = s.Write(line)
+			Expect(err).NotTo(HaveOccurred())
+
+			buf := make([]byte, 1024)
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf[:n])).To(HavePrefix("<11>1 2017-01-14T19:10:10Z"))
+		})
+	})
+
+	Context("writing to a closed writer", func() {
+		It("should error", func() {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			s, err := writer.NewSyslog(writer.WithSyslogAddress("udp", conn.LocalAddr().String()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Close()).To(Succeed())
+			_, err = s.Write(line)
+			Expect(err).To(Equal(writer.ErrClosed))
+		})
+	})
+})
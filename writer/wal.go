@@ -0,0 +1,703 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/pkg/errors"
+)
+
+// DefaultWALSegmentSize is the size of the segment files after which a new
+// one is started.
+const DefaultWALSegmentSize = 16 << 20
+
+// WALRetryDelay is the delay before writing a failed entry again. It is
+// doubled after each failure, up to WALMaxRetryDelay.
+var WALRetryDelay = time.Second
+
+// WALMaxRetryDelay is the maximum delay between writing an entry again into a
+// failing writer.
+var WALMaxRetryDelay = 30 * time.Second
+
+// WALCursorInterval is the interval of recording the position of the last
+// entry that has been written into the writer.
+var WALCursorInterval = time.Second
+
+// SyncMode decides when the written data is synced to the disk.
+type SyncMode int
+
+const (
+	// SyncNever leaves syncing to the operating system.
+	SyncNever SyncMode = iota
+
+	// SyncInterval syncs in intervals.
+	SyncInterval
+
+	// SyncAlways syncs after each write.
+	SyncAlways
+)
+
+// ParseSyncMode returns the mode from its name, which is one of never,
+// interval or always.
+func ParseSyncMode(name string) (SyncMode, error) {
+	switch strings.ToLower(name) {
+	case "never":
+		return SyncNever, nil
+	case "interval":
+		return SyncInterval, nil
+	case "always":
+		return SyncAlways, nil
+	}
+	return SyncNever, fmt.Errorf("unknown fsync mode: %s", name)
+}
+
+// walHeader is the size of the lengths of the entry and its payload, and the
+// checksum of each record.
+const walHeader = 12
+
+// WAL records the entries in segment files on disk before they are written
+// into the writer, so they survive restarts and outages of the destination.
+// A worker writes the entries into the writer in order, and writes the
+// failed ones again until they succeed, or until it gives up on them if the
+// number of the attempts is limited, see WithWALAttempts. The entries that
+// are not written when the WAL is closed are written again when it is
+// opened. Because the position of the written entries is recorded in
+// intervals, some entries might be written twice after a crash. It
+// implements io.WriteCloser interface.
+type WAL struct {
+	w            io.Writer
+	name         string
+	dir          string
+	maxSize      int64
+	segmentSize  int64
+	syncMode     SyncMode
+	syncInterval time.Duration
+	retryDelay   time.Duration
+	attempts     int // gives up on the entries after this many attempts
+	onFailure    func(p, payload []byte, err error)
+	logger       tools.FieldLogger
+
+	// mu guards the following fields.
+	mu      sync.Mutex
+	segment *os.File
+	seq     uint64
+	segSize int64
+	sizes   map[uint64]int64
+	doneSeq uint64 // position of the entries that are written into w
+	doneOff int64
+	dirty   bool
+	closed  bool
+
+	notify chan struct{}
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewWAL returns an error if the directory is not provided or can not be
+// created. It starts writing the entries of the previous run into the writer.
+func NewWAL(w io.Writer, conf ...func(*WAL) error) (*WAL, error) {
+	if w == nil {
+		return nil, errors.New("nil writer")
+	}
+	l := &WAL{
+		w:            w,
+		segmentSize:  DefaultWALSegmentSize,
+		syncInterval: time.Second,
+		retryDelay:   WALRetryDelay,
+		sizes:        make(map[uint64]int64),
+		notify:       make(chan struct{}, 1),
+		quit:         make(chan struct{}),
+	}
+	for _, f := range conf {
+		if err := f(l); err != nil {
+			return nil, err
+		}
+	}
+	if l.dir == "" {
+		return nil, ErrNoPath
+	}
+	if err := os.MkdirAll(l.dir, 0750); err != nil {
+		return nil, errors.Wrap(err, "creating the wal directory")
+	}
+
+	seqs, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	cursorSeq, cursorOff, err := l.readCursor()
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range seqs {
+		if seq < cursorSeq {
+			// already written, but not removed.
+			os.Remove(l.segmentPath(seq))
+			continue
+		}
+		info, err := os.Stat(l.segmentPath(seq))
+		if err != nil {
+			return nil, errors.Wrap(err, "reading the segment")
+		}
+		l.sizes[seq] = info.Size()
+	}
+	if len(seqs) > 0 {
+		l.seq = seqs[len(seqs)-1]
+	}
+	if _, ok := l.sizes[cursorSeq]; !ok {
+		// start from the oldest segment, or the one that is about to be
+		// created.
+		cursorSeq, cursorOff = l.seq+1, 0
+		for seq := range l.sizes {
+			if seq < cursorSeq {
+				cursorSeq = seq
+			}
+		}
+	}
+	l.doneSeq, l.doneOff = cursorSeq, cursorOff
+	if err := l.startSegment(); err != nil {
+		return nil, err
+	}
+
+	l.wg.Add(1)
+	go l.work(cursorSeq, cursorOff)
+	if l.syncMode == SyncInterval {
+		l.wg.Add(1)
+		go l.syncEvery()
+	}
+	return l, nil
+}
+
+// Name returns the name of the WAL. If it is not set, the name of the writer
+// is used.
+func (l *WAL) Name() string {
+	if l.name != "" {
+		return l.name
+	}
+	if n, ok := l.w.(namer); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", l.w)
+}
+
+// Writer returns the writer of the WAL.
+func (l *WAL) Writer() io.Writer { return l.w }
+
+// Size returns the size of the entries that are not written into the writer
+// yet.
+func (l *WAL) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pending()
+}
+
+// pending returns the size of the records after the position of the written
+// entries. The segments before the position are already removed.
+func (l *WAL) pending() int64 {
+	var total int64
+	for _, s := range l.sizes {
+		total += s
+	}
+	if _, ok := l.sizes[l.doneSeq]; ok {
+		total -= l.doneOff
+	}
+	return total
+}
+
+// written reports whether all entries of the current segment are written
+// into the writer.
+func (l *WAL) written() bool {
+	return l.doneSeq == l.seq && l.doneOff >= l.segSize
+}
+
+// Write records p in the current segment, and returns when it is recorded.
+// It returns an error if recording p would exceed the maximum size with the
+// entries that are not written yet. A new segment is started when the current
+// one is full, or when all of its entries are written and it has reached the
+// maximum size, so the written entries can be removed.
+func (l *WAL) Write(p []byte) (int, error) {
+	return l.write(p, nil)
+}
+
+// write records p with the payload of its entries, which is passed to the
+// failure callback if the WAL gives up on p.
+func (l *WAL) write(p, payload []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	record := make([]byte, walHeader+len(p)+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(p)))
+	binary.BigEndian.PutUint32(record[4:], uint32(len(payload)))
+	copy(record[walHeader:], p)
+	copy(record[walHeader+len(p):], payload)
+	binary.BigEndian.PutUint32(record[8:], crc32.ChecksumIEEE(record[walHeader:]))
+	if l.maxSize > 0 && l.pending()+int64(len(record)) > l.maxSize {
+		return 0, ErrWALFull
+	}
+
+	full := l.segSize+int64(len(record)) > l.segmentSize
+	if l.maxSize > 0 && l.written() && l.segSize+int64(len(record)) > l.maxSize {
+		full = true
+	}
+	if l.segment == nil || l.segSize > 0 && full {
+		if err := l.closeSegment(); err != nil {
+			return 0, err
+		}
+		if err := l.startSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.segment.Write(record)
+	l.segSize += int64(n)
+	l.sizes[l.seq] = l.segSize
+	if err != nil {
+		return 0, errors.Wrap(err, "recording the entry")
+	}
+	l.dirty = true
+	if l.syncMode == SyncAlways {
+		if err := l.sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// Flush syncs the recorded entries to the disk, regardless of the sync mode.
+func (l *WAL) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty || l.segment == nil {
+		return nil
+	}
+	l.dirty = false
+	return errors.Wrap(l.segment.Sync(), "syncing the segment")
+}
+
+// submit records p and its payload and calls done with the result, so the
+// entry is recorded when Distribute.Send returns.
+func (l *WAL) submit(p, payload []byte, done func(n int, err error)) {
+	done(l.write(p, payload))
+}
+
+// Close stops accepting new entries and syncs the current segment. It waits
+// for the entry that is being written into the writer. The rest of the
+// entries are written when the WAL is opened again.
+func (l *WAL) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	err := l.closeSegment()
+	l.mu.Unlock()
+
+	close(l.quit)
+	l.wg.Wait()
+	return err
+}
+
+func (l *WAL) segmentPath(seq uint64) string {
+	return path.Join(l.dir, fmt.Sprintf("%020d.seg", seq))
+}
+
+// segments returns the sequence numbers of the segments in order.
+func (l *WAL) segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the wal directory")
+	}
+	var seqs []uint64
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// startSegment starts a new segment. The segments of the previous runs are
+// never appended to, as they might end with a partially written record.
+func (l *WAL) startSegment() error {
+	f, err := os.OpenFile(l.segmentPath(l.seq+1), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0640)
+	if err != nil {
+		return errors.Wrap(err, "creating the segment")
+	}
+	l.seq++
+	l.segment = f
+	l.segSize = 0
+	l.sizes[l.seq] = 0
+	return nil
+}
+
+func (l *WAL) closeSegment() error {
+	if l.segment == nil {
+		return nil
+	}
+	err := l.sync()
+	if e := l.segment.Close(); e != nil && err == nil {
+		err = errors.Wrap(e, "closing the segment")
+	}
+	l.segment = nil
+	return err
+}
+
+func (l *WAL) sync() error {
+	if !l.dirty || l.syncMode == SyncNever || l.segment == nil {
+		return nil
+	}
+	l.dirty = false
+	return errors.Wrap(l.segment.Sync(), "syncing the segment")
+}
+
+func (l *WAL) syncEvery() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			if err := l.sync(); err != nil && l.logger != nil {
+				l.logger.WithField("writer", l.Name()).Error(err)
+			}
+			l.mu.Unlock()
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+// segmentState returns the size of the segment, and whether entries are
+// still added to it.
+func (l *WAL) segmentState(seq uint64) (size int64, current bool, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size, ok = l.sizes[seq]
+	return size, seq == l.seq, ok
+}
+
+// work writes the entries from the position of seq and offset, until the WAL
+// is closed.
+func (l *WAL) work(seq uint64, offset int64) {
+	defer l.wg.Done()
+	var (
+		f         *os.File
+		lastSaved = time.Now()
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		l.saveCursor(seq, offset)
+	}()
+
+	for {
+		select {
+		case <-l.quit:
+			return
+		default:
+		}
+
+		size, current, ok := l.segmentState(seq)
+		if !ok {
+			return
+		}
+		if offset >= size {
+			if current {
+				select {
+				case <-l.notify:
+				case <-l.quit:
+				}
+				continue
+			}
+			if f != nil {
+				f.Close()
+				f = nil
+			}
+			l.removeSegment(seq)
+			seq, offset = seq+1, 0
+			l.advance(seq, offset)
+			l.saveCursor(seq, offset)
+			lastSaved = time.Now()
+			continue
+		}
+
+		if f == nil {
+			var err error
+			if f, err = os.Open(l.segmentPath(seq)); err != nil {
+				l.logError(errors.Wrap(err, "opening the segment"))
+				return
+			}
+		}
+		p, payload, err := readRecord(f, offset, size)
+		if err != nil {
+			// the rest of the segment is not usable.
+			l.logError(errors.Wrapf(err, "reading segment %d at %d", seq, offset))
+			offset = size
+			l.advance(seq, offset)
+			continue
+		}
+		if !l.writeEntry(p, payload) {
+			return
+		}
+		offset += int64(walHeader + len(p) + len(payload))
+		l.advance(seq, offset)
+		if time.Since(lastSaved) >= WALCursorInterval {
+			l.saveCursor(seq, offset)
+			lastSaved = time.Now()
+		}
+	}
+}
+
+// advance records the position of the written entries.
+func (l *WAL) advance(seq uint64, offset int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.doneSeq, l.doneOff = seq, offset
+}
+
+// writeEntry writes p into the writer, and writes it again with an increasing
+// delay until it succeeds or the attempts run out. It returns false if the
+// WAL is closed before the entry is written.
+func (l *WAL) writeEntry(p, payload []byte) bool {
+	delay := l.retryDelay
+	for attempt := 1; ; attempt++ {
+		r := safeWritePayload(l.w, p, payload)
+		if r.err == nil {
+			return true
+		}
+		if l.attempts > 0 && attempt >= l.attempts {
+			l.giveUp(p, payload, &RetryError{Attempts: attempt, Err: r.err})
+			return true
+		}
+		if l.logger != nil {
+			l.logger.WithField("writer", l.Name()).
+				Warnf("writing the entry failed, trying again in %s: %s", delay, r.err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-l.quit:
+			return false
+		}
+		if delay *= 2; delay > WALMaxRetryDelay {
+			delay = WALMaxRetryDelay
+		}
+	}
+}
+
+// giveUp passes p to the failure callback, or logs the error if there is no
+// callback.
+func (l *WAL) giveUp(p, payload []byte, err error) {
+	if l.onFailure != nil {
+		l.onFailure(p, payload, err)
+		return
+	}
+	l.logError(errors.Wrap(err, "dropping the entry"))
+}
+
+// readRecord returns the entry and its payload of the record at offset, and
+// returns an error if the record is not complete or its checksum doesn't
+// match.
+func readRecord(f *os.File, offset, size int64) ([]byte, []byte, error) {
+	if size-offset < walHeader {
+		return nil, nil, errors.New("incomplete record header")
+	}
+	header := make([]byte, walHeader)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header))
+	payloadLength := int64(binary.BigEndian.Uint32(header[4:]))
+	if size-offset-walHeader < length+payloadLength {
+		return nil, nil, errors.New("incomplete record")
+	}
+	body := make([]byte, length+payloadLength)
+	if _, err := f.ReadAt(body, offset+walHeader); err != nil {
+		return nil, nil, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[8:]) {
+		return nil, nil, errors.New("checksum mismatch")
+	}
+	if payloadLength == 0 {
+		return body, nil, nil
+	}
+	return body[:length], body[length:], nil
+}
+
+func (l *WAL) removeSegment(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sizes, seq)
+	if err := os.Remove(l.segmentPath(seq)); err != nil {
+		l.logError(errors.Wrap(err, "removing the segment"))
+	}
+}
+
+func (l *WAL) cursorPath() string { return path.Join(l.dir, "cursor") }
+
+// readCursor returns the position of the last written entry. It returns zeros
+// if there is no cursor file.
+func (l *WAL) readCursor() (uint64, int64, error) {
+	b, err := ioutil.ReadFile(l.cursorPath())
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "reading the cursor")
+	}
+	var (
+		seq    uint64
+		offset int64
+	)
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seq, &offset); err != nil {
+		return 0, 0, errors.Wrap(err, "parsing the cursor")
+	}
+	return seq, offset, nil
+}
+
+// saveCursor records the position in a temporary file and renames it, so the
+// cursor file is always complete.
+func (l *WAL) saveCursor(seq uint64, offset int64) {
+	tmp := l.cursorPath() + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", seq, offset)), 0640)
+	if err == nil {
+		err = os.Rename(tmp, l.cursorPath())
+	}
+	if err != nil {
+		l.logError(errors.Wrap(err, "saving the cursor"))
+	}
+}
+
+func (l *WAL) logError(err error) {
+	if l.logger != nil {
+		l.logger.WithField("writer", l.Name()).Error(err)
+	}
+}
+
+// WithWALDir sets the directory of the segments. Each writer should have its
+// own directory.
+func WithWALDir(dir string) func(*WAL) error {
+	return func(l *WAL) error {
+		l.dir = dir
+		return nil
+	}
+}
+
+// WithWALName sets the name of the WAL for the errors.
+func WithWALName(name string) func(*WAL) error {
+	return func(l *WAL) error {
+		l.name = name
+		return nil
+	}
+}
+
+// WithWALMaxSize sets the maximum size of the entries that are not written
+// into the writer yet. The entries that would exceed it are refused with
+// ErrWALFull. Zero means no limit, which is the default.
+func WithWALMaxSize(size int64) func(*WAL) error {
+	return func(l *WAL) error {
+		if size < 0 {
+			return fmt.Errorf("negative (%d) max size", size)
+		}
+		l.maxSize = size
+		return nil
+	}
+}
+
+// WithWALSegmentSize sets the size of the segment files.
+func WithWALSegmentSize(size int64) func(*WAL) error {
+	return func(l *WAL) error {
+		if size <= walHeader {
+			return fmt.Errorf("low (%d) segment size", size)
+		}
+		l.segmentSize = size
+		return nil
+	}
+}
+
+// WithWALSync sets when the segments are synced to the disk. The interval is
+// only used with SyncInterval. Default is SyncNever.
+func WithWALSync(mode SyncMode, interval time.Duration) func(*WAL) error {
+	return func(l *WAL) error {
+		if mode == SyncInterval && interval <= 0 {
+			return fmt.Errorf("low (%s) sync interval", interval)
+		}
+		l.syncMode = mode
+		l.syncInterval = interval
+		return nil
+	}
+}
+
+// WithWALRetryDelay sets the delay before writing a failed entry again. The
+// delay is doubled after each failure, up to WALMaxRetryDelay.
+func WithWALRetryDelay(delay time.Duration) func(*WAL) error {
+	return func(l *WAL) error {
+		if delay <= 0 {
+			return fmt.Errorf("low (%s) retry delay", delay)
+		}
+		l.retryDelay = delay
+		return nil
+	}
+}
+
+// WithWALAttempts sets the number of the times each entry is written before
+// the WAL gives up on it, and passes it to the failure callback. Zero means
+// the entries are written until they succeed, which is the default.
+func WithWALAttempts(n int) func(*WAL) error {
+	return func(l *WAL) error {
+		if n < 0 {
+			return fmt.Errorf("invalid (%d) attempts", n)
+		}
+		l.attempts = n
+		return nil
+	}
+}
+
+// WithWALOnFailure sets the function that is called with the entries that the
+// WAL gives up on. The entries are the bytes that were written into the WAL,
+// and the payload is the JSON payload of the entries if it was recorded with
+// them, for example by a Distribute with a payload.
+func WithWALOnFailure(f func(p, payload []byte, err error)) func(*WAL) error {
+	return func(l *WAL) error {
+		l.onFailure = f
+		return nil
+	}
+}
+
+// WithWALLogger sets the logger for reporting the errors of the writer.
+func WithWALLogger(logger tools.FieldLogger) func(*WAL) error {
+	return func(l *WAL) error {
+		l.logger = logger
+		return nil
+	}
+}
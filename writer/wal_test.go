@@ -0,0 +1,275 @@
+// Copyright 2017 Arsham Shirvani <arshamshirvani@gmail.com>. All rights reserved.
+// Use of this source code is governed by the Apache 2.0 license
+// License that can be found in the LICENSE file.
+
+package writer_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/arsham/logpipe/tools"
+	"github.com/arsham/logpipe/writer"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// recorder records the writes, and fails while failing is true.
+type recorder struct {
+	sync.Mutex
+	failing bool
+	writes  []string
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.failing {
+		return 0, errors.New("destination is down")
+	}
+	r.writes = append(r.writes, string(p))
+	return len(p), nil
+}
+
+func (r *recorder) Writes() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.writes...)
+}
+
+func (r *recorder) SetFailing(failing bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.failing = failing
+}
+
+var _ = Describe("WAL", func() {
+	var (
+		dir string
+		rec *recorder
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "wal")
+		Expect(err).NotTo(HaveOccurred())
+		rec = &recorder{}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	newWAL := func(w *recorder, opts ...func(*writer.WAL) error) *writer.WAL {
+		opts = append([]func(*writer.WAL) error{
+			writer.WithWALDir(dir),
+			writer.WithWALRetryDelay(time.Millisecond),
+			writer.WithWALLogger(tools.DiscardLogger()),
+		}, opts...)
+		l, err := writer.NewWAL(w, opts...)
+		Expect(err).NotTo(HaveOccurred())
+		return l
+	}
+
+	segments := func() []string {
+		files, _ := filepath.Glob(path.Join(dir, "*.seg"))
+		return files
+	}
+
+	DescribeTable("parsing the sync mode", func(name string, expected writer.SyncMode, fails bool) {
+		mode, err := writer.ParseSyncMode(name)
+		if fails {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mode).To(Equal(expected))
+	},
+		Entry("never", "never", writer.SyncNever, false),
+		Entry("interval", "interval", writer.SyncInterval, false),
+		Entry("always", "Always", writer.SyncAlways, false),
+		Entry("unknown", "sometimes", writer.SyncNever, true),
+	)
+
+	It("should error without a directory", func() {
+		_, err := writer.NewWAL(rec)
+		Expect(err).To(Equal(writer.ErrNoPath))
+	})
+
+	It("should write the entries into the writer in order", func() {
+		l := newWAL(rec, writer.WithWALSync(writer.SyncAlways, 0))
+		defer l.Close()
+		for _, entry := range []string{"first", "second", "third"} {
+			n, err := l.Write([]byte(entry))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(len(entry)))
+		}
+		Eventually(rec.Writes).Should(Equal([]string{"first", "second", "third"}))
+	})
+
+	It("should write the failed entries again until they succeed", func() {
+		rec.SetFailing(true)
+		l := newWAL(rec)
+		defer l.Close()
+		_, err := l.Write([]byte("entry"))
+		Expect(err).NotTo(HaveOccurred())
+		Consistently(rec.Writes, 0.05).Should(BeEmpty())
+
+		rec.SetFailing(false)
+		Eventually(rec.Writes).Should(Equal([]string{"entry"}))
+	})
+
+	It("should write the entries of the previous run when it is opened", func() {
+		rec.SetFailing(true)
+		l := newWAL(rec)
+		for _, entry := range []string{"first", "second"} {
+			_, err := l.Write([]byte(entry))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(l.Close()).To(Succeed())
+		_, err := l.Write([]byte("late"))
+		Expect(err).To(Equal(writer.ErrClosed))
+
+		next := &recorder{}
+		l = newWAL(next)
+		Eventually(next.Writes).Should(Equal([]string{"first", "second"}))
+		Expect(l.Close()).To(Succeed())
+
+		By("not writing them again after they are written")
+		last := &recorder{}
+		l = newWAL(last)
+		defer l.Close()
+		Consistently(last.Writes, 0.05).Should(BeEmpty())
+		Expect(segments()).To(HaveLen(1))
+	})
+
+	It("should remove the segments after they are written", func() {
+		l := newWAL(rec, writer.WithWALSegmentSize(20))
+		defer l.Close()
+		for _, entry := range []string{"entry 1", "entry 2", "entry 3"} {
+			_, err := l.Write([]byte(entry))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Eventually(rec.Writes).Should(HaveLen(3))
+		Eventually(segments).Should(HaveLen(1))
+	})
+
+	It("should refuse the entries that exceed the max size", func() {
+		rec.SetFailing(true)
+		l := newWAL(rec, writer.WithWALMaxSize(30))
+		defer l.Close()
+		_, err := l.Write([]byte("0123456789"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = l.Write([]byte("0123456789"))
+		Expect(err).To(Equal(writer.ErrWALFull))
+		Expect(l.Size()).To(BeEquivalentTo(22))
+	})
+
+	It("should only count the entries that are not written against the max size", func() {
+		l := newWAL(rec, writer.WithWALMaxSize(64))
+		defer l.Close()
+		for i := 0; i < 20; i++ {
+			_, err := l.Write([]byte("0123456789"))
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(rec.Writes).Should(HaveLen(i + 1))
+		}
+		Eventually(l.Size).Should(BeZero())
+
+		By("removing the written entries from the disk")
+		Eventually(segments).Should(HaveLen(1))
+		info, err := os.Stat(segments()[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Size()).To(BeNumerically("<=", 64))
+	})
+
+	It("should give up on the entries after the attempts", func() {
+		var (
+			mu     sync.Mutex
+			failed []string
+			errs   []error
+		)
+		rec.SetFailing(true)
+		l := newWAL(rec,
+			writer.WithWALAttempts(2),
+			writer.WithWALOnFailure(func(p, payload []byte, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				failed = append(failed, string(p))
+				errs = append(errs, err)
+			}),
+		)
+		defer l.Close()
+		_, err := l.Write([]byte("entry"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return failed
+		}).Should(Equal([]string{"entry"}))
+		mu.Lock()
+		Expect(errs[0]).To(BeAssignableToTypeOf(&writer.RetryError{}))
+		Expect(errs[0].(*writer.RetryError).Attempts).To(Equal(2))
+		mu.Unlock()
+		Eventually(l.Size).Should(BeZero())
+
+		By("writing the next entries")
+		rec.SetFailing(false)
+		_, err = l.Write([]byte("next"))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(rec.Writes).Should(Equal([]string{"next"}))
+	})
+
+	It("should pass the payload of the entries to the failure callback", func() {
+		payloads := make(chan string, 1)
+		rec.SetFailing(true)
+		l := newWAL(rec,
+			writer.WithWALAttempts(1),
+			writer.WithWALOnFailure(func(p, payload []byte, err error) {
+				payloads <- string(payload)
+			}),
+		)
+		defer l.Close()
+		d, err := writer.NewDistributeWith(
+			writer.WithDistributeWriters(l),
+			writer.WithDistributePayload([]byte(`{"message":"entry"}`)),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = d.Write([]byte("entry"))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(payloads).Should(Receive(Equal(`{"message":"entry"}`)))
+	})
+
+	It("should error on negative attempts", func() {
+		_, err := writer.NewWAL(rec, writer.WithWALDir(dir), writer.WithWALAttempts(-1))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should skip the partially written records", func() {
+		l := newWAL(&recorder{failing: true})
+		_, err := l.Write([]byte("complete"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(l.Close()).To(Succeed())
+
+		files := segments()
+		Expect(files).To(HaveLen(1))
+		f, err := os.OpenFile(files[0], os.O_APPEND|os.O_WRONLY, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, 'p', 'a', 'r'})
+		Expect(err).NotTo(HaveOccurred())
+		f.Close()
+
+		l = newWAL(rec)
+		defer l.Close()
+		Eventually(rec.Writes).Should(Equal([]string{"complete"}))
+		_, err = l.Write([]byte("new"))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(rec.Writes).Should(Equal([]string{"complete", "new"}))
+	})
+})